@@ -2,10 +2,12 @@ package api
 
 import (
 	"log"
+	"net/http"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/upgrade"
 )
 
 /* gin app */
@@ -19,7 +21,8 @@ func init() {
 }
 
 /**
- * Starts REST API server
+ * Starts REST API server listening synchronously,
+ * so listener inherited on upgrade is taken over before return
  */
 func Start(cfg config.ApiConfig) {
 
@@ -55,19 +58,27 @@ func Start(cfg config.ApiConfig) {
 	/* attach endpoints */
 	attachRoot(r)
 	attachServers(r)
+	attachBackends(r)
+	attachFirewall(r)
 
-	var err error
-	/* start rest api server */
-	if cfg.Tls != nil {
-		log.Printf("[INFO] Starting HTTPS server %s", cfg.Bind)
-		err = app.RunTLS(cfg.Bind, cfg.Tls.CertPath, cfg.Tls.KeyPath)
-	} else {
-		log.Printf("[INFO] Starting HTTP server %s", cfg.Bind)
-		err = app.Run(cfg.Bind)
-	}
-
+	listener, err := upgrade.Listen(cfg.Bind)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	/* start rest api server */
+	go func() {
+		if cfg.Tls != nil {
+			log.Printf("[INFO] Starting HTTPS server %s", cfg.Bind)
+			err = http.ServeTLS(listener, app, cfg.Tls.CertPath, cfg.Tls.KeyPath)
+		} else {
+			log.Printf("[INFO] Starting HTTP server %s", cfg.Bind)
+			err = http.Serve(listener, app)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
 }
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/manager"
+)
+
+/**
+ * Attaches /servers/:name/backends handlers
+ */
+func attachBackends(app *gin.RouterGroup) {
+
+	/**
+	 * List backends of the server with stats
+	 */
+	app.GET("/servers/:name/backends", func(c *gin.Context) {
+
+		backends, err := manager.Backends(c.Param("name"))
+		if err != nil {
+			c.IndentedJSON(http.StatusNotFound, err.Error())
+			return
+		}
+
+		list, err := backends.ListBackends()
+		if err != nil {
+			backendError(c, err)
+			return
+		}
+
+		c.IndentedJSON(http.StatusOK, list)
+	})
+
+	/**
+	 * Add backend to the server
+	 */
+	app.POST("/servers/:name/backends", func(c *gin.Context) {
+
+		backends, err := manager.Backends(c.Param("name"))
+		if err != nil {
+			c.IndentedJSON(http.StatusNotFound, err.Error())
+			return
+		}
+
+		backend := core.Backend{}
+		if err := c.BindJSON(&backend); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if backend.Host == "" || backend.Port == "" {
+			c.IndentedJSON(http.StatusBadRequest, "Need host and port of backend")
+			return
+		}
+		if backend.Weight <= 0 {
+			backend.Weight = 1
+		}
+		if backend.Priority <= 0 {
+			backend.Priority = 1
+		}
+
+		if err := backends.AddBackend(backend); err != nil {
+			if err == core.ErrServerStopped {
+				backendError(c, err)
+				return
+			}
+			c.IndentedJSON(http.StatusConflict, err.Error())
+			return
+		}
+
+		c.IndentedJSON(http.StatusOK, nil)
+	})
+
+	/**
+	 * Change backend weight, priority or state (active | drain | disabled)
+	 */
+	app.PUT("/servers/:name/backends/:backend", func(c *gin.Context) {
+
+		backends, target, ok := findBackend(c)
+		if !ok {
+			return
+		}
+
+		update := core.BackendUpdate{}
+		if err := c.BindJSON(&update); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := backends.UpdateBackend(target, update); err != nil {
+			backendError(c, err)
+			return
+		}
+
+		c.IndentedJSON(http.StatusOK, nil)
+	})
+
+	/**
+	 * Remove backend from the server
+	 */
+	app.DELETE("/servers/:name/backends/:backend", func(c *gin.Context) {
+
+		backends, target, ok := findBackend(c)
+		if !ok {
+			return
+		}
+
+		if err := backends.RemoveBackend(target); err != nil {
+			backendError(c, err)
+			return
+		}
+
+		c.IndentedJSON(http.StatusOK, nil)
+	})
+}
+
+/**
+ * Get backends manager and target "host:port" from request params,
+ * responds with error if there are no such
+ */
+func findBackend(c *gin.Context) (core.BackendsManager, core.Target, bool) {
+
+	backends, err := manager.Backends(c.Param("name"))
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, err.Error())
+		return nil, core.Target{}, false
+	}
+
+	backend, err := core.ParseBackendDefault(c.Param("backend"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, err.Error())
+		return nil, core.Target{}, false
+	}
+
+	return backends, backend.Target, true
+}
+
+/**
+ * Respond with backend management error
+ */
+func backendError(c *gin.Context, err error) {
+	if err == core.ErrBackendNotFound {
+		c.IndentedJSON(http.StatusNotFound, err.Error())
+		return
+	}
+	if err == core.ErrServerStopped {
+		c.IndentedJSON(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	c.IndentedJSON(http.StatusBadRequest, err.Error())
+}
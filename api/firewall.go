@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/millken/tcpwder/firewall"
+)
+
+/**
+ * Firewall entry creation request
+ */
+type firewallEntryRequest struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"`
+	Ttl    int64  `json:"ttl"`
+	Reason string `json:"reason"`
+}
+
+/**
+ * Attaches /firewall handlers
+ */
+func attachFirewall(app *gin.RouterGroup) {
+
+	/**
+	 * List firewall entries
+	 */
+	app.GET("/firewall", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, firewall.All())
+	})
+
+	/**
+	 * Add allow / deny entry for ip or cidr, ttl in seconds, 0 is forever
+	 */
+	app.POST("/firewall", func(c *gin.Context) {
+
+		req := firewallEntryRequest{}
+		if err := c.BindJSON(&req); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if req.Reason == "" {
+			req.Reason = "api"
+		}
+
+		if err := firewall.Set(req.Rule, req.Action, req.Ttl, req.Reason); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		c.IndentedJSON(http.StatusOK, nil)
+	})
+
+	/**
+	 * Remove entry for ip or cidr passed as ?rule=
+	 */
+	app.DELETE("/firewall", func(c *gin.Context) {
+
+		if err := firewall.Del(c.Query("rule"), ""); err != nil {
+			c.IndentedJSON(http.StatusNotFound, err.Error())
+			return
+		}
+
+		c.IndentedJSON(http.StatusOK, nil)
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/millken/tcpwder/config"
 	"github.com/millken/tcpwder/manager"
+	"github.com/millken/tcpwder/upgrade"
 )
 
 /**
@@ -44,4 +45,38 @@ func attachRoot(app *gin.RouterGroup) {
 
 		c.String(http.StatusOK, data)
 	})
+
+	/**
+	 * Drain progress of servers being deleted or shut down
+	 */
+	app.GET("/draining", func(c *gin.Context) {
+		c.IndentedJSON(http.StatusOK, manager.Draining())
+	})
+
+	/**
+	 * Start new process of the binary handing listeners over to it,
+	 * current process drains and exits after that
+	 */
+	app.POST("/upgrade", func(c *gin.Context) {
+
+		if err := upgrade.Request(); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		c.IndentedJSON(http.StatusOK, nil)
+	})
+
+	/**
+	 * Re-read config file and apply changes
+	 */
+	app.POST("/reload", func(c *gin.Context) {
+
+		if err := manager.ReloadFile(); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		c.IndentedJSON(http.StatusOK, nil)
+	})
 }
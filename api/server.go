@@ -30,12 +30,15 @@ func attachServers(app *gin.RouterGroup) {
 	})
 
 	/**
-	 * Delete server by name
+	 * Delete server by name, it's drained in background
 	 */
 	app.DELETE("/servers/:name", func(c *gin.Context) {
 		name := c.Param("name")
-		manager.Delete(name)
-		c.IndentedJSON(http.StatusOK, nil)
+		if err := manager.Delete(name); err != nil {
+			c.IndentedJSON(http.StatusNotFound, err.Error())
+			return
+		}
+		c.IndentedJSON(http.StatusAccepted, nil)
 	})
 
 	/**
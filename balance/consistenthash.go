@@ -0,0 +1,195 @@
+/**
+ * consistenthash.go - consistent hash balance impl
+ */
+
+package balance
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+/* Default virtual nodes per backend weight unit */
+const DEFAULT_VIRTUAL_NODES = 160
+
+/**
+ * Point of the ring
+ */
+type ringPoint struct {
+	hash   uint32
+	target core.Target
+}
+
+/**
+ * Consistent hash balancer.
+ * Backends are placed on a ketama ring with number of virtual nodes
+ * proportional to their weight, so adding or removing backend remaps
+ * only clients which were mapped to it
+ */
+type ConsistentHashBalancer struct {
+
+	/* ip | ip_port | sni | country | asn */
+	key string
+
+	/* Virtual nodes per backend weight unit */
+	virtualNodes int
+
+	/* Sorted ring points */
+	ring []ringPoint
+
+	/* Backends pool ring was built from */
+	pool map[core.Target]int
+}
+
+/**
+ * Apply server configuration
+ */
+func (b *ConsistentHashBalancer) configure(cfg config.Server) {
+
+	b.key = "ip"
+	b.virtualNodes = DEFAULT_VIRTUAL_NODES
+
+	if cfg.ConsistentHash != nil {
+		if cfg.ConsistentHash.Key != "" {
+			b.key = cfg.ConsistentHash.Key
+		}
+		if cfg.ConsistentHash.VirtualNodes > 0 {
+			b.virtualNodes = cfg.ConsistentHash.VirtualNodes
+		}
+	}
+}
+
+/**
+ * Rebuild ring if backends pool changed
+ */
+func (b *ConsistentHashBalancer) UpdateBackends(backends []*core.Backend) {
+
+	pool := make(map[core.Target]int, len(backends))
+	for _, backend := range backends {
+		pool[backend.Target] = backend.Weight
+	}
+
+	if b.ring != nil && len(pool) == len(b.pool) {
+		changed := false
+		for target, weight := range pool {
+			if w, ok := b.pool[target]; !ok || w != weight {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return
+		}
+	}
+
+	if b.virtualNodes <= 0 {
+		b.virtualNodes = DEFAULT_VIRTUAL_NODES
+	}
+
+	ring := []ringPoint{}
+	for target, weight := range pool {
+		if weight <= 0 {
+			weight = 1
+		}
+
+		// every md5 digest gives 4 points
+		address := target.Address()
+		for i := 0; i < (b.virtualNodes*weight+3)/4; i++ {
+			digest := md5.Sum([]byte(address + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				ring = append(ring, ringPoint{
+					hash:   binary.LittleEndian.Uint32(digest[j*4:]),
+					target: target,
+				})
+			}
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].target.Address() < ring[j].target.Address()
+	})
+
+	b.ring = ring
+	b.pool = pool
+}
+
+/**
+ * Elect backend using consistent hash strategy.
+ * Walks the ring clockwise from the key hash until
+ * backend eligible for election is found
+ */
+func (b *ConsistentHashBalancer) Elect(context core.Context, backends []*core.Backend) (*core.Backend, error) {
+
+	if len(backends) == 0 {
+		return nil, errors.New("Can't elect backend, Backends empty")
+	}
+
+	eligible := make(map[core.Target]*core.Backend, len(backends))
+	for _, backend := range backends {
+		eligible[backend.Target] = backend
+	}
+
+	// ring was not built or doesn't know some of backends
+	for target := range eligible {
+		if _, ok := b.pool[target]; !ok {
+			b.UpdateBackends(backends)
+			break
+		}
+	}
+
+	hash := hashKey(b.keyOf(context))
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+
+	for i := 0; i < len(b.ring); i++ {
+		point := b.ring[(start+i)%len(b.ring)]
+		if backend, ok := eligible[point.target]; ok {
+			return backend, nil
+		}
+	}
+
+	return nil, errors.New("Cant elect backend")
+}
+
+/**
+ * Get hashing key of the client
+ */
+func (b *ConsistentHashBalancer) keyOf(context core.Context) string {
+
+	switch b.key {
+	case "ip_port":
+		return context.String()
+	case "sni":
+		if sni := context.Sni(); sni != "" {
+			return sni
+		}
+	case "country":
+		if geo := context.GeoInfo(); geo != nil && geo.Country != "" {
+			return geo.Country
+		}
+	case "asn":
+		if geo := context.GeoInfo(); geo != nil && geo.ASN != 0 {
+			return strconv.FormatUint(uint64(geo.ASN), 10)
+		}
+	}
+
+	return context.Ip().String()
+}
+
+/**
+ * Hash key to the ring point
+ */
+func hashKey(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[0:4])
+}
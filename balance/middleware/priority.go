@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"errors"
+
+	"github.com/millken/tcpwder/core"
+)
+
+/**
+ * Priority balancer middleware.
+ * Passes to delegate only backends of the best (lowest) priority tier,
+ * so next tier is used only when the whole better tier is down
+ */
+type PriorityBalancer struct {
+	Delegate core.Balancer
+}
+
+func (b *PriorityBalancer) Elect(ctx core.Context, backends []*core.Backend) (*core.Backend, error) {
+
+	if len(backends) == 0 {
+		return nil, errors.New("Can't elect backend, Backends empty")
+	}
+
+	best := backends[0].Priority
+	for _, backend := range backends {
+		if backend.Priority < best {
+			best = backend.Priority
+		}
+	}
+
+	var tier []*core.Backend
+	for _, backend := range backends {
+		if backend.Priority == best {
+			tier = append(tier, backend)
+		}
+	}
+
+	return b.Delegate.Elect(ctx, tier)
+}
+
+/**
+ * Pass backends pool update to delegate if it needs it
+ */
+func (b *PriorityBalancer) UpdateBackends(backends []*core.Backend) {
+	if u, ok := b.Delegate.(core.BackendsUpdater); ok {
+		u.UpdateBackends(backends)
+	}
+}
@@ -73,3 +73,12 @@ func (b *SniBalancer) Elect(ctx core.Context, backends []*core.Backend) (*core.B
 	return nil, errors.New("Rejecting client due to not matching sni [" + sni + "].")
 
 }
+
+/**
+ * Pass backends pool update to delegate if it needs it
+ */
+func (b *SniBalancer) UpdateBackends(backends []*core.Backend) {
+	if u, ok := b.Delegate.(core.BackendsUpdater); ok {
+		u.UpdateBackends(backends)
+	}
+}
@@ -28,21 +28,39 @@ func init() {
 	typeRegistry["weight"] = reflect.TypeOf(WeightBalancer{})
 	typeRegistry["iphash"] = reflect.TypeOf(IphashBalancer{})
 	typeRegistry["leastbandwidth"] = reflect.TypeOf(LeastbandwidthBalancer{})
+	typeRegistry["consistenthash"] = reflect.TypeOf(ConsistentHashBalancer{})
+}
+
+/**
+ * Balancer configured from server configuration
+ */
+type configurable interface {
+	configure(config.Server)
 }
 
 /**
  * Create new Balancer based on balancing strategy
  * Wrap it in middlewares if needed
  */
-func New(sniConf *config.Sni, balance string) core.Balancer {
-	balancer := reflect.New(typeRegistry[balance]).Elem().Addr().Interface().(core.Balancer)
+func New(cfg config.Server) core.Balancer {
+	balancer := reflect.New(typeRegistry[cfg.Balance]).Elem().Addr().Interface().(core.Balancer)
+
+	if c, ok := balancer.(configurable); ok {
+		c.configure(cfg)
+	}
+
+	// elect only from the best priority tier
+	balancer = &middleware.PriorityBalancer{
+		Delegate: balancer,
+	}
 
-	if sniConf == nil {
+	// there is no sni for udp
+	if cfg.Sni == nil || cfg.Protocol == "udp" {
 		return balancer
 	}
 
 	return &middleware.SniBalancer{
-		SniConf:  sniConf,
+		SniConf:  cfg.Sni,
 		Delegate: balancer,
 	}
 }
@@ -6,6 +6,7 @@ package config
 type Config struct {
 	Logging  LoggingConfig     `toml:"logging" json:"logging"`
 	Api      ApiConfig         `toml:"api" json:"api"`
+	Firewall FirewallConfig    `toml:"firewall" json:"firewall"`
 	Defaults ConnectionOptions `toml:"defaults" json:"defaults"`
 	Servers  map[string]Server `toml:"servers" json:"servers"`
 }
@@ -18,6 +19,13 @@ type LoggingConfig struct {
 	Output string `toml:"output" json:"output"`
 }
 
+/**
+ * Firewall config section
+ */
+type FirewallConfig struct {
+	Path string `toml:"path" json:"path"`
+}
+
 /**
  * Api config section
  */
@@ -53,6 +61,7 @@ type ConnectionOptions struct {
 	ClientIdleTimeout        *string `toml:"client_idle_timeout" json:"client_idle_timeout"`
 	BackendIdleTimeout       *string `toml:"backend_idle_timeout" json:"backend_idle_timeout"`
 	BackendConnectionTimeout *string `toml:"backend_connection_timeout" json:"backend_connection_timeout"`
+	DrainTimeout             *string `toml:"drain_timeout" json:"drain_timeout"`
 	ChinaIpdbPath            string  `toml:"china_ipdb_path" json:"china_ipdb_path"`
 }
 
@@ -70,12 +79,36 @@ type Server struct {
 	// tcp | udp | tls
 	Protocol string `toml:"protocol" json:"protocol"`
 
-	// weight | leastconn | roundrobin
+	// weight | leastconn | roundrobin | leastbandwidth | iphash | consistenthash
 	Balance string `toml:"balance" json:"balance"`
 
+	// Optional configuration for balance = consistenthash
+	ConsistentHash *ConsistentHash `toml:"consistent_hash" json:"consistent_hash"`
+
 	//upstream
 	Upstream []string `toml:"upstream" json:"upstream"`
 
+	// Number of retries with another backend if connection to elected one failed
+	Retries int `toml:"retries" json:"retries"`
+
+	// Wait before first retry, doubled on every next one
+	RetryBackoff string `toml:"retry_backoff" json:"retry_backoff"`
+
+	// Optional configuration for upstream discovery
+	Discovery *Discovery `toml:"discovery" json:"discovery"`
+
+	// Read PROXY protocol v1 / v2 header from downstream load balancer
+	AcceptProxyProtocol bool `toml:"accept_proxy_protocol" json:"accept_proxy_protocol"`
+
+	// Sources (cidr) allowed to send PROXY protocol header, required if accepting it
+	ProxyProtocolTrusted []string `toml:"proxy_protocol_trusted" json:"proxy_protocol_trusted"`
+
+	// PROXY protocol header read timeout
+	ProxyProtocolReadTimeout string `toml:"proxy_protocol_read_timeout" json:"proxy_protocol_read_timeout"`
+
+	// Send PROXY protocol header to backends: v1 | v2
+	SendProxyProtocol string `toml:"send_proxy_protocol" json:"send_proxy_protocol"`
+
 	// Optional configuration for server name indication
 	Sni *Sni `toml:"sni" json:"sni"`
 
@@ -94,6 +127,22 @@ type Server struct {
 	// Filter limit_perip_connection_filter configuration
 	PerIpConnections *uint `toml:"per_ip_connections" json:"per_ip_connections"`
 
+	// Filter acl configuration
+	Acl *Acl `toml:"acl" json:"acl"`
+
+	// Filter geo configuration
+	Geo *Geo `toml:"geo" json:"geo"`
+
+	// What to do with clients rejected by filters
+	BanPolicy *BanPolicy `toml:"ban_policy" json:"ban_policy"`
+
+	// Ordered filter chain, names of filter instances or filter kinds
+	// configured by server options. All configured filters if empty
+	Filters []string `toml:"filters" json:"filters"`
+
+	// Named filter instances
+	FilterInstances map[string]Filter `toml:"filter" json:"filter"`
+
 	LimitReconnectRate          *LimitReconnectRate    `toml:"limit_reconnect_rate" json:"limit_reconnect_rate"`
 	LimitPeripRate              *LimitPeripRate        `toml:"limit_per_ip_rate" json:"limit_per_ip_rate"`
 	LimitChinaAccessDefault     string                 `toml:"limit_china_access_default" json:"limit_china_access_default"`
@@ -101,8 +150,67 @@ type Server struct {
 	FilterRequestContentDefault string                 `toml:"filter_request_content_default" json:"filter_request_content_default"`
 	FilterRequestContent        []FilterRequestContent `toml:"filter_request_content" json:"filter_request_content"`
 
+	// Filter content configuration
+	Content *Content `toml:"content" json:"content"`
+
+	// Bandwidth shaping configuration
+	Shaping *Shaping `toml:"shaping" json:"shaping"`
+
 	// Healthcheck configuration
 	Healthcheck *HealthcheckConfig `toml:"healthcheck" json:"healthcheck"`
+
+	// Passive outlier detection configuration
+	OutlierDetection *OutlierDetection `toml:"outlier_detection" json:"outlier_detection"`
+}
+
+/**
+ * Upstream discovery configuration
+ */
+type Discovery struct {
+	Kind      string `toml:"kind" json:"kind"`
+	Interval  string `toml:"interval" json:"interval"`
+	Timeout   string `toml:"timeout" json:"timeout"`
+	RetryWait string `toml:"retry_wait" json:"retry_wait"`
+
+	// keeplast | setempty
+	FailPolicy string `toml:"failpolicy" json:"failpolicy"`
+
+	/* Depends on Kind */
+
+	*DnsDiscoveryConfig
+	*SrvDiscoveryConfig
+	*FileDiscoveryConfig
+	*JsonDiscoveryConfig
+}
+
+type DnsDiscoveryConfig struct {
+	DnsLookupServer string `toml:"dns_lookup_server" json:"dns_lookup_server,omitempty"`
+	DnsFamily       string `toml:"dns_family" json:"dns_family,omitempty"`
+}
+
+type SrvDiscoveryConfig struct {
+	SrvLookupServer  string `toml:"srv_lookup_server" json:"srv_lookup_server,omitempty"`
+	SrvLookupPattern string `toml:"srv_lookup_pattern" json:"srv_lookup_pattern,omitempty"`
+}
+
+type FileDiscoveryConfig struct {
+	FilePath   string `toml:"file_path" json:"file_path,omitempty"`
+	FileFormat string `toml:"file_format" json:"file_format,omitempty"`
+}
+
+type JsonDiscoveryConfig struct {
+	JsonEndpoint string `toml:"json_endpoint" json:"json_endpoint,omitempty"`
+}
+
+/**
+ * Consistent hash balancer options
+ */
+type ConsistentHash struct {
+	// ip | ip_port | sni | country | asn
+	Key string `toml:"key" json:"key"`
+
+	// Virtual nodes on the ring per backend weight unit
+	VirtualNodes int `toml:"virtual_nodes" json:"virtual_nodes"`
 }
 
 /**
@@ -152,6 +260,37 @@ type Udp struct {
 	MaxResponses uint64 `toml:"max_responses" json:"max_responses"`
 }
 
+/**
+ * Named filter instance
+ */
+type Filter struct {
+
+	// Registered filter kind, instance name if empty
+	Kind string `toml:"kind" json:"kind"`
+
+	// Is instance in the chain, true if not set
+	Enabled *bool `toml:"enabled" json:"enabled"`
+
+	FilterOptions
+}
+
+/**
+ * Filters options, the same as filter options of server
+ */
+type FilterOptions struct {
+	MaxConnections              *int                   `toml:"max_connections" json:"max_connections"`
+	PerIpConnections            *uint                  `toml:"per_ip_connections" json:"per_ip_connections"`
+	Acl                         *Acl                   `toml:"acl" json:"acl"`
+	Geo                         *Geo                   `toml:"geo" json:"geo"`
+	LimitReconnectRate          *LimitReconnectRate    `toml:"limit_reconnect_rate" json:"limit_reconnect_rate"`
+	LimitPeripRate              *LimitPeripRate        `toml:"limit_per_ip_rate" json:"limit_per_ip_rate"`
+	LimitChinaAccessDefault     string                 `toml:"limit_china_access_default" json:"limit_china_access_default"`
+	LimitChinaAccess            []LimitChinaAccess     `toml:"limit_china_access" json:"limit_china_access"`
+	FilterRequestContentDefault string                 `toml:"filter_request_content_default" json:"filter_request_content_default"`
+	FilterRequestContent        []FilterRequestContent `toml:"filter_request_content" json:"filter_request_content"`
+	Content                     *Content               `toml:"content" json:"content"`
+}
+
 /**
  * filter limit_reconnect_rate configuration
  */
@@ -179,6 +318,57 @@ type LimitChinaAccess struct {
 	Access string `toml:"access" json:"access"`
 }
 
+/**
+ * filter acl configuration
+ */
+type Acl struct {
+
+	// allow | deny, when no rule matches
+	Default string `toml:"default" json:"default"`
+
+	// "allow|deny <ip|cidr|@list>", first matching rule wins
+	Rules []string `toml:"rules" json:"rules"`
+
+	// list name -> file with ip or cidr per line
+	Lists map[string]string `toml:"lists" json:"lists"`
+}
+
+/**
+ * filter geo configuration
+ */
+type Geo struct {
+
+	// MaxMind country or city mmdb database
+	CountryDb string `toml:"country_db" json:"country_db"`
+
+	// MaxMind asn mmdb database
+	AsnDb string `toml:"asn_db" json:"asn_db"`
+
+	// allow | deny, when no rule matches
+	Default string `toml:"default" json:"default"`
+
+	// "allow|deny country:<code>|continent:<code>|asn:<number>", first matching rule wins
+	Rules []string `toml:"rules" json:"rules"`
+}
+
+/**
+ * Ban policy of clients rejected by filters
+ */
+type BanPolicy struct {
+
+	// ban | reject | dryrun
+	Mode string `toml:"mode" json:"mode"`
+
+	// Ban time of the first ban, doubled for every next one
+	BaseBanTime string `toml:"base_ban_time" json:"base_ban_time"`
+
+	// Max ban time, also time after which previous bans are forgotten
+	MaxBanTime string `toml:"max_ban_time" json:"max_ban_time"`
+
+	// Ips or cidrs never banned
+	Allowlist []string `toml:"allowlist" json:"allowlist"`
+}
+
 /**
  * filter filter_request_content configuration
  */
@@ -188,6 +378,59 @@ type FilterRequestContent struct {
 	Access  string `toml:"access" json:"access"`
 }
 
+/**
+ * filter content configuration
+ */
+type Content struct {
+
+	// "allow|deny literal:<text>|hex:<bytes>|regexp:<expr>|@list" for client to backend
+	// stream, first matching rule wins. Allow stops inspection of the stream
+	Rules []string `toml:"rules" json:"rules"`
+
+	// The same for backend to client stream
+	ResponseRules []string `toml:"response_rules" json:"response_rules"`
+
+	// list name -> file with literal per line
+	Lists map[string]string `toml:"lists" json:"lists"`
+
+	// Bytes inspected from the start of each stream or udp datagram, whole stream if 0
+	Limit uint `toml:"limit" json:"limit"`
+
+	// Bytes of previous reads regexps are matched over too, 4096 if 0
+	Window int `toml:"window" json:"window"`
+}
+
+/**
+ * Bandwidth shaping configuration, limits of every scope apply together
+ */
+type Shaping struct {
+
+	// Limits of each client connection (udp session)
+	Connection *Bandwidth `toml:"connection" json:"connection"`
+
+	// Limits shared by all connections of the same client ip
+	PerIp *Bandwidth `toml:"per_ip" json:"per_ip"`
+
+	// Limits shared by all connections of the server
+	Server *Bandwidth `toml:"server" json:"server"`
+}
+
+/**
+ * Token bucket limits, bytes per second, unlimited if 0
+ */
+type Bandwidth struct {
+
+	// Client to backend rate
+	Upload uint64 `toml:"upload" json:"upload"`
+
+	// Backend to client rate
+	Download uint64 `toml:"download" json:"download"`
+
+	// Bytes allowed at once after idle, one second of rate if 0
+	UploadBurst   uint64 `toml:"upload_burst" json:"upload_burst"`
+	DownloadBurst uint64 `toml:"download_burst" json:"download_burst"`
+}
+
 /**
  * Healthcheck configuration
  */
@@ -202,12 +445,46 @@ type HealthcheckConfig struct {
 
 	*PingHealthcheckConfig
 	*ExecHealthcheckConfig
+	*TlsHealthcheckConfig
+	*HttpHealthcheckConfig
+	*ProbeHealthcheckConfig
 }
 
-type PingHealthcheckConfig struct{}
+type PingHealthcheckConfig struct {
+	Protocol string `toml:"ping_protocol" json:"ping_protocol,omitempty"`
+}
 
 type ExecHealthcheckConfig struct {
 	ExecCommand                string `toml:"exec_command" json:"exec_command,omitempty"`
 	ExecExpectedPositiveOutput string `toml:"exec_expected_positive_output" json:"exec_expected_positive_output"`
 	ExecExpectedNegativeOutput string `toml:"exec_expected_negative_output" json:"exec_expected_negative_output"`
 }
+
+type TlsHealthcheckConfig struct {
+	TlsServerName string `toml:"tls_server_name" json:"tls_server_name,omitempty"`
+}
+
+type HttpHealthcheckConfig struct {
+	HttpPath           string `toml:"http_path" json:"http_path,omitempty"`
+	HttpHost           string `toml:"http_host" json:"http_host,omitempty"`
+	HttpExpectedStatus int    `toml:"http_expected_status" json:"http_expected_status,omitempty"`
+	HttpExpectedBody   string `toml:"http_expected_body" json:"http_expected_body,omitempty"`
+}
+
+type ProbeHealthcheckConfig struct {
+	ProbeProtocol string `toml:"probe_protocol" json:"probe_protocol,omitempty"`
+	ProbeSend     string `toml:"probe_send" json:"probe_send,omitempty"`
+	ProbeRecv     string `toml:"probe_recv" json:"probe_recv,omitempty"`
+	ProbeRecvLen  int    `toml:"probe_recv_len" json:"probe_recv_len,omitempty"`
+}
+
+/**
+ * Passive outlier detection configuration
+ */
+type OutlierDetection struct {
+	ConsecutiveFailures int    `toml:"consecutive_failures" json:"consecutive_failures"`
+	Interval            string `toml:"interval" json:"interval"`
+	BaseEjectionTime    string `toml:"base_ejection_time" json:"base_ejection_time"`
+	MaxEjectionTime     string `toml:"max_ejection_time" json:"max_ejection_time"`
+	MaxEjectionPercent  int    `toml:"max_ejection_percent" json:"max_ejection_percent"`
+}
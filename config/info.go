@@ -7,3 +7,6 @@ import (
 var Version string
 var StartTime time.Time
 var Configuration interface{}
+
+/* Path of the configuration file, re-read on reload */
+var File string
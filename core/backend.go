@@ -25,15 +25,45 @@ type Backend struct {
  */
 type BackendStats struct {
 	Live               bool   `json:"live"`
+	Ejected            bool   `json:"ejected"`
+	State              string `json:"state"`
 	TotalConnections   int64  `json:"total_connections"`
 	ActiveConnections  uint   `json:"active_connections"`
 	RefusedConnections uint64 `json:"refused_connections"`
+	ResetConnections   uint64 `json:"reset_connections"`
+	DroppedDatagrams   uint64 `json:"dropped_datagrams"`
 	RxBytes            uint64 `json:"rx"`
 	TxBytes            uint64 `json:"tx"`
 	RxSecond           uint   `json:"rx_second"`
 	TxSecond           uint   `json:"tx_second"`
 }
 
+/**
+ * Backend admin states
+ */
+const (
+	// elected as usual
+	BACKEND_STATE_ACTIVE = "active"
+	// not elected, existing connections are kept
+	BACKEND_STATE_DRAIN = "drain"
+	// not elected, existing connections are closed
+	BACKEND_STATE_DISABLED = "disabled"
+)
+
+/**
+ * Backend changes requested by api,
+ * nil / empty fields are left untouched
+ */
+type BackendUpdate struct {
+	Weight   *int   `json:"weight"`
+	Priority *int   `json:"priority"`
+	State    string `json:"state"`
+}
+
+var ErrBackendNotFound = errors.New("Backend not found")
+
+var ErrServerStopped = errors.New("Server is stopped")
+
 const (
 	DEFAULT_BACKEND_PATTERN = `^(?P<host>\S+):(?P<port>\d+)(\sweight=(?P<weight>\d+))?(\spriority=(?P<priority>\d+))?(\ssni=(?P<sni>[^\s]+))?$`
 )
@@ -126,6 +156,6 @@ func (this *Backend) Address() string {
  * String conversion
  */
 func (this Backend) String() string {
-	return fmt.Sprintf("{%s p=%d,w=%d,l=%t,a=%d}",
-		this.Address(), this.Priority, this.Weight, this.Stats.Live, this.Stats.ActiveConnections)
+	return fmt.Sprintf("{%s p=%d,w=%d,l=%t,e=%t,a=%d}",
+		this.Address(), this.Priority, this.Weight, this.Stats.Live, this.Stats.Ejected, this.Stats.ActiveConnections)
 }
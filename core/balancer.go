@@ -10,3 +10,15 @@ type Balancer interface {
 	 */
 	Elect(Context, []*Backend) (*Backend, error)
 }
+
+/**
+ * Balancer which keeps state built from backends pool,
+ * notified by scheduler when pool changes
+ */
+type BackendsUpdater interface {
+
+	/**
+	 * Update balancer state with current backends pool
+	 */
+	UpdateBackends([]*Backend)
+}
@@ -1,12 +1,17 @@
 package core
 
-import "net"
+import (
+	"net"
+	"strconv"
+)
 
 type Context interface {
 	String() string
+	Addr() net.Addr
 	Ip() net.IP
 	Port() int
 	Sni() string
+	GeoInfo() *Geo
 }
 
 /**
@@ -18,24 +23,46 @@ type TcpContext struct {
 	 * Current client connection
 	 */
 	Conn net.Conn
+
+	/**
+	 * Client geo location tagged by geo filter, nil if unknown
+	 */
+	Geo *Geo
 }
 
 func (t TcpContext) String() string {
 	return t.Conn.RemoteAddr().String()
 }
 
+func (t TcpContext) Addr() net.Addr {
+	return t.Conn.RemoteAddr()
+}
+
 func (t TcpContext) Ip() net.IP {
-	return t.Conn.RemoteAddr().(*net.TCPAddr).IP
+	if addr, ok := t.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	host, _, _ := net.SplitHostPort(t.Conn.RemoteAddr().String())
+	return net.ParseIP(host)
 }
 
 func (t TcpContext) Port() int {
-	return t.Conn.RemoteAddr().(*net.TCPAddr).Port
+	if addr, ok := t.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	_, port, _ := net.SplitHostPort(t.Conn.RemoteAddr().String())
+	p, _ := strconv.Atoi(port)
+	return p
 }
 
 func (t TcpContext) Sni() string {
 	return t.Hostname
 }
 
+func (t TcpContext) GeoInfo() *Geo {
+	return t.Geo
+}
+
 /*
  * Proxy udp context
  */
@@ -45,12 +72,21 @@ type UdpContext struct {
 	 * Current client remote address
 	 */
 	RemoteAddr net.UDPAddr
+
+	/**
+	 * Client geo location, nil if unknown
+	 */
+	Geo *Geo
 }
 
 func (u UdpContext) String() string {
 	return u.RemoteAddr.String()
 }
 
+func (u UdpContext) Addr() net.Addr {
+	return &u.RemoteAddr
+}
+
 func (u UdpContext) Ip() net.IP {
 	return u.RemoteAddr.IP
 }
@@ -62,3 +98,7 @@ func (u UdpContext) Port() int {
 func (u UdpContext) Sni() string {
 	return ""
 }
+
+func (u UdpContext) GeoInfo() *Geo {
+	return u.Geo
+}
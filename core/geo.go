@@ -0,0 +1,25 @@
+package core
+
+import "strconv"
+
+/**
+ * Geo location of the client address
+ */
+type Geo struct {
+
+	/* ISO 3166-1 country code, US */
+	Country string `json:"country"`
+
+	/* Continent code, NA */
+	Continent string `json:"continent"`
+
+	/* Autonomous system number, 0 if unknown */
+	ASN uint `json:"asn"`
+
+	/* Autonomous system organization */
+	Organization string `json:"organization"`
+}
+
+func (g Geo) String() string {
+	return g.Continent + "/" + g.Country + " AS" + strconv.FormatUint(uint64(g.ASN), 10)
+}
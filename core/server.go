@@ -1,6 +1,10 @@
 package core
 
-import "github.com/millken/tcpwder/config"
+import (
+	"time"
+
+	"github.com/millken/tcpwder/config"
+)
 
 /**
  * Server interface
@@ -17,8 +21,65 @@ type Server interface {
 	 */
 	Stop()
 
+	/**
+	 * Stop accepting new connections, wait until active ones finish
+	 * or drain timeout expires, then stop server
+	 */
+	Drain()
+
+	/**
+	 * Get drain progress, nil if server is not draining
+	 */
+	DrainStatus() *DrainStatus
+
+	/**
+	 * Reload upstream, balancer and filters from configuration
+	 * keeping listener and active connections
+	 */
+	Reload(cfg config.Server) error
+
 	/**
 	 * Get server configuration
 	 */
 	Cfg() config.Server
+
+	/**
+	 * Get backends manager of the server
+	 */
+	Backends() BackendsManager
+}
+
+/**
+ * Manages server backends on top of discovered ones
+ */
+type BackendsManager interface {
+
+	/**
+	 * List current backends with stats
+	 */
+	ListBackends() ([]Backend, error)
+
+	/**
+	 * Add backend to discovered ones
+	 */
+	AddBackend(backend Backend) error
+
+	/**
+	 * Remove backend, even discovered one
+	 */
+	RemoveBackend(target Target) error
+
+	/**
+	 * Change backend weight, priority or state
+	 */
+	UpdateBackend(target Target, update BackendUpdate) error
+}
+
+/**
+ * Server drain progress
+ */
+type DrainStatus struct {
+	Started           time.Time `json:"started"`
+	Deadline          time.Time `json:"deadline"`
+	ActiveConnections uint      `json:"active_connections"`
 }
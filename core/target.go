@@ -1,5 +1,7 @@
 package core
 
+import "strings"
+
 /**
  * Target host and port
  */
@@ -21,6 +23,10 @@ func (t *Target) EqualTo(other Target) bool {
  * host:port
  */
 func (this *Target) Address() string {
+	// ipv6 address without brackets
+	if strings.Contains(this.Host, ":") && !strings.HasPrefix(this.Host, "[") {
+		return "[" + this.Host + "]:" + this.Port
+	}
 	return this.Host + ":" + this.Port
 }
 
@@ -1,57 +1,351 @@
 package firewall
 
 import (
+	"errors"
+	"log"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
-	ttlmap "github.com/leprosus/golang-ttl-map"
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/utils/cidrtree"
 )
 
-var ttlMap ttlmap.Heap
+const (
+	ALLOW = "allow"
+	DENY  = "deny"
 
-func init() {
-	ttlMap = ttlmap.New("firewall.tsv")
+	DEFAULT_PATH = "firewall.tsv"
+)
+
+/**
+ * Firewall entry for single ip or cidr range
+ */
+type Entry struct {
+
+	/* Normalized cidr, single ip has full mask */
+	Rule string `json:"rule"`
+
+	/* allow | deny */
+	Action string `json:"action"`
+
+	/* Why entry was added, filter name or api */
+	Reason string `json:"reason"`
+
+	/* When entry was added */
+	Created time.Time `json:"created"`
+
+	/* When entry expires, zero if never */
+	Expires time.Time `json:"expires"`
+
+	network *net.IPNet
 }
 
-func SetAllow(ip string, ttl int64) {
-	Set(ip, "allow", ttl)
+/**
+ * Check if entry is a range wider than single ip
+ */
+func (this *Entry) isRange() bool {
+	ones, bits := this.network.Mask.Size()
+	return ones != bits
 }
 
-func DelAllow(ip string) {
-	Del(ip, "allow")
+/**
+ * Check if entry is expired at the moment
+ */
+func (this *Entry) expired(now time.Time) bool {
+	return !this.Expires.IsZero() && !now.Before(this.Expires)
 }
 
-func SetDeny(ip string, ttl int64) {
-	Set(ip, "deny", ttl)
+var entries = struct {
+	sync.RWMutex
+
+	/* entries by rule */
+	m map[string]*Entry
+
+	/* ranges wider than single ip, longest prefix first */
+	ranges []*Entry
+
+	/* ranges indexed by their position, so lookup finds the longest prefix */
+	tree *cidrtree.Tree
+
+	/* persistence file path */
+	path string
+
+	/* entries changed since last save */
+	dirty bool
+
+	/* file content last saved, to skip writing the same */
+	saved []byte
+}{
+	m:    make(map[string]*Entry),
+	tree: &cidrtree.Tree{},
+	path: DEFAULT_PATH,
 }
 
-func DelDeny(ip string) {
-	Del(ip, "deny")
+var initialize sync.Once
+
+/**
+ * Load persisted entries and start expiring and saving them
+ */
+func Initialize(cfg config.FirewallConfig) {
+	initialize.Do(func() {
+
+		if cfg.Path != "" {
+			entries.path = cfg.Path
+		}
+
+		if err := load(entries.path); err != nil {
+			log.Printf("[WARN] Loading firewall %s: %s", entries.path, err)
+		}
+
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			for range ticker.C {
+				expire(time.Now())
+				if err := save(); err != nil {
+					log.Printf("[ERROR] Saving firewall %s: %s", entries.path, err)
+				}
+			}
+		}()
+	})
 }
 
-func Set(ip, value string, ttl int64) {
-	ttlMap.Set(ip, value, ttl)
+/**
+ * Parse ip or cidr to network
+ */
+func parseRule(rule string) (*net.IPNet, error) {
+
+	if _, network, err := net.ParseCIDR(rule); err == nil {
+		return network, nil
+	}
+
+	ip := net.ParseIP(rule)
+	if ip == nil {
+		return nil, errors.New("Invalid ip or cidr " + rule)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
 }
 
-func Del(ip, match string) {
-	value := ttlMap.Get(ip)
-	if value == match {
-		ttlMap.Del(ip)
+/**
+ * Put entry, replacing one with the same rule.
+ * Should be called holding entries lock
+ */
+func put(entry *Entry) {
+	old, ok := entries.m[entry.Rule]
+	entries.m[entry.Rule] = entry
+	entries.dirty = true
+
+	if entry.isRange() || (ok && old.isRange()) {
+		rebuildRanges()
 	}
 }
 
-func Allows(ip string) bool {
-	value := ttlMap.Get(ip)
-	if value == "deny" {
-		return false
+/**
+ * Rebuild ranges list from entries.
+ * Should be called holding entries lock
+ */
+func rebuildRanges() {
+
+	ranges := []*Entry{}
+	for _, entry := range entries.m {
+		if entry.isRange() {
+			ranges = append(ranges, entry)
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		a, _ := ranges[i].network.Mask.Size()
+		b, _ := ranges[j].network.Mask.Size()
+		return a > b
+	})
+
+	tree := &cidrtree.Tree{}
+	for i, entry := range ranges {
+		tree.Insert(entry.network, i)
+	}
+
+	entries.ranges = ranges
+	entries.tree = tree
+}
+
+/**
+ * Add entry for ip or cidr with action for ttl seconds, forever if ttl is 0
+ */
+func Set(rule, action string, ttl int64, reason string) error {
+
+	switch action {
+	case ALLOW, DENY:
+	default:
+		return errors.New("Not supported firewall action " + action)
+	}
+
+	network, err := parseRule(rule)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry := &Entry{
+		Rule:    network.String(),
+		Action:  action,
+		Reason:  reason,
+		Created: now,
+		network: network,
 	}
-	return true
+	if ttl > 0 {
+		entry.Expires = now.Add(time.Duration(ttl) * time.Second)
+	}
+
+	entries.Lock()
+	put(entry)
+	entries.Unlock()
+
+	return nil
+}
+
+/**
+ * Remove entry of ip or cidr if it has action, any action if empty
+ */
+func Del(rule, action string) error {
+
+	network, err := parseRule(rule)
+	if err != nil {
+		return err
+	}
+
+	entries.Lock()
+	defer entries.Unlock()
+
+	entry, ok := entries.m[network.String()]
+	if !ok || (action != "" && entry.Action != action) {
+		return errors.New("Firewall entry not found")
+	}
+
+	delete(entries.m, entry.Rule)
+	entries.dirty = true
+
+	if entry.isRange() {
+		rebuildRanges()
+	}
+
+	return nil
+}
+
+func SetAllow(rule string, ttl int64, reason string) error {
+	return Set(rule, ALLOW, ttl, reason)
+}
+
+func DelAllow(rule string) error {
+	return Del(rule, ALLOW)
+}
+
+func SetDeny(rule string, ttl int64, reason string) error {
+	return Set(rule, DENY, ttl, reason)
+}
+
+func DelDeny(rule string) error {
+	return Del(rule, DENY)
+}
+
+/**
+ * Returns all not expired entries
+ */
+func All() []Entry {
+
+	now := time.Now()
+	result := []Entry{}
+
+	entries.RLock()
+	for _, entry := range entries.m {
+		if !entry.expired(now) {
+			result = append(result, *entry)
+		}
+	}
+	entries.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.Before(result[j].Created)
+	})
+
+	return result
+}
+
+/**
+ * Find action for ip, most specific entry wins
+ */
+func lookup(ip string) string {
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	network, err := parseRule(ip)
+	if err != nil {
+		return ""
+	}
+
+	now := time.Now()
+
+	entries.RLock()
+	defer entries.RUnlock()
+
+	if entry, ok := entries.m[network.String()]; ok && !entry.expired(now) {
+		return entry.Action
+	}
+
+	i, ok := entries.tree.Lookup(parsed)
+	if !ok {
+		return ""
+	}
+
+	if entry := entries.ranges[i]; !entry.expired(now) {
+		return entry.Action
+	}
+
+	// most specific range is expired, but not removed yet
+	for _, entry := range entries.ranges[i+1:] {
+		if !entry.expired(now) && entry.network.Contains(parsed) {
+			return entry.Action
+		}
+	}
+
+	return ""
+}
+
+/**
+ * Remove expired entries
+ */
+func expire(now time.Time) {
+
+	entries.Lock()
+	defer entries.Unlock()
+
+	rebuild := false
+	for rule, entry := range entries.m {
+		if entry.expired(now) {
+			delete(entries.m, rule)
+			entries.dirty = true
+			rebuild = rebuild || entry.isRange()
+		}
+	}
+
+	if rebuild {
+		rebuildRanges()
+	}
+}
+
+func Allows(ip string) bool {
+	return lookup(ip) != DENY
 }
 
 func IsAllowClient(client net.Conn) bool {
 	ip, _, _ := net.SplitHostPort(client.RemoteAddr().String())
-	value := ttlMap.Get(ip)
-	if value == "deny" {
-		return false
-	}
-	return true
+	return Allows(ip)
 }
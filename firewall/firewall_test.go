@@ -0,0 +1,81 @@
+package firewall
+
+import (
+	"testing"
+	"time"
+)
+
+/**
+ * Drop all entries
+ */
+func reset() {
+	entries.Lock()
+	entries.m = make(map[string]*Entry)
+	entries.dirty = false
+	entries.saved = nil
+	rebuildRanges()
+	entries.Unlock()
+}
+
+func TestLookupMostSpecific(t *testing.T) {
+
+	reset()
+	defer reset()
+
+	for _, e := range []struct{ rule, action string }{
+		{"10.0.0.0/8", DENY},
+		{"10.1.0.0/16", ALLOW},
+		{"10.1.2.0/24", DENY},
+		{"10.1.2.3", ALLOW},
+		{"2001:db8::/32", DENY},
+	} {
+		if err := Set(e.rule, e.action, 0, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for ip, expected := range map[string]string{
+		"10.2.0.1":    DENY,
+		"10.1.3.1":    ALLOW,
+		"10.1.2.4":    DENY,
+		"10.1.2.3":    ALLOW,
+		"11.0.0.1":    "",
+		"2001:db8::1": DENY,
+		"2001:db9::1": "",
+		"not an ip":   "",
+	} {
+		if action := lookup(ip); action != expected {
+			t.Errorf("%s: expected '%s', got '%s'", ip, expected, action)
+		}
+	}
+
+	if err := Del("10.1.0.0/16", ALLOW); err != nil {
+		t.Fatal(err)
+	}
+	if action := lookup("10.1.3.1"); action != DENY {
+		t.Errorf("Expected deny of wider range after delete, got '%s'", action)
+	}
+}
+
+func TestLookupExpiredRange(t *testing.T) {
+
+	reset()
+	defer reset()
+
+	Set("10.0.0.0/8", DENY, 0, "test")
+	Set("10.1.0.0/16", ALLOW, 0, "test")
+
+	// expired, but not removed yet
+	entries.Lock()
+	entries.m["10.1.0.0/16"].Expires = time.Now().Add(-time.Second)
+	entries.Unlock()
+
+	if action := lookup("10.1.0.1"); action != DENY {
+		t.Errorf("Expected deny of wider range, got '%s'", action)
+	}
+
+	expire(time.Now())
+	if action := lookup("10.1.0.1"); action != DENY {
+		t.Errorf("Expected deny of wider range after expire, got '%s'", action)
+	}
+}
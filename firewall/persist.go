@@ -0,0 +1,241 @@
+/**
+ * persist.go - firewall entries persistence.
+ * One entry per line: rule, action, expires, created (unix seconds, 0 if none)
+ * and reason separated by tabs. Lines of golang-ttl-map file used before
+ * are migrated on load
+ */
+
+package firewall
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Load entries from file, missing file is not an error
+ */
+func load(path string) error {
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	entries.Lock()
+	defer entries.Unlock()
+
+	migrated := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var entry *Entry
+		if strings.Count(line, "\t") == 2 {
+			if entry, err = parseLegacyLine(line, now); err == nil {
+				migrated++
+			}
+		} else {
+			entry, err = parseLine(line)
+		}
+		if err != nil {
+			log.Printf("[WARN] Skipping firewall entry '%s': %s", line, err)
+			continue
+		}
+
+		if entry.expired(now) {
+			continue
+		}
+
+		entries.m[entry.Rule] = entry
+	}
+
+	if migrated > 0 {
+		log.Printf("[WARN] Migrated %d firewall entries of old format in %s", migrated, path)
+		entries.dirty = true
+	} else {
+		entries.saved = data
+	}
+
+	rebuildRanges()
+
+	return scanner.Err()
+}
+
+/**
+ * Parse persisted entry
+ */
+func parseLine(line string) (*Entry, error) {
+
+	fields := strings.SplitN(line, "\t", 5)
+	for len(fields) < 5 {
+		fields = append(fields, "")
+	}
+
+	network, err := parseRule(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{
+		Rule:    network.String(),
+		Action:  fields[1],
+		Reason:  fields[4],
+		network: network,
+	}
+
+	switch entry.Action {
+	case ALLOW, DENY:
+	default:
+		return nil, errors.New("Not supported firewall action " + entry.Action)
+	}
+
+	if entry.Expires, err = parseUnix(fields[2]); err != nil {
+		return nil, err
+	}
+	if entry.Created, err = parseUnix(fields[3]); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+/**
+ * Parse line of golang-ttl-map file: ip key, "allow" or "deny" value,
+ * possibly quoted, and unix deadline, in any order
+ */
+func parseLegacyLine(line string, now time.Time) (*Entry, error) {
+
+	fields := strings.Split(line, "\t")
+	if len(fields) != 3 {
+		return nil, errors.New("Not a golang-ttl-map line")
+	}
+
+	entry := &Entry{Reason: "migrated", Created: now}
+	deadline := false
+
+	for _, field := range fields {
+
+		value := strings.Trim(field, "\"' ")
+
+		if network, err := parseRule(value); err == nil && entry.network == nil {
+			entry.Rule = network.String()
+			entry.network = network
+			continue
+		}
+
+		if (value == ALLOW || value == DENY) && entry.Action == "" {
+			entry.Action = value
+			continue
+		}
+
+		if sec, err := strconv.ParseInt(value, 10, 64); err == nil && !deadline {
+			deadline = true
+			// deadline may be stored in milli or nano seconds
+			for sec > 1e11 {
+				sec /= 1000
+			}
+			if sec > 0 {
+				entry.Expires = time.Unix(sec, 0)
+			}
+			continue
+		}
+
+		return nil, errors.New("Unexpected field " + field)
+	}
+
+	if entry.network == nil || entry.Action == "" || !deadline {
+		return nil, errors.New("Not a golang-ttl-map line")
+	}
+
+	return entry, nil
+}
+
+/**
+ * Parse unix seconds, 0 or empty is zero time
+ */
+func parseUnix(s string) (time.Time, error) {
+
+	if s == "" || s == "0" {
+		return time.Time{}, nil
+	}
+
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(sec, 0), nil
+}
+
+/**
+ * Format time as unix seconds, 0 if zero
+ */
+func formatUnix(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+/**
+ * Save entries to file if they were changed,
+ * skipping write if content is the same
+ */
+func save() error {
+
+	entries.Lock()
+	defer entries.Unlock()
+
+	if !entries.dirty {
+		return nil
+	}
+	entries.dirty = false
+
+	rules := make([]string, 0, len(entries.m))
+	for rule := range entries.m {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	var buf bytes.Buffer
+	for _, rule := range rules {
+		entry := entries.m[rule]
+		buf.WriteString(entry.Rule + "\t" + entry.Action + "\t" +
+			formatUnix(entry.Expires) + "\t" + formatUnix(entry.Created) + "\t" +
+			strings.Replace(entry.Reason, "\n", " ", -1) + "\n")
+	}
+
+	if bytes.Equal(buf.Bytes(), entries.saved) {
+		return nil
+	}
+
+	tmp := entries.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, entries.path); err != nil {
+		return err
+	}
+
+	entries.saved = buf.Bytes()
+	return nil
+}
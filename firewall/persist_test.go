@@ -0,0 +1,105 @@
+package firewall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoadMigratesLegacyFile(t *testing.T) {
+
+	reset()
+	defer reset()
+
+	dir, err := ioutil.TempDir("", "firewall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	deadline := time.Now().Add(time.Hour).Unix()
+	path := filepath.Join(dir, "firewall.tsv")
+	data := "10.0.0.1\tdeny\t" + strconv.FormatInt(deadline, 10) + "\n" +
+		strconv.FormatInt(deadline*1e9, 10) + "\t\"allow\"\t10.0.0.2\n" +
+		"10.0.0.3\tdeny\t" + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10) + "\n" +
+		"garbage\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries.path = path
+	if err := load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, action := range map[string]string{"10.0.0.1": DENY, "10.0.0.2": ALLOW, "10.0.0.3": ""} {
+		if got := lookup(ip); got != action {
+			t.Errorf("%s: expected '%s', got '%s'", ip, action, got)
+		}
+	}
+
+	entries.Lock()
+	entry := entries.m["10.0.0.2/32"]
+	dirty := entries.dirty
+	entries.Unlock()
+
+	if entry == nil || entry.Expires.Unix() != deadline {
+		t.Fatalf("Expected nano seconds deadline to be migrated, got %+v", entry)
+	}
+	if !dirty {
+		t.Fatal("Expected migrated file to be saved again")
+	}
+}
+
+func TestSaveOnlyOnChange(t *testing.T) {
+
+	reset()
+	defer reset()
+
+	dir, err := ioutil.TempDir("", "firewall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "firewall.tsv")
+	entries.path = path
+
+	Set("10.0.0.2", DENY, 0, "test")
+	Set("10.0.0.1", DENY, 0, "test")
+	if err := save(); err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	entries.Lock()
+	entries.dirty = true
+	entries.Unlock()
+	if err := save(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(past) {
+		t.Fatal("Expected unchanged file not to be written")
+	}
+
+	reset()
+	entries.path = path
+	if err := load(path); err != nil {
+		t.Fatal(err)
+	}
+	if lookup("10.0.0.1") != DENY || lookup("10.0.0.2") != DENY {
+		t.Fatal("Expected saved entries to be loaded")
+	}
+}
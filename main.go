@@ -6,8 +6,10 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/logutils"
@@ -15,7 +17,9 @@ import (
 	"github.com/millken/tcpwder/api"
 	"github.com/millken/tcpwder/codec"
 	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/firewall"
 	"github.com/millken/tcpwder/manager"
+	"github.com/millken/tcpwder/upgrade"
 	"github.com/millken/tcpwder/utils"
 )
 
@@ -48,6 +52,8 @@ func main() {
 	log.Printf("tcpwder v%s // by millken\n", version)
 	flag.Parse()
 
+	config.File = *flagConfigFile
+
 	var cfg config.Config
 
 	data, err := ioutil.ReadFile(*flagConfigFile)
@@ -92,10 +98,60 @@ func main() {
 		log.Printf("[INFO] loading china ip")
 	}
 
+	// Load firewall entries
+	firewall.Initialize(cfg.Firewall)
+
 	// Start API
-	go api.Start(cfg.Api)
+	api.Start(cfg.Api)
 
 	manager.Initialize(cfg)
-	<-(chan string)(nil)
+
+	// Notify parent process if started by upgrade
+	upgrade.Ready()
+
+	// Reload configuration on SIGHUP, drain and exit on SIGTERM / SIGINT
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM, os.Interrupt)
+
+	// Hand listeners over to new process on SIGUSR2 or api request
+	sigupgrade := make(chan os.Signal, 1)
+	upgrade.Notify(sigupgrade)
+
+	for {
+		select {
+		case <-sighup:
+			if err := manager.ReloadFile(); err != nil {
+				log.Printf("[ERROR] Reload failed: %s", err)
+				continue
+			}
+			log.Printf("[INFO] Reloaded")
+
+		case <-sigupgrade:
+			if err := upgrade.Upgrade(); err != nil {
+				log.Printf("[ERROR] Upgrade failed: %s", err)
+				continue
+			}
+			manager.Shutdown()
+			os.Exit(0)
+
+		case reply := <-upgrade.Requests():
+			err := upgrade.Upgrade()
+			reply <- err
+			if err != nil {
+				log.Printf("[ERROR] Upgrade failed: %s", err)
+				continue
+			}
+			manager.Shutdown()
+			os.Exit(0)
+
+		case sig := <-sigterm:
+			log.Printf("[INFO] Got %s", sig)
+			manager.Shutdown()
+			os.Exit(0)
+		}
+	}
 
 }
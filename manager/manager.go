@@ -2,7 +2,11 @@ package manager
 
 import (
 	"errors"
+	"io/ioutil"
 	"log"
+	"net"
+	"reflect"
+	"regexp"
 	"sync"
 	"time"
 
@@ -10,6 +14,10 @@ import (
 	"github.com/millken/tcpwder/config"
 	"github.com/millken/tcpwder/core"
 	"github.com/millken/tcpwder/server"
+	"github.com/millken/tcpwder/server/filter"
+	"github.com/millken/tcpwder/server/healthcheck"
+	"github.com/millken/tcpwder/server/shaper"
+	"github.com/millken/tcpwder/upgrade"
 )
 
 var servers = struct {
@@ -19,6 +27,14 @@ var servers = struct {
 	m: make(map[string]core.Server),
 }
 
+/* servers being drained, already removed from servers */
+var draining = struct {
+	sync.RWMutex
+	m map[string]core.Server
+}{
+	m: make(map[string]core.Server),
+}
+
 /* default configuration for server */
 var defaults config.ConnectionOptions
 
@@ -118,7 +134,16 @@ func Create(name string, cfg config.Server) error {
 		return err
 	}
 
-	server, err := server.New(name, c)
+	return start(name, c)
+}
+
+/**
+ * Create server from prepared config and launch it.
+ * Should be called holding servers lock
+ */
+func start(name string, cfg config.Server) error {
+
+	server, err := server.New(name, cfg)
 	if err != nil {
 		return err
 	}
@@ -133,24 +158,244 @@ func Create(name string, cfg config.Server) error {
 }
 
 /**
- * Delete server stopping all active connections
+ * Re-read configuration file and apply it
  */
-func Delete(name string) error {
+func ReloadFile() error {
+
+	log.Printf("[INFO] Reloading configuration from %s", config.File)
+
+	data, err := ioutil.ReadFile(config.File)
+	if err != nil {
+		return err
+	}
+
+	var cfg config.Config
+	if err = codec.Decode(string(data), &cfg, "toml"); err != nil {
+		return err
+	}
+
+	return Reload(cfg)
+}
+
+/**
+ * Apply new configuration to running servers:
+ * create new servers, delete removed ones, reload changed ones in place
+ * if only upstream, balancer or filters changed and recreate others.
+ * Deleted and replaced servers are drained in background
+ */
+func Reload(cfg config.Config) error {
+
+	// Validate whole configuration before touching anything
+	prepared := map[string]config.Server{}
+	for name, serverCfg := range cfg.Servers {
+		c, err := prepareConfig(name, serverCfg, cfg.Defaults)
+		if err != nil {
+			return errors.New("Server " + name + ": " + err.Error())
+		}
+		prepared[name] = c
+	}
 
 	servers.Lock()
 	defer servers.Unlock()
 
+	originalCfg = cfg
+	defaults = cfg.Defaults
+
+	var lastErr error
+
+	for name, server := range servers.m {
+		if _, ok := prepared[name]; !ok {
+			log.Printf("[INFO] Reload: deleting '%s'", name)
+			delete(servers.m, name)
+			go drain(name, server)
+		}
+	}
+
+	for name, c := range prepared {
+
+		server, ok := servers.m[name]
+		if !ok {
+			log.Printf("[INFO] Reload: creating '%s'", name)
+			if err := start(name, c); err != nil {
+				log.Printf("[ERROR] Reload: creating '%s': %s", name, err)
+				lastErr = err
+			}
+			continue
+		}
+
+		current := server.Cfg()
+		if reflect.DeepEqual(current, c) {
+			continue
+		}
+
+		if reflect.DeepEqual(withoutReloadable(current), withoutReloadable(c)) {
+			if err := server.Reload(c); err != nil {
+				log.Printf("[ERROR] Reload: reloading '%s': %s", name, err)
+				lastErr = err
+			}
+			continue
+		}
+
+		log.Printf("[INFO] Reload: recreating '%s'", name)
+
+		// new server takes listening socket over while old one drains
+		sameSocket := current.Bind == c.Bind && network(current) == network(c)
+		if sameSocket {
+			upgrade.Share(network(c), c.Bind)
+		}
+		err := start(name, c)
+		if sameSocket {
+			upgrade.Unshare(network(c), c.Bind)
+		}
+
+		if err != nil {
+			log.Printf("[ERROR] Reload: recreating '%s', keeping old one: %s", name, err)
+			lastErr = err
+			continue
+		}
+
+		go drain(name, server)
+	}
+
+	return lastErr
+}
+
+/**
+ * Returns network of server listening socket
+ */
+func network(server config.Server) string {
+	if server.Protocol == "udp" {
+		return "udp"
+	}
+	return "tcp"
+}
+
+/**
+ * Returns server config with parts that can be reloaded
+ * in place (upstream, balancer, healthcheck, filters and shaping) cleared
+ */
+func withoutReloadable(server config.Server) config.Server {
+
+	server.Balance = ""
+	server.ConsistentHash = nil
+	server.Upstream = nil
+	server.Discovery = nil
+	server.Healthcheck = nil
+	server.OutlierDetection = nil
+
+	server.MaxConnections = nil
+	server.PerIpConnections = nil
+	server.Acl = nil
+	server.Geo = nil
+	server.BanPolicy = nil
+	server.LimitReconnectRate = nil
+	server.LimitPeripRate = nil
+	server.LimitChinaAccessDefault = ""
+	server.LimitChinaAccess = nil
+	server.FilterRequestContentDefault = ""
+	server.FilterRequestContent = nil
+	server.Content = nil
+	server.Shaping = nil
+	server.Filters = nil
+	server.FilterInstances = nil
+
+	return server
+}
+
+/**
+ * Delete server draining active connections in background,
+ * drain progress is available from Draining until server is stopped
+ */
+func Delete(name string) error {
+
+	servers.Lock()
 	server, ok := servers.m[name]
 	if !ok {
+		servers.Unlock()
 		return errors.New("Server not found")
 	}
-
-	server.Stop()
 	delete(servers.m, name)
+	servers.Unlock()
+
+	go drain(name, server)
 
 	return nil
 }
 
+/**
+ * Drain all servers and wait until they stop
+ */
+func Shutdown() {
+
+	log.Println("[INFO] Shutting down...")
+
+	servers.Lock()
+	all := servers.m
+	servers.m = make(map[string]core.Server)
+	servers.Unlock()
+
+	var wg sync.WaitGroup
+	for name, server := range all {
+		wg.Add(1)
+		go func(name string, server core.Server) {
+			defer wg.Done()
+			drain(name, server)
+		}(name, server)
+	}
+	wg.Wait()
+
+	log.Println("[INFO] Shut down")
+}
+
+/**
+ * Drain server keeping it in draining servers until it stops
+ */
+func drain(name string, server core.Server) {
+
+	draining.Lock()
+	draining.m[name] = server
+	draining.Unlock()
+
+	server.Drain()
+
+	draining.Lock()
+	if draining.m[name] == server {
+		delete(draining.m, name)
+	}
+	draining.Unlock()
+}
+
+/**
+ * Returns drain progress of draining servers
+ */
+func Draining() map[string]*core.DrainStatus {
+	result := map[string]*core.DrainStatus{}
+
+	draining.RLock()
+	for name, server := range draining.m {
+		result[name] = server.DrainStatus()
+	}
+	draining.RUnlock()
+
+	return result
+}
+
+/**
+ * Returns backends manager of the server
+ */
+func Backends(name string) (core.BackendsManager, error) {
+
+	servers.RLock()
+	server, ok := servers.m[name]
+	servers.RUnlock()
+
+	if !ok {
+		return nil, errors.New("Server not found")
+	}
+
+	return server.Backends(), nil
+}
+
 /**
  * Returns stats for the server
  */
@@ -210,6 +455,35 @@ func prepareConfig(name string, server config.Server, defaults config.Connection
 		}
 	}
 
+	if server.AcceptProxyProtocol {
+		if server.Protocol == "udp" {
+			return config.Server{}, errors.New("accept_proxy_protocol is not supported for udp protocol")
+		}
+		if server.ProxyProtocolReadTimeout == "" {
+			server.ProxyProtocolReadTimeout = "5s"
+		}
+		if _, err := time.ParseDuration(server.ProxyProtocolReadTimeout); err != nil {
+			return config.Server{}, errors.New("proxy_protocol_read_timeout parsing error")
+		}
+		if len(server.ProxyProtocolTrusted) == 0 {
+			return config.Server{}, errors.New("accept_proxy_protocol requires proxy_protocol_trusted sources")
+		}
+		for _, cidr := range server.ProxyProtocolTrusted {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return config.Server{}, errors.New("proxy_protocol_trusted parsing error " + cidr)
+			}
+		}
+	}
+
+	switch server.SendProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		return config.Server{}, errors.New("Not supported send_proxy_protocol " + server.SendProxyProtocol)
+	}
+	if server.SendProxyProtocol != "" && server.Protocol == "udp" {
+		return config.Server{}, errors.New("send_proxy_protocol is not supported for udp protocol")
+	}
+
 	/* ----- Connections params and overrides ----- */
 
 	/* Protocol */
@@ -233,13 +507,247 @@ func prepareConfig(name string, server config.Server, defaults config.Connection
 		"leastconn",
 		"roundrobin",
 		"leastbandwidth",
-		"iphash":
+		"iphash",
+		"consistenthash":
 	case "":
 		server.Balance = "weight"
 	default:
 		return config.Server{}, errors.New("Not supported balance type " + server.Balance)
 	}
 
+	if server.ConsistentHash != nil {
+		switch server.ConsistentHash.Key {
+		case "":
+			server.ConsistentHash.Key = "ip"
+		case "ip", "ip_port", "sni", "country", "asn":
+		default:
+			return config.Server{}, errors.New("Not supported consistent hash key " + server.ConsistentHash.Key)
+		}
+		if server.ConsistentHash.VirtualNodes < 0 {
+			return config.Server{}, errors.New("virtual_nodes should not be negative")
+		}
+	}
+
+	/* Discovery */
+	if server.Discovery == nil {
+		server.Discovery = &config.Discovery{
+			Kind: "static",
+		}
+	}
+
+	switch server.Discovery.Kind {
+	case "":
+		server.Discovery.Kind = "static"
+	case "static":
+	case "dns":
+		if server.Discovery.DnsDiscoveryConfig == nil {
+			server.Discovery.DnsDiscoveryConfig = &config.DnsDiscoveryConfig{}
+		}
+		switch server.Discovery.DnsFamily {
+		case "", "ipv4", "ipv6":
+		default:
+			return config.Server{}, errors.New("Not supported dns family " + server.Discovery.DnsFamily)
+		}
+	case "srv":
+		if server.Discovery.SrvDiscoveryConfig == nil || server.Discovery.SrvLookupPattern == "" {
+			return config.Server{}, errors.New("Need srv_lookup_pattern for srv discovery")
+		}
+	case "file":
+		if server.Discovery.FileDiscoveryConfig == nil || server.Discovery.FilePath == "" {
+			return config.Server{}, errors.New("Need file_path for file discovery")
+		}
+		switch server.Discovery.FileFormat {
+		case "", "plain", "json":
+		default:
+			return config.Server{}, errors.New("Not supported file format " + server.Discovery.FileFormat)
+		}
+		if server.Discovery.Interval == "" {
+			server.Discovery.Interval = "1s"
+		}
+	case "json":
+		if server.Discovery.JsonDiscoveryConfig == nil || server.Discovery.JsonEndpoint == "" {
+			return config.Server{}, errors.New("Need json_endpoint for json discovery")
+		}
+	default:
+		return config.Server{}, errors.New("Not supported discovery kind " + server.Discovery.Kind)
+	}
+
+	switch server.Discovery.FailPolicy {
+	case "":
+		server.Discovery.FailPolicy = "keeplast"
+	case "keeplast", "setempty":
+	default:
+		return config.Server{}, errors.New("Not supported discovery failpolicy " + server.Discovery.FailPolicy)
+	}
+
+	if server.Discovery.Kind != "static" && server.Discovery.Interval == "" {
+		server.Discovery.Interval = "30s"
+	}
+	if server.Discovery.Timeout == "" {
+		server.Discovery.Timeout = "5s"
+	}
+	if server.Discovery.RetryWait == "" {
+		server.Discovery.RetryWait = "2s"
+	}
+	for _, d := range []string{
+		server.Discovery.Interval,
+		server.Discovery.Timeout,
+		server.Discovery.RetryWait,
+	} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return config.Server{}, errors.New("discovery duration parsing error")
+		}
+	}
+
+	/* Retries */
+	if server.Retries < 0 {
+		return config.Server{}, errors.New("retries should not be negative")
+	}
+	if server.RetryBackoff != "" {
+		if _, err := time.ParseDuration(server.RetryBackoff); err != nil {
+			return config.Server{}, errors.New("retry_backoff parsing error")
+		}
+	}
+
+	/* Healthcheck */
+	if server.Healthcheck == nil {
+		server.Healthcheck = &config.HealthcheckConfig{
+			Kind: "none",
+		}
+	}
+
+	switch server.Healthcheck.Kind {
+	case "ping":
+		if server.Healthcheck.PingHealthcheckConfig == nil {
+			server.Healthcheck.PingHealthcheckConfig = &config.PingHealthcheckConfig{}
+		}
+		switch server.Healthcheck.PingHealthcheckConfig.Protocol {
+		case "":
+			server.Healthcheck.PingHealthcheckConfig.Protocol = "tcp"
+			if server.Protocol == "udp" {
+				server.Healthcheck.PingHealthcheckConfig.Protocol = "udp"
+			}
+		case "tcp", "udp":
+		default:
+			return config.Server{}, errors.New("Not supported ping protocol " + server.Healthcheck.PingHealthcheckConfig.Protocol)
+		}
+	case "exec":
+		if server.Healthcheck.ExecHealthcheckConfig == nil || server.Healthcheck.ExecCommand == "" {
+			return config.Server{}, errors.New("Need exec_command for exec healthcheck")
+		}
+	case "tls":
+		if server.Protocol == "udp" {
+			return config.Server{}, errors.New("tls healthcheck is not supported for udp protocol")
+		}
+	case "http":
+		if server.Protocol == "udp" {
+			return config.Server{}, errors.New("http healthcheck is not supported for udp protocol")
+		}
+		if server.Healthcheck.HttpHealthcheckConfig == nil {
+			server.Healthcheck.HttpHealthcheckConfig = &config.HttpHealthcheckConfig{}
+		}
+		if server.Healthcheck.HttpPath == "" {
+			server.Healthcheck.HttpPath = "/"
+		}
+		if server.Healthcheck.HttpExpectedStatus == 0 {
+			server.Healthcheck.HttpExpectedStatus = 200
+		}
+		if _, err := regexp.Compile(server.Healthcheck.HttpExpectedBody); err != nil {
+			return config.Server{}, errors.New("http_expected_body parsing error")
+		}
+	case "probe":
+		if server.Healthcheck.ProbeHealthcheckConfig == nil {
+			server.Healthcheck.ProbeHealthcheckConfig = &config.ProbeHealthcheckConfig{}
+		}
+		switch server.Healthcheck.ProbeProtocol {
+		case "":
+			server.Healthcheck.ProbeProtocol = "tcp"
+			if server.Protocol == "udp" {
+				server.Healthcheck.ProbeProtocol = "udp"
+			}
+		case "tcp", "udp":
+		default:
+			return config.Server{}, errors.New("Not supported probe protocol " + server.Healthcheck.ProbeProtocol)
+		}
+		if _, err := regexp.Compile(server.Healthcheck.ProbeRecv); err != nil {
+			return config.Server{}, errors.New("probe_recv parsing error")
+		}
+	case "none":
+	case "":
+		server.Healthcheck.Kind = "none"
+	default:
+		if !healthcheck.Registered(server.Healthcheck.Kind) {
+			return config.Server{}, errors.New("Not supported healthcheck kind " + server.Healthcheck.Kind)
+		}
+	}
+
+	if server.Healthcheck.Interval == "" {
+		server.Healthcheck.Interval = "2s"
+	}
+	if server.Healthcheck.Timeout == "" {
+		server.Healthcheck.Timeout = "1s"
+	}
+	if _, err := time.ParseDuration(server.Healthcheck.Interval); err != nil {
+		return config.Server{}, errors.New("healthcheck interval parsing error")
+	}
+	if _, err := time.ParseDuration(server.Healthcheck.Timeout); err != nil {
+		return config.Server{}, errors.New("healthcheck timeout parsing error")
+	}
+	if server.Healthcheck.Passes <= 0 {
+		server.Healthcheck.Passes = 1
+	}
+	if server.Healthcheck.Fails <= 0 {
+		server.Healthcheck.Fails = 1
+	}
+
+	/* Filters */
+	if err := filter.Validate(server); err != nil {
+		return config.Server{}, errors.New("filters: " + err.Error())
+	}
+
+	if _, err := filter.NewBanPolicy(server.BanPolicy); err != nil {
+		return config.Server{}, errors.New("ban_policy: " + err.Error())
+	}
+
+	/* Shaping */
+	if _, err := shaper.New(server.Shaping); err != nil {
+		return config.Server{}, errors.New("shaping: " + err.Error())
+	}
+
+	/* Outlier detection */
+	if server.OutlierDetection != nil {
+		if server.OutlierDetection.ConsecutiveFailures <= 0 {
+			server.OutlierDetection.ConsecutiveFailures = 5
+		}
+		if server.OutlierDetection.Interval == "" {
+			server.OutlierDetection.Interval = "10s"
+		}
+		if server.OutlierDetection.BaseEjectionTime == "" {
+			server.OutlierDetection.BaseEjectionTime = "30s"
+		}
+		if server.OutlierDetection.MaxEjectionTime == "" {
+			server.OutlierDetection.MaxEjectionTime = "300s"
+		}
+		if server.OutlierDetection.MaxEjectionPercent <= 0 {
+			server.OutlierDetection.MaxEjectionPercent = 50
+		}
+		if server.OutlierDetection.MaxEjectionPercent > 100 {
+			return config.Server{}, errors.New("max_ejection_percent should be in range 1..100")
+		}
+		for _, d := range []string{
+			server.OutlierDetection.Interval,
+			server.OutlierDetection.BaseEjectionTime,
+			server.OutlierDetection.MaxEjectionTime,
+		} {
+			if _, err := time.ParseDuration(d); err != nil {
+				return config.Server{}, errors.New("outlier detection duration parsing error")
+			}
+		}
+	}
+
 	/* TODO: Still need to decide how to get rid of this */
 
 	if defaults.MaxConnections == nil {
@@ -277,5 +785,17 @@ func prepareConfig(name string, server config.Server, defaults config.Connection
 		*server.BackendConnectionTimeout = *defaults.BackendConnectionTimeout
 	}
 
+	if defaults.DrainTimeout == nil {
+		defaults.DrainTimeout = new(string)
+		*defaults.DrainTimeout = "30s"
+	}
+	if server.DrainTimeout == nil {
+		server.DrainTimeout = new(string)
+		*server.DrainTimeout = *defaults.DrainTimeout
+	}
+	if _, err := time.ParseDuration(*server.DrainTimeout); err != nil {
+		return config.Server{}, errors.New("drain_timeout parsing error")
+	}
+
 	return server, nil
 }
@@ -0,0 +1,84 @@
+/**
+ * conn.go - connection accepted with PROXY protocol header
+ */
+
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+/**
+ * Conn delegates all calls to net.Conn, but Read to reader
+ * and addresses to ones from PROXY protocol header
+ */
+type Conn struct {
+	reader io.Reader
+	net.Conn
+
+	/* Header read from connection */
+	Header *Header
+}
+
+func (c Conn) Read(b []byte) (n int, err error) {
+	return c.reader.Read(b)
+}
+
+/**
+ * Original client address, or peer address if
+ * header says addresses are not relevant
+ */
+func (c Conn) RemoteAddr() net.Addr {
+	if c.Header.Local || c.Header.SourceAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.Header.SourceAddr
+}
+
+/**
+ * Original destination address, or local address if
+ * header says addresses are not relevant
+ */
+func (c Conn) LocalAddr() net.Addr {
+	if c.Header.Local || c.Header.DestinationAddr == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.Header.DestinationAddr
+}
+
+/**
+ * Accept reads PROXY protocol header from tcp connection, rejecting
+ * headers of other transports. Returns proxyprotocol.Conn reporting
+ * original addresses
+ */
+func Accept(conn net.Conn, readTimeout time.Duration) (net.Conn, error) {
+
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+	br := bufio.NewReader(conn)
+	header, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// udp addresses make no sense for stream connection
+	if !header.Local {
+		if _, ok := header.SourceAddr.(*net.TCPAddr); !ok {
+			return nil, errors.New("PROXY header of not tcp connection")
+		}
+	}
+
+	conn.SetReadDeadline(time.Time{}) // Reset read deadline
+
+	// Read buffered data first and remaining data from initial conn
+	data := make([]byte, br.Buffered())
+	br.Read(data)
+	mreader := io.MultiReader(bytes.NewReader(data), conn)
+
+	return Conn{mreader, conn, header}, nil
+}
@@ -0,0 +1,396 @@
+/**
+ * header.go - PROXY protocol v1 / v2 header
+ *
+ * See https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+ */
+
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+
+	/* Max length of v1 header including CRLF */
+	V1_MAX_LENGTH = 107
+
+	/* v2 command: connection was established on purpose by the proxy */
+	V2_CMD_LOCAL = 0x0
+
+	/* v2 command: connection was established on behalf of another node */
+	V2_CMD_PROXY = 0x1
+
+	/* v2 address families and transport protocols */
+	V2_FAM_UNSPEC    = 0x00
+	V2_FAM_TCP_OVER4 = 0x11
+	V2_FAM_UDP_OVER4 = 0x12
+	V2_FAM_TCP_OVER6 = 0x21
+	V2_FAM_UDP_OVER6 = 0x22
+
+	/* v2 TLV types */
+	V2_TYPE_ALPN      = 0x01
+	V2_TYPE_AUTHORITY = 0x02
+)
+
+/* v2 header signature */
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+/* v1 header prefix */
+var v1Prefix = []byte("PROXY ")
+
+/**
+ * Parsed PROXY protocol header
+ */
+type Header struct {
+
+	/* 1 or 2 */
+	Version int
+
+	/* True if addresses are not relevant (v1 UNKNOWN or v2 LOCAL) */
+	Local bool
+
+	/* Original client address */
+	SourceAddr net.Addr
+
+	/* Original destination address */
+	DestinationAddr net.Addr
+
+	/* v2 TLVs by type */
+	TLVs map[byte][]byte
+}
+
+/**
+ * Read PROXY protocol header of any version from reader
+ */
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+
+	sig, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, v1Prefix) {
+		return readV1(r)
+	}
+
+	sig, err = r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+
+	return nil, errors.New("No PROXY protocol header")
+}
+
+/**
+ * Read v1 text header:
+ * PROXY TCP4|TCP6|UNKNOWN src dst srcport dstport\r\n
+ */
+func readV1(r *bufio.Reader) (*Header, error) {
+
+	line := make([]byte, 0, V1_MAX_LENGTH)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		}
+
+		if len(line) >= V1_MAX_LENGTH {
+			return nil, errors.New("PROXY v1 header is too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header should end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	header := &Header{
+		Version: 1,
+	}
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		header.Local = true
+		return header, nil
+	}
+
+	if len(fields) != 6 {
+		return nil, errors.New("Invalid PROXY v1 header")
+	}
+
+	srcIp := net.ParseIP(fields[2])
+	dstIp := net.ParseIP(fields[3])
+	if srcIp == nil || dstIp == nil {
+		return nil, errors.New("Invalid PROXY v1 header address")
+	}
+
+	switch fields[1] {
+	case "TCP4":
+		if srcIp.To4() == nil || dstIp.To4() == nil {
+			return nil, errors.New("Invalid PROXY v1 header TCP4 address")
+		}
+	case "TCP6":
+	default:
+		return nil, errors.New("Invalid PROXY v1 header protocol " + fields[1])
+	}
+
+	srcPort, err := parsePort(fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	dstPort, err := parsePort(fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	header.SourceAddr = &net.TCPAddr{IP: srcIp, Port: srcPort}
+	header.DestinationAddr = &net.TCPAddr{IP: dstIp, Port: dstPort}
+
+	return header, nil
+}
+
+/**
+ * Read v2 binary header
+ */
+func readV2(r *bufio.Reader) (*Header, error) {
+
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	if fixed[12]>>4 != 2 {
+		return nil, errors.New("Invalid PROXY v2 header version")
+	}
+
+	command := fixed[12] & 0x0f
+	family := fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	header := &Header{
+		Version: 2,
+	}
+
+	switch command {
+	case V2_CMD_LOCAL:
+		header.Local = true
+		return header, nil
+	case V2_CMD_PROXY:
+	default:
+		return nil, errors.New("Invalid PROXY v2 header command")
+	}
+
+	var addrLen int
+	switch family {
+	case V2_FAM_TCP_OVER4, V2_FAM_UDP_OVER4:
+		addrLen = 12
+		if len(payload) < addrLen {
+			return nil, errors.New("Invalid PROXY v2 header length")
+		}
+		header.SourceAddr, header.DestinationAddr = v2Addrs(family, payload[0:4], payload[4:8], payload[8:10], payload[10:12])
+	case V2_FAM_TCP_OVER6, V2_FAM_UDP_OVER6:
+		addrLen = 36
+		if len(payload) < addrLen {
+			return nil, errors.New("Invalid PROXY v2 header length")
+		}
+		header.SourceAddr, header.DestinationAddr = v2Addrs(family, payload[0:16], payload[16:32], payload[32:34], payload[34:36])
+	default:
+		// unix sockets and unspec, addresses are not relevant
+		header.Local = true
+		return header, nil
+	}
+
+	tlvs, err := parseTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+
+	return header, nil
+}
+
+/**
+ * Make addresses from v2 address block
+ */
+func v2Addrs(family byte, src, dst, srcPort, dstPort []byte) (net.Addr, net.Addr) {
+
+	srcIp := make(net.IP, len(src))
+	copy(srcIp, src)
+	dstIp := make(net.IP, len(dst))
+	copy(dstIp, dst)
+
+	sp := int(binary.BigEndian.Uint16(srcPort))
+	dp := int(binary.BigEndian.Uint16(dstPort))
+
+	if family == V2_FAM_UDP_OVER4 || family == V2_FAM_UDP_OVER6 {
+		return &net.UDPAddr{IP: srcIp, Port: sp}, &net.UDPAddr{IP: dstIp, Port: dp}
+	}
+
+	return &net.TCPAddr{IP: srcIp, Port: sp}, &net.TCPAddr{IP: dstIp, Port: dp}
+}
+
+/**
+ * Parse v2 type-length-value vectors
+ */
+func parseTLVs(data []byte) (map[byte][]byte, error) {
+
+	tlvs := make(map[byte][]byte)
+
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, errors.New("Invalid PROXY v2 TLV")
+		}
+
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return nil, errors.New("Invalid PROXY v2 TLV length")
+		}
+
+		tlvs[data[0]] = data[3 : 3+length]
+		data = data[3+length:]
+	}
+
+	return tlvs, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, errors.New("Invalid PROXY header port " + s)
+	}
+	return port, nil
+}
+
+/**
+ * Format header in PROXY protocol version 1 or 2.
+ * TLVs are sent in v2 only
+ */
+func (h *Header) Format(version int) ([]byte, error) {
+	switch version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2()
+	default:
+		return nil, errors.New("Unknown PROXY protocol version " + strconv.Itoa(version))
+	}
+}
+
+/**
+ * Returns source and destination ip and ports if header has tcp addresses
+ */
+func (h *Header) tcpAddrs() (*net.TCPAddr, *net.TCPAddr, bool) {
+
+	if h.Local {
+		return nil, nil, false
+	}
+
+	src, ok := h.SourceAddr.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+
+	dst, ok := h.DestinationAddr.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+
+	return src, dst, true
+}
+
+func (h *Header) formatV1() []byte {
+
+	src, dst, ok := h.tcpAddrs()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	proto := "TCP4"
+	srcIp, dstIp := src.IP.To4(), dst.IP.To4()
+	if srcIp == nil || dstIp == nil {
+		proto = "TCP6"
+		srcIp, dstIp = src.IP.To16(), dst.IP.To16()
+	}
+
+	return []byte("PROXY " + proto + " " + srcIp.String() + " " + dstIp.String() + " " +
+		strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n")
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+
+	buf := bytes.NewBuffer(make([]byte, 0, 64))
+	buf.Write(v2Signature)
+
+	var payload []byte
+
+	src, dst, ok := h.tcpAddrs()
+	if !ok {
+		buf.WriteByte(0x20 | V2_CMD_LOCAL)
+		buf.WriteByte(V2_FAM_UNSPEC)
+	} else {
+		buf.WriteByte(0x20 | V2_CMD_PROXY)
+
+		srcIp, dstIp := src.IP.To4(), dst.IP.To4()
+		if srcIp != nil && dstIp != nil {
+			buf.WriteByte(V2_FAM_TCP_OVER4)
+		} else {
+			buf.WriteByte(V2_FAM_TCP_OVER6)
+			srcIp, dstIp = src.IP.To16(), dst.IP.To16()
+		}
+
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports[0:2], uint16(src.Port))
+		binary.BigEndian.PutUint16(ports[2:4], uint16(dst.Port))
+
+		payload = append(payload, srcIp...)
+		payload = append(payload, dstIp...)
+		payload = append(payload, ports...)
+
+		// tlvs in type order to keep output stable
+		for t := 0; t < 256; t++ {
+			value, ok := h.TLVs[byte(t)]
+			if !ok {
+				continue
+			}
+			if len(value) > 0xffff {
+				return nil, errors.New("PROXY v2 TLV is too long")
+			}
+			payload = append(payload, byte(t), byte(len(value)>>8), byte(len(value)))
+			payload = append(payload, value...)
+		}
+	}
+
+	if len(payload) > 0xffff {
+		return nil, errors.New("PROXY v2 header is too long")
+	}
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(payload)))
+	buf.Write(length)
+	buf.Write(payload)
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,208 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+/**
+ * Build v2 header with command, family and payload
+ */
+func v2Header(command, family byte, payload []byte) []byte {
+	buf := append([]byte{}, v2Signature...)
+	buf = append(buf, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(buf[14:16], uint16(len(payload)))
+	return append(buf, payload...)
+}
+
+func v2Ipv4Payload() []byte {
+	return []byte{
+		192, 168, 0, 1, // src
+		10, 0, 0, 1, // dst
+		0x30, 0x39, // 12345
+		0x01, 0xbb, // 443
+	}
+}
+
+func read(data []byte) (*Header, error) {
+	return ReadHeader(bufio.NewReader(bytes.NewReader(data)))
+}
+
+func TestReadV1(t *testing.T) {
+
+	header, err := read([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 12345 443\r\ndata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Version != 1 || header.Local {
+		t.Fatalf("unexpected header %+v", header)
+	}
+	if header.SourceAddr.String() != "192.168.0.1:12345" || header.DestinationAddr.String() != "10.0.0.1:443" {
+		t.Fatalf("unexpected addresses %s %s", header.SourceAddr, header.DestinationAddr)
+	}
+
+	header, err = read([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 1 2\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.SourceAddr.String() != "[2001:db8::1]:1" {
+		t.Fatalf("unexpected source %s", header.SourceAddr)
+	}
+
+	header, err = read([]byte("PROXY UNKNOWN\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.Local {
+		t.Fatal("UNKNOWN header should be local")
+	}
+}
+
+func TestReadV1Invalid(t *testing.T) {
+
+	for _, data := range []string{
+		"PROXY TCP4 192.168.0.1 10.0.0.1 12345\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n",
+		"PROXY UDP4 192.168.0.1 10.0.0.1 1 2\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 1 70000\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 1 2\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1",
+		"GET / HTTP/1.1\r\n",
+	} {
+		if _, err := read([]byte(data)); err == nil {
+			t.Errorf("expected error for %q", data)
+		}
+	}
+}
+
+func TestReadV2(t *testing.T) {
+
+	payload := v2Ipv4Payload()
+	payload = append(payload, V2_TYPE_AUTHORITY, 0, 4)
+	payload = append(payload, []byte("host")...)
+
+	header, err := read(v2Header(V2_CMD_PROXY, V2_FAM_TCP_OVER4, payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Version != 2 || header.Local {
+		t.Fatalf("unexpected header %+v", header)
+	}
+	if _, ok := header.SourceAddr.(*net.TCPAddr); !ok {
+		t.Fatalf("expected tcp source, got %T", header.SourceAddr)
+	}
+	if header.SourceAddr.String() != "192.168.0.1:12345" || header.DestinationAddr.String() != "10.0.0.1:443" {
+		t.Fatalf("unexpected addresses %s %s", header.SourceAddr, header.DestinationAddr)
+	}
+	if string(header.TLVs[V2_TYPE_AUTHORITY]) != "host" {
+		t.Fatalf("unexpected tlvs %v", header.TLVs)
+	}
+}
+
+func TestReadV2Local(t *testing.T) {
+
+	header, err := read(v2Header(V2_CMD_LOCAL, V2_FAM_UNSPEC, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.Local || header.SourceAddr != nil {
+		t.Fatalf("unexpected header %+v", header)
+	}
+
+	// LOCAL with addresses, addresses are ignored
+	header, err = read(v2Header(V2_CMD_LOCAL, V2_FAM_TCP_OVER4, v2Ipv4Payload()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.Local || header.SourceAddr != nil {
+		t.Fatalf("unexpected header %+v", header)
+	}
+}
+
+func TestReadV2Truncated(t *testing.T) {
+
+	full := v2Header(V2_CMD_PROXY, V2_FAM_TCP_OVER4, v2Ipv4Payload())
+
+	for _, n := range []int{len(v2Signature) + 2, 16, len(full) - 1} {
+		if _, err := read(full[:n]); err == nil {
+			t.Errorf("expected error for header truncated to %d bytes", n)
+		}
+	}
+
+	// declared length shorter than address block
+	if _, err := read(v2Header(V2_CMD_PROXY, V2_FAM_TCP_OVER4, v2Ipv4Payload()[:8])); err == nil {
+		t.Error("expected error for short address block")
+	}
+
+	// truncated tlv
+	payload := append(v2Ipv4Payload(), V2_TYPE_ALPN, 0, 10, 'h')
+	if _, err := read(v2Header(V2_CMD_PROXY, V2_FAM_TCP_OVER4, payload)); err == nil {
+		t.Error("expected error for truncated tlv")
+	}
+}
+
+func TestReadV2Udp(t *testing.T) {
+
+	header, err := read(v2Header(V2_CMD_PROXY, V2_FAM_UDP_OVER4, v2Ipv4Payload()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := header.SourceAddr.(*net.UDPAddr); !ok {
+		t.Fatalf("expected udp source, got %T", header.SourceAddr)
+	}
+}
+
+/**
+ * Accept header sent over in-memory connection
+ */
+func accept(data []byte) (net.Conn, error) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		client.Write(data)
+	}()
+
+	return Accept(server, time.Second)
+}
+
+func TestAcceptRejectsUdp(t *testing.T) {
+
+	for _, family := range []byte{V2_FAM_UDP_OVER4, V2_FAM_UDP_OVER6} {
+
+		payload := v2Ipv4Payload()
+		if family == V2_FAM_UDP_OVER6 {
+			payload = make([]byte, 36)
+		}
+
+		if _, err := accept(v2Header(V2_CMD_PROXY, family, payload)); err == nil {
+			t.Errorf("expected udp family 0x%x to be rejected", family)
+		}
+	}
+}
+
+func TestAccept(t *testing.T) {
+
+	conn, err := accept([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 12345 443\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "192.168.0.1:12345" {
+		t.Fatalf("unexpected remote address %s", conn.RemoteAddr())
+	}
+
+	conn, err = accept(v2Header(V2_CMD_LOCAL, V2_FAM_UNSPEC, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "pipe" {
+		t.Fatalf("unexpected remote address %s", conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,204 @@
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/utils/cidrtree"
+)
+
+/**
+ * Static allow / deny rules over ip and cidr, first matching rule wins
+ */
+type AclFilter struct {
+
+	/* Prefixes of all rules */
+	tree *cidrtree.Tree
+
+	/* Is rule allowing, by rule index */
+	allows []bool
+
+	/* Allow if no rule matches */
+	allowDefault bool
+}
+
+/**
+ * Build acl from configuration
+ */
+func NewAcl(cfg config.Acl) (*AclFilter, error) {
+
+	acl := &AclFilter{
+		tree: &cidrtree.Tree{},
+	}
+
+	switch cfg.Default {
+	case "", "allow":
+		acl.allowDefault = true
+	case "deny":
+	default:
+		return nil, errors.New("Not supported acl default " + cfg.Default)
+	}
+
+	lists := map[string][]*net.IPNet{}
+
+	for i, rule := range cfg.Rules {
+
+		fields := strings.Fields(rule)
+		if len(fields) != 2 {
+			return nil, errors.New("Bad acl rule '" + rule + "', expected 'allow|deny <ip|cidr|@list>'")
+		}
+
+		switch fields[0] {
+		case "allow":
+			acl.allows = append(acl.allows, true)
+		case "deny":
+			acl.allows = append(acl.allows, false)
+		default:
+			return nil, errors.New("Bad acl rule action '" + fields[0] + "'")
+		}
+
+		var networks []*net.IPNet
+
+		if strings.HasPrefix(fields[1], "@") {
+			name := fields[1][1:]
+			var ok bool
+			if networks, ok = lists[name]; !ok {
+				path, ok := cfg.Lists[name]
+				if !ok {
+					return nil, errors.New("Unknown acl list '" + name + "'")
+				}
+				list, err := loadAclList(path)
+				if err != nil {
+					return nil, err
+				}
+				lists[name] = list
+				networks = list
+			}
+		} else {
+			network, err := parseAclNetwork(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			networks = []*net.IPNet{network}
+		}
+
+		for _, network := range networks {
+			acl.tree.Insert(network, i)
+		}
+	}
+
+	return acl, nil
+}
+
+/**
+ * Parse ip or cidr
+ */
+func parseAclNetwork(s string) (*net.IPNet, error) {
+
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("Bad acl ip or cidr '" + s + "'")
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+/**
+ * Load list of ip or cidr per line, # starts comment
+ */
+func loadAclList(path string) ([]*net.IPNet, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var result []*net.IPNet
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		network, err := parseAclNetwork(line)
+		if err != nil {
+			return nil, errors.New(path + ":" + strconv.Itoa(n) + ": " + err.Error())
+		}
+		result = append(result, network)
+	}
+
+	return result, scanner.Err()
+}
+
+/**
+ * Check if ip is allowed
+ */
+func (this *AclFilter) Allows(ip net.IP) bool {
+	if rule, ok := this.tree.Lookup(ip); ok {
+		return this.allows[rule]
+	}
+	return this.allowDefault
+}
+
+func (this *AclFilter) Validate(cfg config.FilterOptions) error {
+	if cfg.Acl == nil {
+		return nil
+	}
+	_, err := NewAcl(*cfg.Acl)
+	return err
+}
+
+func (this *AclFilter) Init(cfg config.FilterOptions) bool {
+	if cfg.Acl == nil {
+		return false
+	}
+
+	acl, err := NewAcl(*cfg.Acl)
+	if err != nil {
+		log.Printf("[ERROR] acl: %s", err)
+		return false
+	}
+
+	*this = *acl
+	return true
+}
+
+func (this *AclFilter) Connect(client net.Addr) (ConnectionFilter, error) {
+	host, _, _ := net.SplitHostPort(client.String())
+	ip := net.ParseIP(host)
+	if ip == nil || !this.Allows(ip) {
+		return nil, RejectError("acl denied " + host)
+	}
+	return NopConnectionFilter{}, nil
+}
+
+func (this *AclFilter) Stop() {
+}
+
+func init() {
+	RegisterFilter("acl", func() interface{} {
+		return new(AclFilter)
+	})
+}
@@ -0,0 +1,125 @@
+/**
+ * ahocorasick.go - Aho-Corasick automaton matching many literals
+ * in one pass. Its state can be kept between chunks of the stream,
+ * so literals split across reads are found too
+ */
+
+package filter
+
+/**
+ * Automaton node
+ */
+type acNode struct {
+	children map[byte]int32
+
+	/* Longest proper suffix node */
+	fail int32
+
+	/* Smallest value of literals ending here or in suffixes, -1 if none */
+	value int
+}
+
+type ahoCorasick struct {
+	nodes []acNode
+}
+
+func newAhoCorasick() *ahoCorasick {
+	return &ahoCorasick{
+		nodes: []acNode{{children: make(map[byte]int32), value: -1}},
+	}
+}
+
+/**
+ * Add literal with value, smaller values win on match.
+ * Should not be called after Build
+ */
+func (this *ahoCorasick) Add(literal []byte, value int) {
+
+	n := int32(0)
+	for _, b := range literal {
+		next, ok := this.nodes[n].children[b]
+		if !ok {
+			next = int32(len(this.nodes))
+			this.nodes = append(this.nodes, acNode{children: make(map[byte]int32), value: -1})
+			this.nodes[n].children[b] = next
+		}
+		n = next
+	}
+
+	if this.nodes[n].value < 0 || value < this.nodes[n].value {
+		this.nodes[n].value = value
+	}
+}
+
+/**
+ * Compute failure links, breadth first
+ */
+func (this *ahoCorasick) Build() {
+
+	queue := []int32{}
+	for _, child := range this.nodes[0].children {
+		this.nodes[child].fail = 0
+		queue = append(queue, child)
+	}
+
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+
+		for b, child := range this.nodes[n].children {
+
+			fail := this.nodes[n].fail
+			for {
+				if next, ok := this.nodes[fail].children[b]; ok && next != child {
+					fail = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = this.nodes[fail].fail
+			}
+
+			this.nodes[child].fail = fail
+			if v := this.nodes[fail].value; v >= 0 && (this.nodes[child].value < 0 || v < this.nodes[child].value) {
+				this.nodes[child].value = v
+			}
+
+			queue = append(queue, child)
+		}
+	}
+}
+
+/**
+ * Feed data starting from state, returns new state and smallest
+ * value of literals found, -1 if none
+ */
+func (this *ahoCorasick) Match(state int32, data []byte) (int32, int) {
+
+	best := -1
+	for _, b := range data {
+		for {
+			if next, ok := this.nodes[state].children[b]; ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = this.nodes[state].fail
+		}
+
+		if v := this.nodes[state].value; v >= 0 && (best < 0 || v < best) {
+			best = v
+		}
+	}
+
+	return state, best
+}
+
+/**
+ * Check if automaton has no literals
+ */
+func (this *ahoCorasick) Empty() bool {
+	return len(this.nodes) == 1
+}
@@ -0,0 +1,99 @@
+package filter
+
+import (
+	"testing"
+)
+
+func newTestAhoCorasick(literals ...string) *ahoCorasick {
+	ac := newAhoCorasick()
+	for i, literal := range literals {
+		ac.Add([]byte(literal), i)
+	}
+	ac.Build()
+	return ac
+}
+
+func TestAhoCorasickMatch(t *testing.T) {
+
+	ac := newTestAhoCorasick("hers", "his", "she", "he")
+
+	cases := []struct {
+		data string
+		best int
+	}{
+		{"ushers", 0},
+		{"this", 1},
+		{"ashe", 2},
+		{"the", 3},
+		{"hhe", 3},
+		{"hi there", 3},
+		{"nothing", -1},
+		{"", -1},
+	}
+
+	for _, c := range cases {
+		if _, best := ac.Match(0, []byte(c.data)); best != c.best {
+			t.Errorf("%s: expected %d, got %d", c.data, c.best, best)
+		}
+	}
+}
+
+func TestAhoCorasickSuffixValue(t *testing.T) {
+
+	// "bc" is found inside "abcd" through failure links
+	ac := newTestAhoCorasick("bc", "abcd")
+
+	if _, best := ac.Match(0, []byte("abcd")); best != 0 {
+		t.Fatalf("Expected suffix literal to win, got %d", best)
+	}
+	if _, best := ac.Match(0, []byte("xabx")); best != -1 {
+		t.Fatalf("Expected no match, got %d", best)
+	}
+}
+
+func TestAhoCorasickDuplicate(t *testing.T) {
+
+	ac := newAhoCorasick()
+	ac.Add([]byte("evil"), 3)
+	ac.Add([]byte("evil"), 1)
+	ac.Add([]byte("evil"), 2)
+	ac.Build()
+
+	if _, best := ac.Match(0, []byte("evil")); best != 1 {
+		t.Fatalf("Expected smallest value of duplicate literal, got %d", best)
+	}
+}
+
+func TestAhoCorasickStateAcrossChunks(t *testing.T) {
+
+	ac := newTestAhoCorasick("evil", "secret")
+
+	state := int32(0)
+	best := -1
+	for _, chunk := range []string{"se", "c", "r", "et"} {
+		state, best = ac.Match(state, []byte(chunk))
+	}
+	if best != 1 {
+		t.Fatalf("Expected literal split across chunks to match, got %d", best)
+	}
+
+	// fresh state does not remember previous chunks
+	if _, best := ac.Match(0, []byte("et")); best != -1 {
+		t.Fatalf("Expected no match from initial state, got %d", best)
+	}
+}
+
+func TestAhoCorasickEmpty(t *testing.T) {
+
+	ac := newTestAhoCorasick()
+	if !ac.Empty() {
+		t.Fatal("Expected automaton without literals to be empty")
+	}
+	if state, best := ac.Match(0, []byte("anything")); state != 0 || best != -1 {
+		t.Fatalf("Expected empty automaton not to match, got %d %d", state, best)
+	}
+
+	if newTestAhoCorasick("a").Empty() {
+		t.Fatal("Expected automaton with literal not to be empty")
+	}
+}
@@ -0,0 +1,210 @@
+/**
+ * ban_policy.go - what to do with clients offending filters
+ */
+
+package filter
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/firewall"
+	"github.com/millken/tcpwder/utils"
+	"github.com/millken/tcpwder/utils/cidrtree"
+)
+
+const (
+	BAN_MODE_BAN    = "ban"
+	BAN_MODE_REJECT = "reject"
+	BAN_MODE_DRYRUN = "dryrun"
+)
+
+/**
+ * Offences state of a single client
+ */
+type banState struct {
+
+	/* Number of bans in a row, used for exponential ban time */
+	bans uint
+
+	/* Time when last ban expires */
+	bannedUntil time.Time
+}
+
+/**
+ * Ban policy decides if offending client is banned in firewall,
+ * for how long, or only rejected. Safe for concurrent use
+ */
+type BanPolicy struct {
+	sync.Mutex
+
+	/* ban | reject | dryrun */
+	mode string
+
+	/* Ban time of the first ban, doubled on every next one */
+	baseBanTime time.Duration
+
+	/* Max ban time */
+	maxBanTime time.Duration
+
+	/* Clients never banned */
+	allowlist *cidrtree.Tree
+
+	/* Per client states */
+	states map[string]*banState
+}
+
+/**
+ * Create ban policy from configuration, default one if nil
+ */
+func NewBanPolicy(cfg *config.BanPolicy) (*BanPolicy, error) {
+	policy := &BanPolicy{
+		states: make(map[string]*banState),
+	}
+	if err := policy.configure(cfg); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+/**
+ * Apply configuration keeping clients states
+ */
+func (this *BanPolicy) configure(cfg *config.BanPolicy) error {
+
+	if cfg == nil {
+		cfg = &config.BanPolicy{}
+	}
+
+	mode := cfg.Mode
+	switch mode {
+	case "":
+		mode = BAN_MODE_BAN
+	case BAN_MODE_BAN, BAN_MODE_REJECT, BAN_MODE_DRYRUN:
+	default:
+		return errors.New("Not supported ban mode " + mode)
+	}
+
+	for _, d := range []string{cfg.BaseBanTime, cfg.MaxBanTime} {
+		if _, err := time.ParseDuration(d); d != "" && err != nil {
+			return errors.New("Bad ban time " + d)
+		}
+	}
+
+	baseBanTime := utils.ParseDurationOrDefault(cfg.BaseBanTime, time.Hour)
+	maxBanTime := utils.ParseDurationOrDefault(cfg.MaxBanTime, baseBanTime)
+	if baseBanTime <= 0 || maxBanTime < baseBanTime {
+		return errors.New("base_ban_time should be positive and not greater than max_ban_time")
+	}
+
+	allowlist := &cidrtree.Tree{}
+	for _, rule := range cfg.Allowlist {
+		network, err := parseAclNetwork(rule)
+		if err != nil {
+			return err
+		}
+		allowlist.Insert(network, 0)
+	}
+
+	this.Lock()
+	this.mode = mode
+	this.baseBanTime = baseBanTime
+	this.maxBanTime = maxBanTime
+	this.allowlist = allowlist
+	this.Unlock()
+
+	return nil
+}
+
+/**
+ * Reload configuration keeping clients states, keeps
+ * current configuration if new one is invalid
+ */
+func (this *BanPolicy) Reload(cfg *config.BanPolicy) {
+	if err := this.configure(cfg); err != nil {
+		log.Printf("[ERROR] ban policy: %s", err)
+	}
+}
+
+/**
+ * Handle offence of the client, banning it if needed. Offences of
+ * allowlisted clients are ignored. Returns false if offending client
+ * should still be served
+ */
+func (this *BanPolicy) HandleOffence(host, reason string) bool {
+
+	this.Lock()
+	defer this.Unlock()
+
+	if ip := net.ParseIP(host); ip != nil {
+		if _, ok := this.allowlist.Lookup(ip); ok {
+			log.Printf("[DEBUG] Ignoring offence of allowlisted %s: %s", host, reason)
+			return false
+		}
+	}
+
+	switch this.mode {
+	case BAN_MODE_REJECT:
+		return true
+	case BAN_MODE_DRYRUN:
+		log.Printf("[INFO] Dry run, would ban %s: %s", host, reason)
+		return false
+	}
+
+	// client is already banned, keep the ban as is
+	if !firewall.Allows(host) {
+		return true
+	}
+
+	now := time.Now()
+
+	state, ok := this.states[host]
+	if !ok {
+		state = &banState{}
+		this.states[host] = state
+	}
+
+	// forget previous bans if client behaved long enough
+	if !state.bannedUntil.IsZero() && now.Sub(state.bannedUntil) > this.maxBanTime {
+		state.bans = 0
+	}
+
+	banTime := this.baseBanTime << state.bans
+	if banTime > this.maxBanTime || banTime <= 0 {
+		banTime = this.maxBanTime
+	} else {
+		state.bans++
+	}
+
+	state.bannedUntil = now.Add(banTime)
+
+	ttl := int64(banTime / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	log.Printf("[WARN] Banning %s for %s: %s", host, banTime, reason)
+	if err := firewall.SetDeny(host, ttl, reason); err != nil {
+		log.Printf("[ERROR] Banning %s: %s", host, err)
+	}
+
+	return true
+}
+
+/**
+ * Forget states of clients behaving long enough
+ */
+func (this *BanPolicy) Expire(now time.Time) {
+	this.Lock()
+	defer this.Unlock()
+
+	for host, state := range this.states {
+		if now.Sub(state.bannedUntil) > this.maxBanTime {
+			delete(this.states, host)
+		}
+	}
+}
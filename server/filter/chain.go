@@ -0,0 +1,174 @@
+/**
+ * chain.go - order and options of server filters
+ */
+
+package filter
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/millken/tcpwder/config"
+)
+
+/**
+ * Chain order of filters if server has no filters list,
+ * cheap checks first. Other registered filters follow by name
+ */
+var defaultOrder = []string{
+	"acl",
+	"geo",
+	"limit_max_connection",
+	"limit_perip_connection",
+	"limit_reconnects_rate",
+	"limit_china_access",
+	"limit_perip_rate",
+	"filter_request_content",
+	"content",
+}
+
+/**
+ * Filter of the chain before initialization
+ */
+type chainEntry struct {
+	name    string
+	kind    string
+	options config.FilterOptions
+}
+
+/**
+ * Check if filter kind is registered
+ */
+func Registered(kind string) bool {
+	_, ok := filters[kind]
+	return ok
+}
+
+/**
+ * Check filters list, instances and their options
+ */
+func Validate(cfg config.Server) error {
+
+	entries, err := chainEntries(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		ff := filters[e.kind]()
+		if vf, ok := ff.(ValidatingFilter); ok {
+			if err := vf.Validate(e.options); err != nil {
+				return errors.New(e.name + ": " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Resolve filters of the server to ordered kinds and options
+ */
+func chainEntries(cfg config.Server) ([]chainEntry, error) {
+
+	names := cfg.Filters
+	if len(names) == 0 {
+		names = defaultNames(cfg)
+	}
+
+	for name, instance := range cfg.FilterInstances {
+		kind := instance.Kind
+		if kind == "" {
+			kind = name
+		}
+		if !Registered(kind) {
+			return nil, errors.New("Not supported filter kind " + kind + " of filter " + name)
+		}
+	}
+
+	result := []chainEntry{}
+	seen := make(map[string]bool)
+
+	for _, name := range names {
+
+		if seen[name] {
+			return nil, errors.New("Filter " + name + " is listed twice")
+		}
+		seen[name] = true
+
+		if instance, ok := cfg.FilterInstances[name]; ok {
+			if instance.Enabled != nil && !*instance.Enabled {
+				continue
+			}
+			kind := instance.Kind
+			if kind == "" {
+				kind = name
+			}
+			result = append(result, chainEntry{name, kind, instance.FilterOptions})
+			continue
+		}
+
+		if !Registered(name) {
+			return nil, errors.New("Unknown filter " + name)
+		}
+		result = append(result, chainEntry{name, name, serverOptions(cfg)})
+	}
+
+	return result, nil
+}
+
+/**
+ * Returns names of all registered filter kinds in default order,
+ * followed by names of filter instances
+ */
+func defaultNames(cfg config.Server) []string {
+
+	names := []string{}
+	seen := make(map[string]bool)
+
+	for _, kind := range defaultOrder {
+		if Registered(kind) {
+			names = append(names, kind)
+			seen[kind] = true
+		}
+	}
+
+	rest := []string{}
+	for kind := range filters {
+		if !seen[kind] {
+			rest = append(rest, kind)
+			seen[kind] = true
+		}
+	}
+	sort.Strings(rest)
+	names = append(names, rest...)
+
+	rest = []string{}
+	for name := range cfg.FilterInstances {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+
+	return append(names, rest...)
+}
+
+/**
+ * Returns filter options set on the server level
+ */
+func serverOptions(cfg config.Server) config.FilterOptions {
+	return config.FilterOptions{
+		MaxConnections:              cfg.MaxConnections,
+		PerIpConnections:            cfg.PerIpConnections,
+		Acl:                         cfg.Acl,
+		Geo:                         cfg.Geo,
+		LimitReconnectRate:          cfg.LimitReconnectRate,
+		LimitPeripRate:              cfg.LimitPeripRate,
+		LimitChinaAccessDefault:     cfg.LimitChinaAccessDefault,
+		LimitChinaAccess:            cfg.LimitChinaAccess,
+		FilterRequestContentDefault: cfg.FilterRequestContentDefault,
+		FilterRequestContent:        cfg.FilterRequestContent,
+		Content:                     cfg.Content,
+	}
+}
@@ -0,0 +1,190 @@
+/**
+ * connection.go - filters of the single client connection
+ */
+
+package filter
+
+import (
+	"log"
+	"sync"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+/**
+ * Filter instance with its registered name
+ */
+type namedFilter struct {
+	name   string
+	filter FilterInterface
+}
+
+/**
+ * Filters initialized from one configuration, shared
+ * by connections accepted while it was current
+ */
+type chain struct {
+	filters []namedFilter
+
+	/* Connections using chain, guarded by Filter mutex */
+	connections int
+
+	/* Chain was replaced and should be stopped once idle */
+	retired bool
+}
+
+/**
+ * Create chain of filters enabled by configuration,
+ * taking connections state over from previous chain if any
+ */
+func newChain(cfg config.Server, ban *BanPolicy, previous *chain) *chain {
+
+	result := &chain{}
+
+	entries, err := chainEntries(cfg)
+	if err != nil {
+		log.Printf("[ERROR] filters: %s", err)
+		return result
+	}
+
+	for _, e := range entries {
+		ff := filters[e.kind]().(FilterInterface)
+		if bf, ok := ff.(BanningFilter); ok {
+			bf.SetBanPolicy(ban)
+		}
+		if !ff.Init(e.options) {
+			if len(cfg.Filters) > 0 {
+				log.Printf("[WARN] Filter %s is not configured, skipping", e.name)
+			}
+			continue
+		}
+		if inf, ok := ff.(InheritingFilter); ok && previous != nil {
+			for _, pf := range previous.filters {
+				if pf.name == e.name {
+					inf.Inherit(pf.filter)
+				}
+			}
+		}
+		result.filters = append(result.filters, namedFilter{e.name, ff})
+	}
+
+	return result
+}
+
+/**
+ * Stop filters of the chain
+ */
+func (this *chain) stop() {
+	for _, f := range this.filters {
+		f.filter.Stop()
+	}
+}
+
+/**
+ * Client connection accepted by filters, passes its traffic
+ * through per connection filters. Safe for concurrent use
+ */
+type Connection struct {
+	sync.Mutex
+
+	filter *Filter
+	chain  *chain
+
+	/* Per connection filters, in chain order */
+	filters []ConnectionFilter
+
+	disconnected bool
+}
+
+/**
+ * Handle data chunk or datagram from client,
+ * error means it should not be proxied
+ */
+func (this *Connection) Request(buf []byte) error {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.disconnected {
+		return nil
+	}
+
+	for _, f := range this.filters {
+		if err := f.Request(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Handle data chunk or datagram from backend,
+ * error means it should not be proxied
+ */
+func (this *Connection) Response(buf []byte) error {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.disconnected {
+		return nil
+	}
+
+	for _, f := range this.filters {
+		if err := f.Response(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Handle bytes client read from backend
+ */
+func (this *Connection) Read(rwc core.ReadWriteCount) {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.disconnected {
+		return
+	}
+
+	for _, f := range this.filters {
+		f.Read(rwc)
+	}
+}
+
+/**
+ * Handle bytes client wrote to backend
+ */
+func (this *Connection) Write(rwc core.ReadWriteCount) {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.disconnected {
+		return
+	}
+
+	for _, f := range this.filters {
+		f.Write(rwc)
+	}
+}
+
+/**
+ * Handle connection end. Does nothing if already called
+ */
+func (this *Connection) Disconnect() {
+	this.Lock()
+	if this.disconnected {
+		this.Unlock()
+		return
+	}
+	this.disconnected = true
+	filters := this.filters
+	this.Unlock()
+
+	for _, f := range filters {
+		f.Disconnect()
+	}
+
+	this.filter.release(this.chain)
+}
@@ -0,0 +1,380 @@
+package filter
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+/* Default bytes of previous reads regexps are matched over */
+const DEFAULT_CONTENT_WINDOW = 4096
+
+/**
+ * Regexp rule
+ */
+type contentRegexp struct {
+	rule   int
+	regexp *regexp.Regexp
+}
+
+/**
+ * Compiled rules of one stream direction
+ */
+type contentInspector struct {
+
+	/* Literal, hex and list rules */
+	literals *ahoCorasick
+
+	/* Regexp rules, in rules order */
+	regexps []contentRegexp
+
+	/* Is rule allowing, by rule index */
+	allows []bool
+
+	/* Rules text for logs */
+	rules []string
+}
+
+/**
+ * Inspects client and backend streams with literal and regexp rules.
+ * Literals are matched by Aho-Corasick automaton continued across reads,
+ * regexps over the window of previous reads and the current one.
+ * Udp datagrams are inspected one by one
+ */
+type ContentFilter struct {
+	request  *contentInspector
+	response *contentInspector
+
+	limit  uint
+	window int
+}
+
+/**
+ * Inspection state of one stream of the connection
+ */
+type contentStream struct {
+	inspector *contentInspector
+
+	/* Automaton state after previous reads */
+	state int32
+
+	/* Tail of previous reads */
+	window []byte
+
+	/* Bytes inspected */
+	inspected uint
+
+	/* Inspection is over, allowed or limit reached */
+	done bool
+}
+
+/**
+ * Start inspection over, as if nothing was read
+ */
+func (this *contentStream) reset() {
+	this.state = 0
+	this.window = this.window[:0]
+	this.inspected = 0
+	this.done = false
+}
+
+/**
+ * Connection which streams are inspected by ContentFilter
+ */
+type contentConnection struct {
+	NopConnectionFilter
+	filter   *ContentFilter
+	client   net.Addr
+	request  *contentStream
+	response *contentStream
+
+	/* Every chunk is a separate datagram, not continuing previous ones */
+	datagrams bool
+}
+
+/**
+ * Build content filter from configuration
+ */
+func NewContent(cfg config.Content) (*ContentFilter, error) {
+
+	if cfg.Window < 0 {
+		return nil, errors.New("window should not be negative")
+	}
+
+	filter := &ContentFilter{
+		limit:  cfg.Limit,
+		window: cfg.Window,
+	}
+	if filter.window == 0 {
+		filter.window = DEFAULT_CONTENT_WINDOW
+	}
+
+	lists := map[string][][]byte{}
+
+	var err error
+	if filter.request, err = newContentInspector(cfg.Rules, cfg.Lists, lists); err != nil {
+		return nil, err
+	}
+	if filter.response, err = newContentInspector(cfg.ResponseRules, cfg.Lists, lists); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+/**
+ * Compile rules of one direction, loading lists not loaded yet
+ */
+func newContentInspector(rules []string, paths map[string]string, lists map[string][][]byte) (*contentInspector, error) {
+
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	inspector := &contentInspector{
+		literals: newAhoCorasick(),
+		rules:    rules,
+	}
+
+	for i, rule := range rules {
+
+		fields := strings.SplitN(rule, " ", 2)
+		if len(fields) != 2 || fields[1] == "" {
+			return nil, errors.New("Bad content rule '" + rule + "', expected 'allow|deny literal:<text>|hex:<bytes>|regexp:<expr>|@list'")
+		}
+
+		switch fields[0] {
+		case "allow":
+			inspector.allows = append(inspector.allows, true)
+		case "deny":
+			inspector.allows = append(inspector.allows, false)
+		default:
+			return nil, errors.New("Bad content rule action '" + fields[0] + "'")
+		}
+
+		match := fields[1]
+
+		if strings.HasPrefix(match, "@") {
+			name := match[1:]
+			list, ok := lists[name]
+			if !ok {
+				path, ok := paths[name]
+				if !ok {
+					return nil, errors.New("Unknown content list '" + name + "'")
+				}
+				var err error
+				if list, err = loadContentList(path); err != nil {
+					return nil, err
+				}
+				lists[name] = list
+			}
+			for _, literal := range list {
+				inspector.literals.Add(literal, i)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(match, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.New("Bad content rule match '" + match + "'")
+		}
+
+		switch parts[0] {
+		case "literal":
+			inspector.literals.Add([]byte(parts[1]), i)
+		case "hex":
+			literal, err := hex.DecodeString(parts[1])
+			if err != nil {
+				return nil, errors.New("Bad content rule hex '" + parts[1] + "'")
+			}
+			inspector.literals.Add(literal, i)
+		case "regexp":
+			re, err := regexp.Compile(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			inspector.regexps = append(inspector.regexps, contentRegexp{i, re})
+		default:
+			return nil, errors.New("Not supported content rule match '" + parts[0] + "'")
+		}
+	}
+
+	inspector.literals.Build()
+	return inspector, nil
+}
+
+/**
+ * Load list of literals per line, lines starting with # are comments
+ */
+func loadContentList(path string) ([][]byte, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var result [][]byte
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result = append(result, []byte(line))
+	}
+
+	return result, scanner.Err()
+}
+
+/**
+ * Inspect next chunk of the stream, returns error if it's denied
+ */
+func (this *ContentFilter) inspect(stream *contentStream, buf []byte) error {
+
+	if stream == nil || stream.done {
+		return nil
+	}
+
+	if this.limit > 0 {
+		if left := this.limit - stream.inspected; uint(len(buf)) > left {
+			buf = buf[:left]
+		}
+	}
+	stream.inspected += uint(len(buf))
+
+	inspector := stream.inspector
+
+	// literals, automaton state continues previous reads
+	var rule int
+	stream.state, rule = inspector.literals.Match(stream.state, buf)
+
+	// regexps, over window of previous reads
+	if len(inspector.regexps) > 0 {
+		data := append(stream.window, buf...)
+		for _, r := range inspector.regexps {
+			if rule >= 0 && r.rule > rule {
+				break
+			}
+			if r.regexp.Match(data) {
+				rule = r.rule
+				break
+			}
+		}
+		if len(data) > this.window {
+			data = data[len(data)-this.window:]
+		}
+		stream.window = append(stream.window[:0], data...)
+	}
+
+	if this.limit > 0 && stream.inspected >= this.limit {
+		stream.done = true
+	}
+
+	if rule < 0 {
+		return nil
+	}
+
+	if inspector.allows[rule] {
+		stream.done = true
+		stream.window = nil
+		return nil
+	}
+
+	return errors.New("content denied by rule '" + inspector.rules[rule] + "'")
+}
+
+func (this *ContentFilter) Validate(cfg config.FilterOptions) error {
+	if cfg.Content == nil {
+		return nil
+	}
+	_, err := NewContent(*cfg.Content)
+	return err
+}
+
+func (this *ContentFilter) Init(cfg config.FilterOptions) bool {
+	if cfg.Content == nil {
+		return false
+	}
+
+	filter, err := NewContent(*cfg.Content)
+	if err != nil {
+		log.Printf("[ERROR] content: %s", err)
+		return false
+	}
+
+	*this = *filter
+	return true
+}
+
+func (this *ContentFilter) newStream(inspector *contentInspector) *contentStream {
+	if inspector == nil {
+		return nil
+	}
+	return &contentStream{inspector: inspector}
+}
+
+func (this *ContentFilter) Connect(client net.Addr) (ConnectionFilter, error) {
+	return &contentConnection{
+		filter:   this,
+		client:   client,
+		request:  this.newStream(this.request),
+		response: this.newStream(this.response),
+	}, nil
+}
+
+/**
+ * Connect client, inspecting datagrams of udp one separately
+ */
+func (this *ContentFilter) ConnectContext(ctx core.Context) (ConnectionFilter, error) {
+	cf, _ := this.Connect(ctx.Addr())
+	if _, ok := ctx.(*core.UdpContext); ok {
+		cf.(*contentConnection).datagrams = true
+	}
+	return cf, nil
+}
+
+/**
+ * Reset stream before the next datagram
+ */
+func (this *contentConnection) next(stream *contentStream) {
+	if this.datagrams && stream != nil {
+		stream.reset()
+	}
+}
+
+func (this *contentConnection) Request(buf []byte) error {
+	this.next(this.request)
+	if err := this.filter.inspect(this.request, buf); err != nil {
+		log.Printf("[WARN] content: request of %s %s", this.client, err)
+		return err
+	}
+	return nil
+}
+
+func (this *contentConnection) Response(buf []byte) error {
+	this.next(this.response)
+	if err := this.filter.inspect(this.response, buf); err != nil {
+		log.Printf("[WARN] content: response to %s %s", this.client, err)
+		return err
+	}
+	return nil
+}
+
+func (this *ContentFilter) Stop() {
+}
+
+func init() {
+	RegisterFilter("content", func() interface{} {
+		return new(ContentFilter)
+	})
+}
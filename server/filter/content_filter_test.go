@@ -0,0 +1,182 @@
+package filter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+/**
+ * Connect tcp client to content filter of configuration
+ */
+func contentConnect(t *testing.T, cfg config.Content) *contentConnection {
+
+	filter, err := NewContent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cf, err := filter.Connect(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cf.(*contentConnection)
+}
+
+/**
+ * Feed chunks as requests, returns index of the first denied one, -1 if none
+ */
+func deniedChunk(conn *contentConnection, chunks ...string) int {
+	for i, chunk := range chunks {
+		if err := conn.Request([]byte(chunk)); err != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestContentSplitAcrossReads(t *testing.T) {
+
+	cases := []struct {
+		rule   string
+		chunks []string
+		denied int
+	}{
+		{"deny literal:evil", []string{"ev", "il"}, 1},
+		{"deny literal:evil", []string{"e", "v", "i", "l"}, 3},
+		{"deny hex:00ff00", []string{"a\x00", "\xff", "\x00b"}, 2},
+		{"deny regexp:ab+c", []string{"xa", "bb", "bc"}, 2},
+		{"deny literal:evil", []string{"ev", "xil"}, -1},
+	}
+
+	for _, c := range cases {
+		conn := contentConnect(t, config.Content{Rules: []string{c.rule}})
+		if denied := deniedChunk(conn, c.chunks...); denied != c.denied {
+			t.Errorf("%s %q: expected chunk %d denied, got %d", c.rule, c.chunks, c.denied, denied)
+		}
+	}
+}
+
+func TestContentWindowTrimmed(t *testing.T) {
+
+	conn := contentConnect(t, config.Content{
+		Rules:  []string{"deny regexp:a.*z"},
+		Window: 4,
+	})
+
+	if denied := deniedChunk(conn, "a", "0123456789", "z"); denied != -1 {
+		t.Fatalf("Expected match beyond window not to be found, got chunk %d denied", denied)
+	}
+	if len(conn.request.window) != 4 {
+		t.Fatalf("Expected window of 4 bytes, got %q", conn.request.window)
+	}
+	if string(conn.request.window) != "789z" {
+		t.Fatalf("Expected window to keep the tail, got %q", conn.request.window)
+	}
+
+	if denied := deniedChunk(conn, "a", "z"); denied != 1 {
+		t.Fatalf("Expected match within window to be found, got %d", denied)
+	}
+}
+
+func TestContentRulePrecedence(t *testing.T) {
+
+	cases := []struct {
+		rules  []string
+		chunks []string
+		denied int
+	}{
+		// first matching rule wins, allow ends inspection
+		{[]string{"allow literal:GET /public", "deny literal:GET"}, []string{"GET /public", "GET /private"}, -1},
+		{[]string{"allow literal:GET /public", "deny literal:GET"}, []string{"GET /private"}, 0},
+		// literals and regexps are ordered together
+		{[]string{"deny regexp:sec.et", "allow literal:secret"}, []string{"secret"}, 0},
+		{[]string{"allow regexp:sec.et", "deny literal:secret"}, []string{"secret", "evil secret"}, -1},
+		{[]string{"deny literal:x", "allow regexp:x"}, []string{"x"}, 0},
+		// regexp later than matched literal is not applied
+		{[]string{"allow literal:ok", "deny regexp:o"}, []string{"ok"}, -1},
+	}
+
+	for _, c := range cases {
+		conn := contentConnect(t, config.Content{Rules: c.rules})
+		if denied := deniedChunk(conn, c.chunks...); denied != c.denied {
+			t.Errorf("%v %q: expected chunk %d denied, got %d", c.rules, c.chunks, c.denied, denied)
+		}
+	}
+}
+
+func TestContentLimit(t *testing.T) {
+
+	conn := contentConnect(t, config.Content{
+		Rules: []string{"deny literal:evil"},
+		Limit: 6,
+	})
+
+	if denied := deniedChunk(conn, "1234ev", "il"); denied != -1 {
+		t.Fatalf("Expected content after limit not to be inspected, got chunk %d denied", denied)
+	}
+}
+
+func TestContentResponse(t *testing.T) {
+
+	conn := contentConnect(t, config.Content{
+		Rules:         []string{"deny literal:evil"},
+		ResponseRules: []string{"deny literal:secret"},
+	})
+
+	if err := conn.Request([]byte("secret")); err != nil {
+		t.Fatalf("Expected response rule not to apply to request: %s", err)
+	}
+	if err := conn.Response([]byte("evil")); err != nil {
+		t.Fatalf("Expected request rule not to apply to response: %s", err)
+	}
+	if err := conn.Response([]byte("secret")); err == nil {
+		t.Fatal("Expected response to be denied")
+	}
+}
+
+func TestContentDatagrams(t *testing.T) {
+
+	filter, err := NewContent(config.Content{
+		Rules: []string{"deny literal:evil", "deny regexp:a.*z"},
+		Limit: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cf, err := filter.ConnectContext(&core.UdpContext{
+		RemoteAddr: net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := cf.(*contentConnection)
+
+	// matches do not span datagrams, limit applies to each one
+	if denied := deniedChunk(conn, "ev", "il", "a", "z", "12345678"); denied != -1 {
+		t.Fatalf("Expected match across datagrams not to be found, got %d", denied)
+	}
+	if denied := deniedChunk(conn, "evil"); denied != 0 {
+		t.Fatal("Expected datagram after limit of previous one to be inspected")
+	}
+}
+
+func TestContentBadRules(t *testing.T) {
+
+	for _, rules := range [][]string{
+		{"deny"},
+		{"block literal:x"},
+		{"deny literal:"},
+		{"deny hex:zz"},
+		{"deny regexp:("},
+		{"deny glob:x"},
+		{"deny @missing"},
+	} {
+		if _, err := NewContent(config.Content{Rules: rules}); err == nil {
+			t.Errorf("Expected %v to be rejected", rules)
+		}
+	}
+}
@@ -8,16 +8,23 @@ import (
 	"strings"
 
 	"github.com/millken/tcpwder/config"
-	"github.com/millken/tcpwder/core"
 )
 
 type FilterRequestContent struct {
 	frc           []config.FilterRequestContent
 	defaultAccess bool
-	client        net.Conn
 }
 
-func (this *FilterRequestContent) Init(cfg config.Server) bool {
+/**
+ * Connection which requests are checked by FilterRequestContent
+ */
+type filterRequestContentConnection struct {
+	NopConnectionFilter
+	filter *FilterRequestContent
+	client net.Addr
+}
+
+func (this *FilterRequestContent) Init(cfg config.FilterOptions) bool {
 	if len(cfg.FilterRequestContent) != 0 {
 		this.frc = cfg.FilterRequestContent
 		this.defaultAccess = cfg.FilterRequestContentDefault == "deny"
@@ -27,21 +34,15 @@ func (this *FilterRequestContent) Init(cfg config.Server) bool {
 	return false
 }
 
-func (this *FilterRequestContent) Connect(client net.Conn) error {
-	this.client = client
-	return nil
-}
-
-func (this *FilterRequestContent) Disconnect(client net.Conn) {
-}
-
-func (this *FilterRequestContent) Read(client net.Conn, rwc core.ReadWriteCount) {
+func (this *FilterRequestContent) Connect(client net.Addr) (ConnectionFilter, error) {
+	return &filterRequestContentConnection{filter: this, client: client}, nil
 }
 
-func (this *FilterRequestContent) Write(client net.Conn, rwc core.ReadWriteCount) {
+func (this *filterRequestContentConnection) Request(buf []byte) error {
+	return this.filter.Request(this.client, buf)
 }
 
-func (this *FilterRequestContent) Request(buf []byte) error {
+func (this *FilterRequestContent) Request(client net.Addr, buf []byte) error {
 	if len(bytes.TrimSpace(buf)) == 0 {
 		return nil
 	}
@@ -63,7 +64,7 @@ func (this *FilterRequestContent) Request(buf []byte) error {
 			case "allow":
 				return nil
 			case "deny":
-				return fmt.Errorf("deny by FilterRequestContent %s:%s", this.client.RemoteAddr().String(), r.Content)
+				return fmt.Errorf("deny by FilterRequestContent %s:%s", client.String(), r.Content)
 			}
 		}
 	}
@@ -0,0 +1,338 @@
+package filter
+
+import (
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+/**
+ * Server configuring every registered filter kind. Clients of 10.0.1.0/24
+ * are rejected by acl, chunks with "evil" and "secret" by content filters
+ */
+func stressConfig() config.Server {
+
+	maxConnections := 1000
+	perIpConnections := uint(50)
+
+	return config.Server{
+		MaxConnections:   &maxConnections,
+		PerIpConnections: &perIpConnections,
+		Acl: &config.Acl{
+			Rules: []string{"deny 10.0.1.0/24"},
+		},
+		BanPolicy: &config.BanPolicy{
+			Mode: BAN_MODE_REJECT,
+		},
+		LimitReconnectRate: &config.LimitReconnectRate{
+			Interval:   "1s",
+			Reconnects: 1000000,
+		},
+		LimitPeripRate: &config.LimitPeripRate{
+			Interval:   "1s",
+			ReadBytes:  1 << 30,
+			WriteBytes: 1 << 30,
+		},
+		// private clients are not looked up in china ip database
+		LimitChinaAccess: []config.LimitChinaAccess{
+			{Area: "nowhere", Access: "deny"},
+		},
+		FilterRequestContent: []config.FilterRequestContent{
+			{Content: "evil", Access: "deny"},
+		},
+		Content: &config.Content{
+			Rules:         []string{"deny literal:evil"},
+			ResponseRules: []string{"deny literal:secret"},
+		},
+	}
+}
+
+/**
+ * Filters needing external databases, created directly
+ */
+var stressInstances = map[string]func() FilterInterface{
+	"geo": func() FilterInterface {
+		return &GeoFilter{
+			rules:        []geoRule{{allow: false, kind: "country", value: "DE"}},
+			allowDefault: true,
+		}
+	},
+}
+
+/**
+ * Create started filter with every registered kind in its chain
+ */
+func newStressFilter(t *testing.T) *Filter {
+
+	f := New(stressConfig())
+	f.Start()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for name, create := range stressInstances {
+		f.current.filters = append(f.current.filters, namedFilter{name, create()})
+	}
+
+	present := make(map[string]bool)
+	for _, nf := range f.current.filters {
+		present[nf.name] = true
+	}
+	for kind := range filters {
+		if !present[kind] {
+			t.Fatalf("Filter %s is not covered by stress test configuration", kind)
+		}
+	}
+
+	return f
+}
+
+func TestFiltersConcurrentUse(t *testing.T) {
+
+	f := newStressFilter(t)
+
+	initial := f.current
+
+	payloads := [][]byte{
+		[]byte("GET / HTTP/1.1\r\n"),
+		[]byte("some evil payload"),
+		[]byte("secret"),
+		make([]byte, 1024),
+	}
+
+	stop := make(chan bool)
+	var reloads sync.WaitGroup
+	reloads.Add(1)
+	go func() {
+		defer reloads.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				f.Reload(stressConfig())
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 32; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			rnd := rand.New(rand.NewSource(int64(w)))
+
+			for i := 0; i < 200; i++ {
+
+				ctx := &core.UdpContext{
+					RemoteAddr: net.UDPAddr{
+						IP:   net.ParseIP("10.0." + strconv.Itoa(rnd.Intn(3)) + "." + strconv.Itoa(rnd.Intn(8))),
+						Port: 1024 + i,
+					},
+				}
+
+				conn, err := f.HandleClientConnect(ctx)
+				if err != nil {
+					continue
+				}
+
+				// traffic of both directions from separate goroutines
+				var traffic sync.WaitGroup
+				traffic.Add(2)
+				go func(seed int64) {
+					defer traffic.Done()
+					rnd := rand.New(rand.NewSource(seed))
+					for j := 0; j < 5; j++ {
+						buf := payloads[rnd.Intn(len(payloads))]
+						conn.Request(buf)
+						conn.Write(core.ReadWriteCount{CountRead: uint(len(buf)), CountWrite: uint(len(buf))})
+					}
+				}(rnd.Int63())
+				go func(seed int64) {
+					defer traffic.Done()
+					rnd := rand.New(rand.NewSource(seed))
+					for j := 0; j < 5; j++ {
+						buf := payloads[rnd.Intn(len(payloads))]
+						conn.Response(buf)
+						conn.Read(core.ReadWriteCount{CountRead: uint(len(buf)), CountWrite: uint(len(buf))})
+					}
+				}(rnd.Int63())
+				traffic.Wait()
+
+				// disconnect is idempotent, even if racing
+				var disconnects sync.WaitGroup
+				disconnects.Add(2)
+				for j := 0; j < 2; j++ {
+					go func() {
+						defer disconnects.Done()
+						conn.Disconnect()
+					}()
+				}
+				disconnects.Wait()
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(stop)
+	reloads.Wait()
+
+	// all connections are gone, counters are back to zero
+	f.mutex.Lock()
+	if initial.connections != 0 || f.current.connections != 0 {
+		t.Errorf("Connections left %d %d", initial.connections, f.current.connections)
+	}
+	f.mutex.Unlock()
+
+	for _, nf := range initial.filters {
+		switch ff := nf.filter.(type) {
+		case *LimitMaxConnectionFilter:
+			if ff.active.count != 0 {
+				t.Errorf("limit_max_connection has %d connections left", ff.active.count)
+			}
+		case *LimitPerIPConnectionFilter:
+			if len(ff.active.clients) != 0 {
+				t.Errorf("limit_perip_connection has %d clients left", len(ff.active.clients))
+			}
+		}
+	}
+
+	f.Stop()
+}
+
+func TestFilterRejects(t *testing.T) {
+
+	f := newStressFilter(t)
+	defer f.Stop()
+
+	connect := func(ip string) (*Connection, error) {
+		return f.HandleClientConnect(&core.UdpContext{
+			RemoteAddr: net.UDPAddr{IP: net.ParseIP(ip), Port: 1},
+		})
+	}
+
+	if _, err := connect("10.0.1.1"); err == nil {
+		t.Error("Client denied by acl accepted")
+	}
+
+	conn, err := connect("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+
+	if err := conn.Request([]byte("hello")); err != nil {
+		t.Errorf("Request denied: %s", err)
+	}
+	if err := conn.Request([]byte("evil")); err == nil {
+		t.Error("Request with denied content accepted")
+	}
+	if err := conn.Response([]byte("secret")); err == nil {
+		t.Error("Response with denied content accepted")
+	}
+}
+
+func TestReloadKeepsConnectionCounts(t *testing.T) {
+
+	maxConnections := 2
+	perIpConnections := uint(1)
+	cfg := config.Server{
+		MaxConnections:   &maxConnections,
+		PerIpConnections: &perIpConnections,
+		BanPolicy:        &config.BanPolicy{Mode: BAN_MODE_REJECT},
+	}
+
+	f := New(cfg)
+	f.Start()
+	defer f.Stop()
+
+	connect := func(ip string) (*Connection, error) {
+		return f.HandleClientConnect(&core.UdpContext{
+			RemoteAddr: net.UDPAddr{IP: net.ParseIP(ip), Port: 1},
+		})
+	}
+
+	a, err := connect("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connect("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Reload(cfg)
+
+	if _, err := connect("10.0.0.1"); err == nil {
+		t.Error("Per ip connections exceeded after reload")
+	}
+	if _, err := connect("10.0.0.3"); err == nil {
+		t.Error("Max connections exceeded after reload")
+	}
+
+	// connection of old chain releases new chain counters
+	a.Disconnect()
+	if _, err := connect("10.0.0.1"); err != nil {
+		t.Errorf("Connection rejected after disconnect: %s", err)
+	}
+}
+
+func TestRateOffenceOncePerInterval(t *testing.T) {
+
+	f := &LimitPeripRateFilter{}
+	f.Init(config.FilterOptions{LimitPeripRate: &config.LimitPeripRate{
+		Interval:   "1h",
+		ReadBytes:  10,
+		WriteBytes: 10,
+	}})
+	defer f.Stop()
+
+	offences := 0
+	for i := 0; i < 5; i++ {
+		if f.count("10.0.0.1", core.ReadWriteCount{CountRead: 5, CountWrite: 5}) {
+			offences++
+		}
+	}
+	if offences != 1 {
+		t.Errorf("Expected one offence per interval, got %d", offences)
+	}
+
+	if f.count("10.0.0.2", core.ReadWriteCount{CountRead: 5}) {
+		t.Error("Client under limit offended")
+	}
+}
+
+func TestAllowlistedOffenceIgnored(t *testing.T) {
+
+	for _, mode := range []string{BAN_MODE_BAN, BAN_MODE_REJECT, BAN_MODE_DRYRUN} {
+
+		policy, err := NewBanPolicy(&config.BanPolicy{
+			Mode:      mode,
+			Allowlist: []string{"10.0.0.0/8"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if policy.HandleOffence("10.0.0.1", "test") {
+			t.Errorf("Allowlisted client rejected in %s mode", mode)
+		}
+		if len(policy.states) != 0 {
+			t.Errorf("Offence of allowlisted client recorded in %s mode", mode)
+		}
+	}
+}
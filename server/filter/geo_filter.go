@@ -0,0 +1,244 @@
+package filter
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/utils"
+	"github.com/oschwald/geoip2-golang"
+)
+
+/**
+ * Single geo rule
+ */
+type geoRule struct {
+	allow bool
+
+	/* country | continent | asn */
+	kind string
+
+	/* Upper cased code or asn number */
+	value string
+}
+
+/**
+ * Allow / deny by country, continent or asn from MaxMind databases,
+ * first matching rule wins
+ */
+type GeoFilter struct {
+	country *geoip2.Reader
+	asn     *geoip2.Reader
+
+	rules []geoRule
+
+	/* Allow if no rule matches */
+	allowDefault bool
+}
+
+/**
+ * Build geo filter from configuration, loading databases
+ */
+func NewGeo(cfg config.Geo) (*GeoFilter, error) {
+
+	geo := &GeoFilter{}
+
+	switch cfg.Default {
+	case "", "allow":
+		geo.allowDefault = true
+	case "deny":
+	default:
+		return nil, errors.New("Not supported geo default " + cfg.Default)
+	}
+
+	if cfg.CountryDb == "" && cfg.AsnDb == "" {
+		return nil, errors.New("country_db or asn_db should be set")
+	}
+
+	var err error
+
+	if cfg.CountryDb != "" {
+		if geo.country, err = utils.LoadGeoDB(cfg.CountryDb); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.AsnDb != "" {
+		if geo.asn, err = utils.LoadGeoDB(cfg.AsnDb); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, rule := range cfg.Rules {
+
+		fields := strings.Fields(rule)
+		if len(fields) != 2 {
+			return nil, errors.New("Bad geo rule '" + rule + "', expected 'allow|deny country:<code>|continent:<code>|asn:<number>'")
+		}
+
+		r := geoRule{}
+
+		switch fields[0] {
+		case "allow":
+			r.allow = true
+		case "deny":
+		default:
+			return nil, errors.New("Bad geo rule action '" + fields[0] + "'")
+		}
+
+		parts := strings.SplitN(fields[1], ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.New("Bad geo rule match '" + fields[1] + "'")
+		}
+		r.kind, r.value = parts[0], strings.ToUpper(parts[1])
+
+		switch r.kind {
+		case "country", "continent":
+			if geo.country == nil {
+				return nil, errors.New("Geo rule '" + rule + "' requires country_db")
+			}
+		case "asn":
+			if geo.asn == nil {
+				return nil, errors.New("Geo rule '" + rule + "' requires asn_db")
+			}
+			if _, err := strconv.ParseUint(strings.TrimPrefix(r.value, "AS"), 10, 32); err != nil {
+				return nil, errors.New("Bad geo rule asn '" + parts[1] + "'")
+			}
+			r.value = strings.TrimPrefix(r.value, "AS")
+		default:
+			return nil, errors.New("Not supported geo rule match '" + r.kind + "'")
+		}
+
+		geo.rules = append(geo.rules, r)
+	}
+
+	return geo, nil
+}
+
+/**
+ * Lookup geo location of ip, fields are empty if not found
+ */
+func (this *GeoFilter) Lookup(ip net.IP) *core.Geo {
+
+	result := &core.Geo{}
+
+	if this.country != nil {
+		if record, err := this.country.Country(ip); err == nil {
+			result.Country = record.Country.IsoCode
+			result.Continent = record.Continent.Code
+		}
+	}
+
+	if this.asn != nil {
+		if record, err := this.asn.ASN(ip); err == nil {
+			result.ASN = record.AutonomousSystemNumber
+			result.Organization = record.AutonomousSystemOrganization
+		}
+	}
+
+	return result
+}
+
+/**
+ * Check if geo location is allowed
+ */
+func (this *GeoFilter) Allows(geo *core.Geo) bool {
+
+	asn := strconv.FormatUint(uint64(geo.ASN), 10)
+
+	for _, r := range this.rules {
+		var match bool
+		switch r.kind {
+		case "country":
+			match = r.value == geo.Country
+		case "continent":
+			match = r.value == geo.Continent
+		case "asn":
+			match = geo.ASN != 0 && r.value == asn
+		}
+		if match {
+			return r.allow
+		}
+	}
+
+	return this.allowDefault
+}
+
+func (this *GeoFilter) Validate(cfg config.FilterOptions) error {
+	if cfg.Geo == nil {
+		return nil
+	}
+	_, err := NewGeo(*cfg.Geo)
+	return err
+}
+
+func (this *GeoFilter) Init(cfg config.FilterOptions) bool {
+	if cfg.Geo == nil {
+		return false
+	}
+
+	geo, err := NewGeo(*cfg.Geo)
+	if err != nil {
+		log.Printf("[ERROR] geo: %s", err)
+		return false
+	}
+
+	*this = *geo
+	return true
+}
+
+/**
+ * Lookup client geo location and check if it's allowed
+ */
+func (this *GeoFilter) check(client net.Addr) (*core.Geo, error) {
+	host, _, _ := net.SplitHostPort(client.String())
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, RejectError("geo denied " + host)
+	}
+
+	geo := this.Lookup(ip)
+	if !this.Allows(geo) {
+		return geo, RejectError("geo denied " + host + " " + geo.String())
+	}
+	return geo, nil
+}
+
+/**
+ * Check client geo location and tag it to the context
+ */
+func (this *GeoFilter) ConnectContext(ctx core.Context) (ConnectionFilter, error) {
+	geo, err := this.check(ctx.Addr())
+
+	switch c := ctx.(type) {
+	case *core.TcpContext:
+		c.Geo = geo
+	case *core.UdpContext:
+		c.Geo = geo
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return NopConnectionFilter{}, nil
+}
+
+func (this *GeoFilter) Connect(client net.Addr) (ConnectionFilter, error) {
+	if _, err := this.check(client); err != nil {
+		return nil, err
+	}
+	return NopConnectionFilter{}, nil
+}
+
+func (this *GeoFilter) Stop() {
+}
+
+func init() {
+	RegisterFilter("geo", func() interface{} {
+		return new(GeoFilter)
+	})
+}
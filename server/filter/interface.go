@@ -3,28 +3,112 @@ package filter
 import (
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/millken/tcpwder/config"
 	"github.com/millken/tcpwder/core"
-	"github.com/millken/tcpwder/firewall"
 )
 
+/**
+ * Filter of tcp connections and udp sessions, identified by client address.
+ * Filter instance is shared by all connections, so its state should be
+ * safe for concurrent use. Connect returns part of the filter keeping
+ * state of the single connection
+ */
 type FilterInterface interface {
-	Init(cf config.Server) bool
-	Connect(client net.Conn) error
-	Read(client net.Conn, rwc core.ReadWriteCount)
-	Write(client net.Conn, rwc core.ReadWriteCount)
-	Request([]byte) error
-	Disconnect(client net.Conn)
+	Init(cfg config.FilterOptions) bool
+	Connect(client net.Addr) (ConnectionFilter, error)
 	Stop()
 }
 
+/**
+ * Per connection part of the filter. Request and Response are called with
+ * data chunks or datagrams from client and from backend, Read and Write with
+ * counts of bytes client read from backend and wrote to backend, Disconnect
+ * once connection or session ends.
+ * Methods of the single connection are never called concurrently
+ */
+type ConnectionFilter interface {
+	Read(rwc core.ReadWriteCount)
+	Write(rwc core.ReadWriteCount)
+	Request(buf []byte) error
+	Response(buf []byte) error
+	Disconnect()
+}
+
+/**
+ * Connection filter of filters keeping no per connection state
+ */
+type NopConnectionFilter struct{}
+
+func (NopConnectionFilter) Read(rwc core.ReadWriteCount) {
+}
+
+func (NopConnectionFilter) Write(rwc core.ReadWriteCount) {
+}
+
+func (NopConnectionFilter) Request(buf []byte) error {
+	return nil
+}
+
+func (NopConnectionFilter) Response(buf []byte) error {
+	return nil
+}
+
+func (NopConnectionFilter) Disconnect() {
+}
+
+/**
+ * Filter which needs connection context on connect, to tag it
+ * with data of the client. Used instead of Connect if implemented
+ */
+type ContextFilter interface {
+	ConnectContext(ctx core.Context) (ConnectionFilter, error)
+}
+
+/**
+ * Filter checking its options when configuration is loaded
+ */
+type ValidatingFilter interface {
+	Validate(cfg config.FilterOptions) error
+}
+
+/**
+ * Filter keeping state of active connections, which it takes over
+ * from filter of the same name in previous chain on reload
+ */
+type InheritingFilter interface {
+	Inherit(previous FilterInterface)
+}
+
+/**
+ * Filter handling client offences by itself, not only by rejecting connect
+ */
+type BanningFilter interface {
+	SetBanPolicy(policy *BanPolicy)
+}
+
 var filters = make(map[string]func() interface{})
 
+/**
+ * Error of filter rejecting connection without banning client in firewall
+ */
+type RejectError string
+
+func (this RejectError) Error() string {
+	return string(this)
+}
+
 type Filter struct {
-	cfg     config.Server
-	filters map[string]FilterInterface
-	stop    chan bool
+	cfg config.Server
+	ban *BanPolicy
+
+	/* Chain new connections are filtered by */
+	current *chain
+	mutex   sync.Mutex
+
+	stop chan bool
 }
 
 func RegisterFilter(name string, filter func() interface{}) {
@@ -40,25 +124,34 @@ func RegisterFilter(name string, filter func() interface{}) {
 }
 
 func New(cfg config.Server) *Filter {
+	ban, err := NewBanPolicy(cfg.BanPolicy)
+	if err != nil {
+		log.Printf("[ERROR] ban policy: %s, using default", err)
+		ban, _ = NewBanPolicy(nil)
+	}
+
 	return &Filter{
 		cfg:     cfg,
-		filters: make(map[string]FilterInterface),
+		ban:     ban,
+		current: &chain{},
 	}
 }
 
 func (this *Filter) Start() {
 	log.Printf("[INFO] Starting filter")
 	this.stop = make(chan bool)
-	for name, filter := range filters {
-		ff := filter().(FilterInterface)
-		if ff.Init(this.cfg) {
-			this.filters[name] = ff
-		}
-	}
+	this.mutex.Lock()
+	this.current = newChain(this.cfg, this.ban, nil)
+	this.mutex.Unlock()
 	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
 		for {
 			select {
 
+			case now := <-ticker.C:
+				this.ban.Expire(now)
+
 			case <-this.stop:
 				log.Printf("Stopping filter")
 				return
@@ -67,47 +160,101 @@ func (this *Filter) Start() {
 	}()
 }
 
+/**
+ * Replace filters with ones initialized from new configuration.
+ * Active connections keep old filters, which are stopped once
+ * the last of them disconnects
+ */
+func (this *Filter) Reload(cfg config.Server) {
+	log.Printf("[INFO] Reloading filter")
+	this.cfg = cfg
+	this.ban.Reload(cfg.BanPolicy)
+
+	this.mutex.Lock()
+	previous := this.current
+	this.mutex.Unlock()
+
+	this.retire(newChain(cfg, this.ban, previous))
+}
+
 func (this *Filter) Stop() {
-	for _, filter := range this.filters {
-		filter.Stop()
-	}
+	this.retire(&chain{})
 	this.stop <- true
 }
 
-func (this *Filter) HandleClientConnect(client net.Conn) error {
-	for _, filter := range this.filters {
-		if err := filter.Connect(client); err != nil {
-			host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
-			firewall.SetDeny(host, 3600)
-			return err
-		}
-	}
-	return nil
-}
+/**
+ * Replace current chain, stopping old one if it has no connections
+ */
+func (this *Filter) retire(next *chain) {
+	this.mutex.Lock()
+	old := this.current
+	this.current = next
+	old.retired = true
+	idle := old.connections == 0
+	this.mutex.Unlock()
 
-func (this *Filter) HandleClientDisconnect(client net.Conn) {
-	for _, filter := range this.filters {
-		filter.Disconnect(client)
+	if idle {
+		old.stop()
 	}
 }
 
-func (this *Filter) HandleClientWrite(client net.Conn, rwc core.ReadWriteCount) {
-	for _, filter := range this.filters {
-		filter.Write(client, rwc)
+/**
+ * Release chain of disconnected connection, stopping it if
+ * it's retired and has no connections left
+ */
+func (this *Filter) release(c *chain) {
+	this.mutex.Lock()
+	c.connections--
+	idle := c.retired && c.connections == 0
+	this.mutex.Unlock()
+
+	if idle {
+		c.stop()
 	}
 }
 
-func (this *Filter) HandleClientRead(client net.Conn, rwc core.ReadWriteCount) {
-	for _, filter := range this.filters {
-		filter.Read(client, rwc)
+/**
+ * Run connect filters on new client, returning connection to pass
+ * its traffic through filters
+ */
+func (this *Filter) HandleClientConnect(ctx core.Context) (*Connection, error) {
+
+	this.mutex.Lock()
+	c := this.current
+	c.connections++
+	this.mutex.Unlock()
+
+	conn := &Connection{
+		filter: this,
+		chain:  c,
 	}
-}
 
-func (this *Filter) HandleClientRequest(buf []byte) error {
-	for _, filter := range this.filters {
-		if err := filter.Request(buf); err != nil {
-			return err
+	client := ctx.Addr()
+	for _, f := range c.filters {
+
+		var cf ConnectionFilter
+		var err error
+		if ff, ok := f.filter.(ContextFilter); ok {
+			cf, err = ff.ConnectContext(ctx)
+		} else {
+			cf, err = f.filter.Connect(client)
+		}
+
+		if err == nil {
+			conn.filters = append(conn.filters, cf)
+			continue
 		}
+
+		if _, ok := err.(RejectError); !ok {
+			host, _, _ := net.SplitHostPort(client.String())
+			if !this.ban.HandleOffence(host, f.name+": "+err.Error()) {
+				continue
+			}
+		}
+
+		conn.Disconnect()
+		return nil, err
 	}
-	return nil
+
+	return conn, nil
 }
@@ -6,7 +6,6 @@ import (
 	"strings"
 
 	"github.com/millken/tcpwder/config"
-	"github.com/millken/tcpwder/core"
 	"github.com/millken/tcpwder/utils"
 )
 
@@ -15,7 +14,7 @@ type LimitChinaAccessFilter struct {
 	lcad bool
 }
 
-func (this *LimitChinaAccessFilter) Init(cfg config.Server) bool {
+func (this *LimitChinaAccessFilter) Init(cfg config.FilterOptions) bool {
 	if len(cfg.LimitChinaAccess) != 0 {
 		this.lca = cfg.LimitChinaAccess
 		this.lcad = cfg.LimitChinaAccessDefault == "deny"
@@ -24,11 +23,11 @@ func (this *LimitChinaAccessFilter) Init(cfg config.Server) bool {
 	return false
 }
 
-func (this *LimitChinaAccessFilter) Connect(client net.Conn) error {
-	host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+func (this *LimitChinaAccessFilter) Connect(client net.Addr) (ConnectionFilter, error) {
+	host, _, _ := net.SplitHostPort(client.String())
 	isPrivate, _ := utils.PrivateIP(host)
 	if isPrivate {
-		return nil
+		return NopConnectionFilter{}, nil
 	}
 	ip := net.ParseIP(host)
 	cn, err := utils.FindCN(ip)
@@ -40,7 +39,7 @@ func (this *LimitChinaAccessFilter) Connect(client net.Conn) error {
 		countSplit := strings.Count(fmt.Sprintf("%s%s%s", r.Area, r.Region, r.Isp), "-")
 		if err != nil {
 			if countSplit == 0 && r.Access == "deny" {
-				return fmt.Errorf("deny outsite of china")
+				return nil, fmt.Errorf("deny outsite of china")
 			}
 		} else {
 			if countSplit < hitSplit {
@@ -66,25 +65,12 @@ func (this *LimitChinaAccessFilter) Connect(client net.Conn) error {
 		}
 	}
 	if allow {
-		return nil
+		return NopConnectionFilter{}, nil
 	}
 	if this.lcad {
-		return fmt.Errorf("deny default")
+		return nil, fmt.Errorf("deny default")
 	}
-	return nil
-}
-
-func (this *LimitChinaAccessFilter) Disconnect(client net.Conn) {
-}
-
-func (this *LimitChinaAccessFilter) Read(client net.Conn, rwc core.ReadWriteCount) {
-}
-
-func (this *LimitChinaAccessFilter) Write(client net.Conn, rwc core.ReadWriteCount) {
-}
-
-func (this *LimitChinaAccessFilter) Request(buf []byte) error {
-	return nil
+	return NopConnectionFilter{}, nil
 }
 
 func (this *LimitChinaAccessFilter) Stop() {
@@ -3,45 +3,67 @@ package filter
 import (
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/millken/tcpwder/config"
-	"github.com/millken/tcpwder/core"
 )
 
 type LimitMaxConnectionFilter struct {
 	maxConnections *int
-	clients        map[string]bool
+
+	/* Active connections, shared with filters replacing this one on reload */
+	active *activeConnections
+}
+
+/**
+ * Count of active connections, guarded by mutex
+ */
+type activeConnections struct {
+	count int
+	mutex sync.Mutex
+}
+
+/**
+ * Connection counted by LimitMaxConnectionFilter
+ */
+type limitMaxConnection struct {
+	NopConnectionFilter
+	active *activeConnections
 }
 
-func (this *LimitMaxConnectionFilter) Init(cfg config.Server) bool {
+func (this *LimitMaxConnectionFilter) Init(cfg config.FilterOptions) bool {
 	if cfg.MaxConnections != nil && *cfg.MaxConnections > 0 {
 		this.maxConnections = cfg.MaxConnections
-		this.clients = make(map[string]bool)
+		this.active = &activeConnections{}
 		return true
 	}
 	return false
 }
 
-func (this *LimitMaxConnectionFilter) Connect(client net.Conn) error {
-	if len(this.clients) >= *this.maxConnections {
-		return fmt.Errorf("Too many connections, more than %d", *this.maxConnections)
+/**
+ * Keep counting connections accepted by previous filter
+ */
+func (this *LimitMaxConnectionFilter) Inherit(previous FilterInterface) {
+	if p, ok := previous.(*LimitMaxConnectionFilter); ok {
+		this.active = p.active
 	}
-	this.clients[client.RemoteAddr().String()] = true
-	return nil
 }
 
-func (this *LimitMaxConnectionFilter) Disconnect(client net.Conn) {
-	delete(this.clients, client.RemoteAddr().String())
-}
-
-func (this *LimitMaxConnectionFilter) Read(client net.Conn, rwc core.ReadWriteCount) {
-}
+func (this *LimitMaxConnectionFilter) Connect(client net.Addr) (ConnectionFilter, error) {
+	this.active.mutex.Lock()
+	defer this.active.mutex.Unlock()
 
-func (this *LimitMaxConnectionFilter) Write(client net.Conn, rwc core.ReadWriteCount) {
+	if this.active.count >= *this.maxConnections {
+		return nil, fmt.Errorf("Too many connections, more than %d", *this.maxConnections)
+	}
+	this.active.count++
+	return &limitMaxConnection{active: this.active}, nil
 }
 
-func (this *LimitMaxConnectionFilter) Request(buf []byte) error {
-	return nil
+func (this *limitMaxConnection) Disconnect() {
+	this.active.mutex.Lock()
+	this.active.count--
+	this.active.mutex.Unlock()
 }
 
 func (this *LimitMaxConnectionFilter) Stop() {
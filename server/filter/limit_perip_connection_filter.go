@@ -3,53 +3,75 @@ package filter
 import (
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/millken/tcpwder/config"
-	"github.com/millken/tcpwder/core"
 )
 
 type LimitPerIPConnectionFilter struct {
 	connections *uint
-	clients     map[string]uint
+
+	/* Active connections by client host, shared with filters replacing this one on reload */
+	active *activeClients
+}
+
+/**
+ * Count of active connections by client host, guarded by mutex
+ */
+type activeClients struct {
+	clients map[string]uint
+	mutex   sync.Mutex
 }
 
-func (this *LimitPerIPConnectionFilter) Init(cfg config.Server) bool {
+/**
+ * Connection counted by LimitPerIPConnectionFilter
+ */
+type limitPerIPConnection struct {
+	NopConnectionFilter
+	active *activeClients
+	host   string
+}
+
+func (this *LimitPerIPConnectionFilter) Init(cfg config.FilterOptions) bool {
 	if cfg.PerIpConnections != nil && *cfg.PerIpConnections > 0 {
 		this.connections = cfg.PerIpConnections
-		this.clients = make(map[string]uint)
+		this.active = &activeClients{clients: make(map[string]uint)}
 		return true
 	}
 	return false
 }
 
-func (this *LimitPerIPConnectionFilter) Connect(client net.Conn) error {
-	host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
-	if this.clients[host] >= *this.connections {
-		return fmt.Errorf("per ip connections %s, limit %d", host, *this.connections)
-	}
-	this.clients[host] += 1
-	return nil
-}
-
-func (this *LimitPerIPConnectionFilter) Disconnect(client net.Conn) {
-	host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
-	if _, ok := this.clients[host]; ok {
-		if this.clients[host] > 1 {
-			this.clients[host] -= 1
-		} else {
-			delete(this.clients, host)
-		}
+/**
+ * Keep counting connections accepted by previous filter
+ */
+func (this *LimitPerIPConnectionFilter) Inherit(previous FilterInterface) {
+	if p, ok := previous.(*LimitPerIPConnectionFilter); ok {
+		this.active = p.active
 	}
 }
 
-func (this *LimitPerIPConnectionFilter) Read(client net.Conn, rwc core.ReadWriteCount) {
-}
+func (this *LimitPerIPConnectionFilter) Connect(client net.Addr) (ConnectionFilter, error) {
+	host, _, _ := net.SplitHostPort(client.String())
+
+	this.active.mutex.Lock()
+	defer this.active.mutex.Unlock()
 
-func (this *LimitPerIPConnectionFilter) Write(client net.Conn, rwc core.ReadWriteCount) {
+	if this.active.clients[host] >= *this.connections {
+		return nil, fmt.Errorf("per ip connections %s, limit %d", host, *this.connections)
+	}
+	this.active.clients[host] += 1
+	return &limitPerIPConnection{active: this.active, host: host}, nil
 }
 
-func (this *LimitPerIPConnectionFilter) Request(buf []byte) error {
-	return nil
+func (this *limitPerIPConnection) Disconnect() {
+	this.active.mutex.Lock()
+	defer this.active.mutex.Unlock()
+
+	if this.active.clients[this.host] > 1 {
+		this.active.clients[this.host] -= 1
+	} else {
+		delete(this.active.clients, this.host)
+	}
 }
 
 func (this *LimitPerIPConnectionFilter) Stop() {
@@ -3,11 +3,11 @@ package filter
 import (
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/millken/tcpwder/config"
 	"github.com/millken/tcpwder/core"
-	"github.com/millken/tcpwder/firewall"
 	"github.com/millken/tcpwder/utils"
 )
 
@@ -15,23 +15,55 @@ type LimitPeripRateFilter struct {
 	readBytes  uint
 	writeBytes uint
 	interval   time.Duration
-	clients    map[string]*core.ReadWriteCount
-	stop       chan bool
+
+	/* Traffic by client host in current interval, guarded by mutex */
+	clients map[string]*rateClient
+	mutex   sync.Mutex
+
+	ban  *BanPolicy
+	stop chan bool
+}
+
+/**
+ * Traffic of a client in current interval
+ */
+type rateClient struct {
+	counts core.ReadWriteCount
+
+	/* Client went over limit, offence is handled once per interval */
+	offended bool
+}
+
+/**
+ * Connection which traffic is counted by LimitPeripRateFilter
+ */
+type limitPeripRateConnection struct {
+	NopConnectionFilter
+	filter *LimitPeripRateFilter
+	host   string
 }
 
-func (this *LimitPeripRateFilter) Init(cfg config.Server) bool {
+func (this *LimitPeripRateFilter) SetBanPolicy(policy *BanPolicy) {
+	this.ban = policy
+}
+
+func (this *LimitPeripRateFilter) Init(cfg config.FilterOptions) bool {
 	if cfg.LimitPeripRate != nil {
 		this.readBytes = cfg.LimitPeripRate.ReadBytes
 		this.writeBytes = cfg.LimitPeripRate.WriteBytes
 		this.interval = utils.ParseDurationOrDefault(cfg.LimitPeripRate.Interval, time.Second*2)
-		this.clients = make(map[string]*core.ReadWriteCount)
+		this.clients = make(map[string]*rateClient)
+
+		this.stop = make(chan bool)
 
 		ticker := time.NewTicker(this.interval)
 		go func() {
 			for {
 				select {
 				case <-ticker.C:
-					this.clients = make(map[string]*core.ReadWriteCount)
+					this.mutex.Lock()
+					this.clients = make(map[string]*rateClient)
+					this.mutex.Unlock()
 				case <-this.stop:
 					ticker.Stop()
 					return
@@ -43,39 +75,48 @@ func (this *LimitPeripRateFilter) Init(cfg config.Server) bool {
 	return false
 }
 
-func (this *LimitPeripRateFilter) Connect(client net.Conn) error {
-	return nil
+func (this *LimitPeripRateFilter) Connect(client net.Addr) (ConnectionFilter, error) {
+	host, _, _ := net.SplitHostPort(client.String())
+	return &limitPeripRateConnection{filter: this, host: host}, nil
 }
 
-func (this *LimitPeripRateFilter) Disconnect(client net.Conn) {
-}
+/**
+ * Add bytes to client counts. Returns true if client went over
+ * limit for the first time in current interval
+ */
+func (this *LimitPeripRateFilter) count(host string, rwc core.ReadWriteCount) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 
-func (this *LimitPeripRateFilter) Read(client net.Conn, rwc core.ReadWriteCount) {
-	host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
-	if _, ok := this.clients[host]; !ok {
-		this.clients[host] = &core.ReadWriteCount{}
+	client, ok := this.clients[host]
+	if !ok {
+		client = &rateClient{}
+		this.clients[host] = client
 	}
-	this.clients[host].CountRead += rwc.CountRead
-	if this.readBytes != 0 && this.clients[host].CountRead > this.readBytes {
-		log.Printf("[WARN] LimitPeripRateFilter host %s reach read limit %d", host, this.readBytes)
-		firewall.SetDeny(host, 3600)
+	client.counts.CountRead += rwc.CountRead
+	client.counts.CountWrite += rwc.CountWrite
+
+	if client.offended {
+		return false
 	}
+
+	client.offended = (this.readBytes != 0 && client.counts.CountRead > this.readBytes) ||
+		(this.writeBytes != 0 && client.counts.CountWrite > this.writeBytes)
+	return client.offended
 }
 
-func (this *LimitPeripRateFilter) Write(client net.Conn, rwc core.ReadWriteCount) {
-	host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
-	if _, ok := this.clients[host]; !ok {
-		this.clients[host] = &core.ReadWriteCount{}
-	}
-	this.clients[host].CountWrite += rwc.CountWrite
-	if this.writeBytes != 0 && this.clients[host].CountWrite > this.writeBytes {
-		log.Printf("[WARN] LimitPeripRateFilter host %s reach write limit %d", host, this.writeBytes)
-		firewall.SetDeny(host, 3600)
+func (this *limitPeripRateConnection) Read(rwc core.ReadWriteCount) {
+	if this.filter.count(this.host, core.ReadWriteCount{CountRead: rwc.CountRead}) {
+		log.Printf("[WARN] LimitPeripRateFilter host %s reach read limit %d", this.host, this.filter.readBytes)
+		this.filter.ban.HandleOffence(this.host, "limit_perip_rate: read limit")
 	}
 }
 
-func (this *LimitPeripRateFilter) Request(buf []byte) error {
-	return nil
+func (this *limitPeripRateConnection) Write(rwc core.ReadWriteCount) {
+	if this.filter.count(this.host, core.ReadWriteCount{CountWrite: rwc.CountWrite}) {
+		log.Printf("[WARN] LimitPeripRateFilter host %s reach write limit %d", this.host, this.filter.writeBytes)
+		this.filter.ban.HandleOffence(this.host, "limit_perip_rate: write limit")
+	}
 }
 
 func (this *LimitPeripRateFilter) Stop() {
@@ -3,32 +3,49 @@ package filter
 import (
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/millken/tcpwder/config"
-	"github.com/millken/tcpwder/core"
 	"github.com/millken/tcpwder/utils"
 )
 
 type LimitReconnectRateFilter struct {
 	reconnects int
 	interval   time.Duration
-	clients    map[string]int
-	stop       chan bool
+
+	/* Disconnects by client host in current interval, guarded by mutex */
+	clients map[string]int
+	mutex   sync.Mutex
+
+	stop chan bool
+}
+
+/**
+ * Connection counted by LimitReconnectRateFilter on disconnect
+ */
+type limitReconnectRateConnection struct {
+	NopConnectionFilter
+	filter *LimitReconnectRateFilter
+	host   string
 }
 
-func (this *LimitReconnectRateFilter) Init(cfg config.Server) bool {
+func (this *LimitReconnectRateFilter) Init(cfg config.FilterOptions) bool {
 	if cfg.LimitReconnectRate != nil {
 		this.reconnects = cfg.LimitReconnectRate.Reconnects
 		this.interval = utils.ParseDurationOrDefault(cfg.LimitReconnectRate.Interval, time.Second*2)
 		this.clients = make(map[string]int)
 
+		this.stop = make(chan bool)
+
 		ticker := time.NewTicker(this.interval)
 		go func() {
 			for {
 				select {
 				case <-ticker.C:
+					this.mutex.Lock()
 					this.clients = make(map[string]int)
+					this.mutex.Unlock()
 				case <-this.stop:
 					ticker.Stop()
 					return
@@ -40,29 +57,22 @@ func (this *LimitReconnectRateFilter) Init(cfg config.Server) bool {
 	return false
 }
 
-func (this *LimitReconnectRateFilter) Connect(client net.Conn) error {
-	host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
-	if _, ok := this.clients[host]; ok {
-		if this.clients[host] > this.reconnects {
-			return fmt.Errorf("limit reconnet rate %s, limit %d", host, this.reconnects)
-		}
-	}
-	return nil
-}
+func (this *LimitReconnectRateFilter) Connect(client net.Addr) (ConnectionFilter, error) {
+	host, _, _ := net.SplitHostPort(client.String())
 
-func (this *LimitReconnectRateFilter) Disconnect(client net.Conn) {
-	host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
-	this.clients[host] += 1
-}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 
-func (this *LimitReconnectRateFilter) Read(client net.Conn, rwc core.ReadWriteCount) {
-}
-
-func (this *LimitReconnectRateFilter) Write(client net.Conn, rwc core.ReadWriteCount) {
+	if this.clients[host] > this.reconnects {
+		return nil, fmt.Errorf("limit reconnet rate %s, limit %d", host, this.reconnects)
+	}
+	return &limitReconnectRateConnection{filter: this, host: host}, nil
 }
 
-func (this *LimitReconnectRateFilter) Request(buf []byte) error {
-	return nil
+func (this *limitReconnectRateConnection) Disconnect() {
+	this.filter.mutex.Lock()
+	this.filter.clients[this.host] += 1
+	this.filter.mutex.Unlock()
 }
 
 func (this *LimitReconnectRateFilter) Stop() {
@@ -0,0 +1,59 @@
+/**
+ * exec.go - exec healthcheck
+ */
+
+package healthcheck
+
+import (
+	"context"
+	"log"
+	osexec "os/exec"
+	"strings"
+	"time"
+
+	"github.com/millken/tcpwder/utils"
+)
+
+/**
+ * Exec healthcheck.
+ * Runs exec_command with target host and port as arguments
+ * and compares its output with expected positive / negative output
+ */
+func exec(p Probe, result chan<- CheckResult) {
+
+	t, cfg := p.Target, p.Cfg
+
+	checkResult := CheckResult{
+		Target: t,
+	}
+
+	if cfg.ExecHealthcheckConfig == nil || cfg.ExecCommand == "" {
+		log.Printf("[ERROR] healthcheck exec %s: no exec_command", t.Address())
+		result <- checkResult
+		return
+	}
+
+	timeout := utils.ParseDurationOrDefault(cfg.Timeout, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	out, err := osexec.CommandContext(ctx, cfg.ExecCommand, t.Host, t.Port).Output()
+	if err != nil {
+		log.Printf("[DEBUG] healthcheck exec %s: %s", t.Address(), err)
+		result <- checkResult
+		return
+	}
+
+	output := strings.TrimSpace(string(out))
+
+	switch output {
+	case cfg.ExecExpectedPositiveOutput:
+		checkResult.Live = true
+	case cfg.ExecExpectedNegativeOutput:
+		checkResult.Live = false
+	default:
+		log.Printf("[WARN] healthcheck exec %s: unexpected output %q", t.Address(), output)
+	}
+
+	result <- checkResult
+}
@@ -0,0 +1,163 @@
+/**
+ * healthcheck.go - backends healthcheck
+ */
+
+package healthcheck
+
+import (
+	"crypto/tls"
+	"log"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+/**
+ * Probe describes single check of the target
+ */
+type Probe struct {
+
+	/* Target to check */
+	Target core.Target
+
+	/* Healthcheck configuration */
+	Cfg config.HealthcheckConfig
+
+	/* Tls config used to connect to backends, nil if backends are not tls */
+	TlsConfig *tls.Config
+}
+
+/**
+ * Health Check function
+ * Checks target and pushes result to the channel
+ */
+type CheckFunc func(Probe, chan<- CheckResult)
+
+/**
+ * Check result
+ * Contains target and its live status
+ */
+type CheckResult struct {
+
+	/* Target to which check result belongs */
+	Target core.Target
+
+	/* Is target live */
+	Live bool
+}
+
+/**
+ * Healthcheck manages workers checking targets
+ */
+type Healthcheck struct {
+
+	/* Healthcheck function */
+	check CheckFunc
+
+	/* Healthcheck configuration */
+	cfg config.HealthcheckConfig
+
+	/* Tls config used to connect to backends */
+	tlsConfig *tls.Config
+
+	/* Current check workers */
+	workers map[core.Target]*Worker
+
+	/* ----- channels ----- */
+
+	/* Input channel of targets to check */
+	In chan []core.Target
+
+	/* Output channel of live status changes */
+	Out chan CheckResult
+
+	/* Stop channel */
+	stop chan bool
+}
+
+/**
+ * Create new Healthcheck based on kind.
+ * Unknown kinds are rejected by config validation (see Registered)
+ */
+func New(cfg config.HealthcheckConfig, tlsConfig *tls.Config) *Healthcheck {
+
+	check, ok := registry[cfg.Kind]
+	if !ok {
+		log.Printf("[ERROR] Unknown healthcheck kind %s, healthcheck disabled", cfg.Kind)
+	}
+
+	return &Healthcheck{
+		check:     check,
+		cfg:       cfg,
+		tlsConfig: tlsConfig,
+		workers:   make(map[core.Target]*Worker),
+		In:        make(chan []core.Target),
+		Out:       make(chan CheckResult),
+		stop:      make(chan bool),
+	}
+}
+
+/**
+ * Start processing targets
+ */
+func (this *Healthcheck) Start() {
+
+	go func() {
+		for {
+			select {
+
+			/* got new targets */
+			case targets := <-this.In:
+				this.UpdateWorkers(targets)
+
+			/* stop requested */
+			case <-this.stop:
+				for _, worker := range this.workers {
+					worker.Stop()
+				}
+				this.workers = nil
+				return
+			}
+		}
+	}()
+}
+
+/**
+ * Sync workers with targets: start workers for new
+ * targets and stop workers of removed targets
+ */
+func (this *Healthcheck) UpdateWorkers(targets []core.Target) {
+
+	// healthcheck is disabled
+	if this.check == nil {
+		return
+	}
+
+	result := map[core.Target]*Worker{}
+
+	// Keep or add needed workers
+	for _, t := range targets {
+		worker, ok := this.workers[t]
+		if !ok {
+			worker = newWorker(Probe{t, this.cfg, this.tlsConfig}, this.check, this.Out)
+			worker.Start()
+		}
+		result[t] = worker
+	}
+
+	// Stop workers of removed targets
+	for t, worker := range this.workers {
+		if _, ok := result[t]; !ok {
+			worker.Stop()
+		}
+	}
+
+	this.workers = result
+}
+
+/**
+ * Stop healthcheck and all its workers
+ */
+func (this *Healthcheck) Stop() {
+	this.stop <- true
+}
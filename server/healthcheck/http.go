@@ -0,0 +1,108 @@
+/**
+ * http.go - http healthcheck
+ */
+
+package healthcheck
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/millken/tcpwder/utils"
+)
+
+/* Max bytes of response body to match against expected body */
+const HTTP_MAX_BODY_SIZE = 64 * 1024
+
+/**
+ * Http healthcheck.
+ * Target is live if GET request returns expected status and
+ * body matching expected regexp. Https is used if backends are tls
+ */
+func httpGet(p Probe, result chan<- CheckResult) {
+
+	t, cfg := p.Target, p.Cfg
+
+	timeout := utils.ParseDurationOrDefault(cfg.Timeout, time.Second)
+	checkResult := CheckResult{
+		Target: t,
+	}
+
+	path := "/"
+	host := ""
+	expectedStatus := http.StatusOK
+	expectedBody := ""
+	if cfg.HttpHealthcheckConfig != nil {
+		if cfg.HttpPath != "" {
+			path = cfg.HttpPath
+		}
+		if cfg.HttpExpectedStatus != 0 {
+			expectedStatus = cfg.HttpExpectedStatus
+		}
+		host = cfg.HttpHost
+		expectedBody = cfg.HttpExpectedBody
+	}
+
+	scheme := "http"
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+	}
+	if p.TlsConfig != nil {
+		scheme = "https"
+		transport.TLSClientConfig = p.TlsConfig.Clone()
+	}
+
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest("GET", scheme+"://"+t.Address()+path, nil)
+	if err != nil {
+		log.Printf("[ERROR] healthcheck http %s: %s", t.Address(), err)
+		result <- checkResult
+		return
+	}
+	if host != "" {
+		req.Host = host
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("[DEBUG] healthcheck http %s: %s", t.Address(), err)
+		result <- checkResult
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		log.Printf("[DEBUG] healthcheck http %s: unexpected status %d", t.Address(), resp.StatusCode)
+		result <- checkResult
+		return
+	}
+
+	if expectedBody != "" {
+		re, err := regexp.Compile(expectedBody)
+		if err != nil {
+			log.Printf("[ERROR] healthcheck http %s: %s", t.Address(), err)
+			result <- checkResult
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(resp.Body, HTTP_MAX_BODY_SIZE))
+		if err != nil || !re.Match(body) {
+			log.Printf("[DEBUG] healthcheck http %s: unexpected body", t.Address())
+			result <- checkResult
+			return
+		}
+	}
+
+	checkResult.Live = true
+	result <- checkResult
+}
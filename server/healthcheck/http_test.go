@@ -0,0 +1,123 @@
+package healthcheck
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+/**
+ * Run check against address, returning its result
+ */
+func runCheck(t *testing.T, check CheckFunc, address string, cfg config.HealthcheckConfig, tlsConfig *tls.Config) CheckResult {
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Timeout == "" {
+		cfg.Timeout = "1s"
+	}
+
+	target := core.Target{Host: host, Port: port}
+	results := make(chan CheckResult, 1)
+	check(Probe{Target: target, Cfg: cfg, TlsConfig: tlsConfig}, results)
+
+	result := <-results
+	if result.Target != target {
+		t.Fatalf("Expected result of %v, got %v", target, result.Target)
+	}
+	return result
+}
+
+/**
+ * Tls config trusting test server certificate
+ */
+func trusting(server *httptest.Server) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return &tls.Config{RootCAs: pool, ServerName: "example.com"}
+}
+
+func httpConfig(path, host string, status int, body string) config.HealthcheckConfig {
+	return config.HealthcheckConfig{
+		Kind: "http",
+		HttpHealthcheckConfig: &config.HttpHealthcheckConfig{
+			HttpPath:           path,
+			HttpHost:           host,
+			HttpExpectedStatus: status,
+			HttpExpectedBody:   body,
+		},
+	}
+}
+
+func TestHttpCheck(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			if r.Host != "backend.local" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("status: ok"))
+		case "/redirect":
+			http.Redirect(w, r, "/health", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	address := server.Listener.Addr().String()
+
+	cases := []struct {
+		cfg  config.HealthcheckConfig
+		live bool
+	}{
+		{httpConfig("/health", "backend.local", 0, ""), true},
+		{httpConfig("/health", "backend.local", 0, "ok$"), true},
+		{httpConfig("/health", "backend.local", 0, "failed"), false},
+		{httpConfig("/health", "", 0, ""), false},
+		{httpConfig("/", "", 0, ""), false},
+		{httpConfig("/", "", http.StatusServiceUnavailable, ""), true},
+		// redirects are not followed
+		{httpConfig("/redirect", "backend.local", 0, ""), false},
+		{httpConfig("/redirect", "backend.local", http.StatusFound, ""), true},
+		{config.HealthcheckConfig{Kind: "http"}, false},
+	}
+
+	for i, c := range cases {
+		if result := runCheck(t, httpGet, address, c.cfg, nil); result.Live != c.live {
+			t.Errorf("Case %d: expected live %v, got %v", i, c.live, result.Live)
+		}
+	}
+
+	server.Close()
+	if result := runCheck(t, httpGet, address, httpConfig("/health", "backend.local", 0, ""), nil); result.Live {
+		t.Error("Expected closed server not to be live")
+	}
+}
+
+func TestHttpsCheck(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	address := server.Listener.Addr().String()
+
+	if result := runCheck(t, httpGet, address, httpConfig("/", "", 0, "ok"), trusting(server)); !result.Live {
+		t.Error("Expected https server to be live")
+	}
+	if result := runCheck(t, httpGet, address, httpConfig("/", "", 0, ""), nil); result.Live {
+		t.Error("Expected plain http check of https server to fail")
+	}
+}
@@ -0,0 +1,58 @@
+/**
+ * ping.go - connect ping healthcheck
+ */
+
+package healthcheck
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/millken/tcpwder/utils"
+)
+
+/**
+ * Ping healthcheck.
+ * For tcp target is live if connection can be established,
+ * for udp target is live unless it answers with port unreachable
+ */
+func ping(p Probe, result chan<- CheckResult) {
+
+	t, cfg := p.Target, p.Cfg
+
+	protocol := "tcp"
+	if cfg.PingHealthcheckConfig != nil && cfg.PingHealthcheckConfig.Protocol != "" {
+		protocol = cfg.PingHealthcheckConfig.Protocol
+	}
+
+	timeout := utils.ParseDurationOrDefault(cfg.Timeout, time.Second)
+	checkResult := CheckResult{
+		Target: t,
+	}
+
+	conn, err := net.DialTimeout(protocol, t.Address(), timeout)
+	if err != nil {
+		log.Printf("[DEBUG] healthcheck ping %s: %s", t.Address(), err)
+		result <- checkResult
+		return
+	}
+	defer conn.Close()
+
+	if protocol == "udp" {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err = conn.Write([]byte{}); err == nil {
+			_, err = conn.Read(make([]byte, 1))
+		}
+		if err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				log.Printf("[DEBUG] healthcheck ping %s: %s", t.Address(), err)
+				result <- checkResult
+				return
+			}
+		}
+	}
+
+	checkResult.Live = true
+	result <- checkResult
+}
@@ -0,0 +1,107 @@
+/**
+ * probe.go - send / expect healthcheck
+ */
+
+package healthcheck
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/millken/tcpwder/utils"
+)
+
+/* Default max bytes to read from target while waiting for expected response */
+const PROBE_DEFAULT_RECV_LEN = 512
+
+/**
+ * Probe healthcheck.
+ * Sends probe_send to the target and expects response
+ * matching probe_recv regexp within first probe_recv_len bytes
+ */
+func probe(p Probe, result chan<- CheckResult) {
+
+	t, cfg := p.Target, p.Cfg
+
+	timeout := utils.ParseDurationOrDefault(cfg.Timeout, time.Second)
+	checkResult := CheckResult{
+		Target: t,
+	}
+
+	protocol := "tcp"
+	send := ""
+	recv := ""
+	recvLen := PROBE_DEFAULT_RECV_LEN
+	if cfg.ProbeHealthcheckConfig != nil {
+		if cfg.ProbeProtocol != "" {
+			protocol = cfg.ProbeProtocol
+		}
+		if cfg.ProbeRecvLen > 0 {
+			recvLen = cfg.ProbeRecvLen
+		}
+		send = cfg.ProbeSend
+		recv = cfg.ProbeRecv
+	}
+
+	var re *regexp.Regexp
+	if recv != "" {
+		var err error
+		if re, err = regexp.Compile(recv); err != nil {
+			log.Printf("[ERROR] healthcheck probe %s: %s", t.Address(), err)
+			result <- checkResult
+			return
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if protocol == "tcp" && p.TlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, protocol, t.Address(), p.TlsConfig)
+	} else {
+		conn, err = net.DialTimeout(protocol, t.Address(), timeout)
+	}
+	if err != nil {
+		log.Printf("[DEBUG] healthcheck probe %s: %s", t.Address(), err)
+		result <- checkResult
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if send != "" {
+		if _, err = conn.Write([]byte(send)); err != nil {
+			log.Printf("[DEBUG] healthcheck probe %s: %s", t.Address(), err)
+			result <- checkResult
+			return
+		}
+	}
+
+	if re == nil {
+		checkResult.Live = true
+		result <- checkResult
+		return
+	}
+
+	buf := make([]byte, recvLen)
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+
+		if re.Match(buf[:n]) {
+			checkResult.Live = true
+			break
+		}
+
+		if err != nil {
+			log.Printf("[DEBUG] healthcheck probe %s: %s", t.Address(), err)
+			break
+		}
+	}
+
+	result <- checkResult
+}
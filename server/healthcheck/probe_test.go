@@ -0,0 +1,122 @@
+package healthcheck
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/millken/tcpwder/config"
+)
+
+/**
+ * Tcp stub answering every line with reply
+ */
+func tcpStub(t *testing.T, reply func(line string) string) net.Listener {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(reply(line)))
+			}(conn)
+		}
+	}()
+
+	return ln
+}
+
+func probeConfig(protocol, send, recv string, recvLen int) config.HealthcheckConfig {
+	return config.HealthcheckConfig{
+		Kind:    "probe",
+		Timeout: "200ms",
+		ProbeHealthcheckConfig: &config.ProbeHealthcheckConfig{
+			ProbeProtocol: protocol,
+			ProbeSend:     send,
+			ProbeRecv:     recv,
+			ProbeRecvLen:  recvLen,
+		},
+	}
+}
+
+func TestTcpProbeCheck(t *testing.T) {
+
+	ln := tcpStub(t, func(line string) string {
+		if line == "PING\r\n" {
+			return "+PONG\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	defer ln.Close()
+
+	address := ln.Addr().String()
+
+	cases := []struct {
+		cfg  config.HealthcheckConfig
+		live bool
+	}{
+		{probeConfig("tcp", "PING\r\n", "^\\+PONG", 0), true},
+		{probeConfig("tcp", "INFO\r\n", "^\\+PONG", 0), false},
+		// response is not read past recv len
+		{probeConfig("tcp", "PING\r\n", "PONG", 3), false},
+		// connect only
+		{probeConfig("tcp", "", "", 0), true},
+		// nothing sent, nothing received before timeout
+		{probeConfig("tcp", "", "PONG", 0), false},
+		{probeConfig("tcp", "PING\r\n", "(", 0), false},
+	}
+
+	for i, c := range cases {
+		if result := runCheck(t, probe, address, c.cfg, nil); result.Live != c.live {
+			t.Errorf("Case %d: expected live %v, got %v", i, c.live, result.Live)
+		}
+	}
+
+	ln.Close()
+	if result := runCheck(t, probe, address, probeConfig("tcp", "", "", 0), nil); result.Live {
+		t.Error("Expected closed listener not to be live")
+	}
+}
+
+func TestUdpProbeCheck(t *testing.T) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "ping" {
+				conn.WriteTo([]byte("pong"), addr)
+			}
+		}
+	}()
+
+	address := conn.LocalAddr().String()
+
+	if result := runCheck(t, probe, address, probeConfig("udp", "ping", "^pong$", 0), nil); !result.Live {
+		t.Error("Expected udp probe to succeed")
+	}
+	if result := runCheck(t, probe, address, probeConfig("udp", "hello", "^pong$", 0), nil); result.Live {
+		t.Error("Expected unanswered udp probe to fail")
+	}
+}
@@ -0,0 +1,37 @@
+/**
+ * registry.go - healthchecks registry
+ */
+
+package healthcheck
+
+/**
+ * Registry of available healthchecks
+ */
+var registry = make(map[string]CheckFunc)
+
+/**
+ * Initialize registry
+ */
+func init() {
+	registry["none"] = nil
+	registry["ping"] = ping
+	registry["exec"] = exec
+	registry["tls"] = tlsHandshake
+	registry["http"] = httpGet
+	registry["probe"] = probe
+}
+
+/**
+ * Register healthcheck kind
+ */
+func Register(kind string, check CheckFunc) {
+	registry[kind] = check
+}
+
+/**
+ * Check if healthcheck kind is registered
+ */
+func Registered(kind string) bool {
+	_, ok := registry[kind]
+	return ok
+}
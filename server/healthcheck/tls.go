@@ -0,0 +1,48 @@
+/**
+ * tls.go - tls handshake healthcheck
+ */
+
+package healthcheck
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+
+	"github.com/millken/tcpwder/utils"
+)
+
+/**
+ * Tls healthcheck.
+ * Target is live if full tls handshake succeeds, using
+ * the same tls settings as proxied connections to backends
+ */
+func tlsHandshake(p Probe, result chan<- CheckResult) {
+
+	t, cfg := p.Target, p.Cfg
+
+	timeout := utils.ParseDurationOrDefault(cfg.Timeout, time.Second)
+	checkResult := CheckResult{
+		Target: t,
+	}
+
+	tlsConfig := &tls.Config{}
+	if p.TlsConfig != nil {
+		tlsConfig = p.TlsConfig.Clone()
+	}
+	if cfg.TlsHealthcheckConfig != nil && cfg.TlsServerName != "" {
+		tlsConfig.ServerName = cfg.TlsServerName
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", t.Address(), tlsConfig)
+	if err != nil {
+		log.Printf("[DEBUG] healthcheck tls %s: %s", t.Address(), err)
+		result <- checkResult
+		return
+	}
+	conn.Close()
+
+	checkResult.Live = true
+	result <- checkResult
+}
@@ -0,0 +1,64 @@
+package healthcheck
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/millken/tcpwder/config"
+)
+
+func TestTlsCheck(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	address := server.Listener.Addr().String()
+	cfg := config.HealthcheckConfig{Kind: "tls"}
+
+	if result := runCheck(t, tlsHandshake, address, cfg, trusting(server)); !result.Live {
+		t.Error("Expected handshake with trusted certificate to succeed")
+	}
+
+	// certificate is not trusted by default
+	if result := runCheck(t, tlsHandshake, address, cfg, nil); result.Live {
+		t.Error("Expected handshake with untrusted certificate to fail")
+	}
+
+	// server name not in certificate
+	cfg.TlsHealthcheckConfig = &config.TlsHealthcheckConfig{TlsServerName: "other.org"}
+	if result := runCheck(t, tlsHandshake, address, cfg, trusting(server)); result.Live {
+		t.Error("Expected handshake with wrong server name to fail")
+	}
+
+	if result := runCheck(t, tlsHandshake, address, cfg, &tls.Config{InsecureSkipVerify: true}); !result.Live {
+		t.Error("Expected handshake without verification to succeed")
+	}
+}
+
+func TestTlsCheckPlainServer(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+
+	cfg := config.HealthcheckConfig{Kind: "tls"}
+	if result := runCheck(t, tlsHandshake, ln.Addr().String(), cfg, &tls.Config{InsecureSkipVerify: true}); result.Live {
+		t.Error("Expected handshake with plain server to fail")
+	}
+}
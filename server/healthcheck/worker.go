@@ -0,0 +1,139 @@
+/**
+ * worker.go - healthcheck worker of a single target
+ */
+
+package healthcheck
+
+import (
+	"time"
+
+	"github.com/millken/tcpwder/utils"
+)
+
+/**
+ * Worker periodically checks single target
+ * and reports its live status changes
+ */
+type Worker struct {
+
+	/* Probe of the target */
+	probe Probe
+
+	/* Check function */
+	check CheckFunc
+
+	/* Last reported result */
+	LastResult CheckResult
+
+	/* Consecutive results different from LastResult */
+	passes int
+	fails  int
+
+	/* ----- channels ----- */
+
+	/* Output channel of live status changes */
+	out chan<- CheckResult
+
+	/* Stop channel */
+	stop chan bool
+}
+
+/**
+ * Create new worker for the target.
+ * Targets are considered live until checks say otherwise
+ */
+func newWorker(probe Probe, check CheckFunc, out chan<- CheckResult) *Worker {
+	return &Worker{
+		probe: probe,
+		check: check,
+		out:   out,
+		stop:  make(chan bool),
+		LastResult: CheckResult{
+			Target: probe.Target,
+			Live:   true,
+		},
+	}
+}
+
+/**
+ * Start checking target
+ */
+func (this *Worker) Start() {
+
+	interval := utils.ParseDurationOrDefault(this.probe.Cfg.Interval, 2*time.Second)
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	results := make(chan CheckResult, 1)
+	checking := false
+
+	go func() {
+		for {
+			select {
+
+			/* time for the next check, skip if previous is still running */
+			case <-ticker.C:
+				if checking {
+					continue
+				}
+				checking = true
+				go this.check(this.probe, results)
+
+			/* check finished */
+			case result := <-results:
+				checking = false
+				if this.process(result) {
+					select {
+					case this.out <- result:
+					case <-this.stop:
+						ticker.Stop()
+						return
+					}
+				}
+
+			/* stop requested */
+			case <-this.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+/**
+ * Apply passes / fails hysteresis to the check result.
+ * Returns true if live status of the target changed
+ */
+func (this *Worker) process(result CheckResult) bool {
+
+	if result.Live == this.LastResult.Live {
+		this.passes = 0
+		this.fails = 0
+		return false
+	}
+
+	if result.Live {
+		this.passes++
+		this.fails = 0
+	} else {
+		this.fails++
+		this.passes = 0
+	}
+
+	if (result.Live && this.passes >= this.probe.Cfg.Passes) || (!result.Live && this.fails >= this.probe.Cfg.Fails) {
+		this.LastResult = result
+		this.passes = 0
+		this.fails = 0
+		return true
+	}
+
+	return false
+}
+
+/**
+ * Stop worker
+ */
+func (this *Worker) Stop() {
+	close(this.stop)
+}
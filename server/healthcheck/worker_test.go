@@ -0,0 +1,127 @@
+package healthcheck
+
+import (
+	"testing"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+func TestWorkerHysteresis(t *testing.T) {
+
+	target := core.Target{Host: "10.0.0.1", Port: "80"}
+	worker := newWorker(Probe{
+		Target: target,
+		Cfg:    config.HealthcheckConfig{Passes: 2, Fails: 3},
+	}, nil, nil)
+
+	steps := []struct {
+		live    bool
+		changed bool
+	}{
+		{false, false},
+		{false, false},
+		// pass in between resets fails
+		{true, false},
+		{false, false},
+		{false, false},
+		{false, true},
+		{false, false},
+		{true, false},
+		{true, true},
+		{true, false},
+	}
+
+	for i, step := range steps {
+		changed := worker.process(CheckResult{Target: target, Live: step.live})
+		if changed != step.changed {
+			t.Fatalf("Step %d: expected changed %v, got %v", i, step.changed, changed)
+		}
+		if changed && worker.LastResult.Live != step.live {
+			t.Fatalf("Step %d: expected live %v reported", i, step.live)
+		}
+	}
+}
+
+func TestWorkerReportsChanges(t *testing.T) {
+
+	out := make(chan CheckResult)
+	target := core.Target{Host: "10.0.0.1", Port: "80"}
+	worker := newWorker(Probe{
+		Target: target,
+		Cfg:    config.HealthcheckConfig{Interval: "10ms", Passes: 1, Fails: 1},
+	}, func(probe Probe, results chan<- CheckResult) {
+		results <- CheckResult{Target: probe.Target, Live: false}
+	}, out)
+
+	worker.Start()
+	defer worker.Stop()
+
+	select {
+	case result := <-out:
+		if result.Target != target || result.Live {
+			t.Fatalf("Unexpected result %+v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected live status change to be reported")
+	}
+}
+
+func TestUpdateWorkers(t *testing.T) {
+
+	h := New(config.HealthcheckConfig{Kind: "none", Interval: "1h"}, nil)
+
+	a := core.Target{Host: "10.0.0.1", Port: "80"}
+	b := core.Target{Host: "10.0.0.2", Port: "80"}
+	c := core.Target{Host: "10.0.0.3", Port: "80"}
+
+	// disabled healthcheck starts no workers
+	h.UpdateWorkers([]core.Target{a, b})
+	if len(h.workers) != 0 {
+		t.Fatalf("Expected no workers, got %d", len(h.workers))
+	}
+
+	h.check = func(probe Probe, results chan<- CheckResult) {
+		results <- CheckResult{Target: probe.Target, Live: true}
+	}
+
+	h.UpdateWorkers([]core.Target{a, b})
+	if len(h.workers) != 2 {
+		t.Fatalf("Expected 2 workers, got %d", len(h.workers))
+	}
+	workerA, workerB := h.workers[a], h.workers[b]
+
+	h.UpdateWorkers([]core.Target{b, c})
+	if len(h.workers) != 2 || h.workers[b] != workerB || h.workers[c] == nil {
+		t.Fatalf("Expected worker of kept target to be reused and new one started, got %v", h.workers)
+	}
+
+	select {
+	case <-workerA.stop:
+	default:
+		t.Fatal("Expected worker of removed target to be stopped")
+	}
+	select {
+	case <-workerB.stop:
+		t.Fatal("Expected worker of kept target to keep running")
+	default:
+	}
+
+	h.UpdateWorkers(nil)
+	if len(h.workers) != 0 {
+		t.Fatalf("Expected all workers to be stopped, got %d", len(h.workers))
+	}
+}
+
+func TestRegistered(t *testing.T) {
+
+	for _, kind := range []string{"none", "ping", "exec", "tls", "http", "probe"} {
+		if !Registered(kind) {
+			t.Errorf("Expected %s kind to be registered", kind)
+		}
+	}
+	if Registered("unknown") {
+		t.Error("Expected unknown kind not to be registered")
+	}
+}
@@ -0,0 +1,295 @@
+/**
+ * backends.go - backends management by api
+ */
+
+package scheduler
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/millken/tcpwder/core"
+)
+
+/**
+ * Backend management action
+ */
+type BackendAction int
+
+/**
+ * Constants for backend management actions
+ */
+const (
+	ListBackends BackendAction = iota
+	AddBackend
+	RemoveBackend
+	UpdateBackend
+)
+
+/**
+ * Request to manage backends
+ */
+type BackendRequest struct {
+	Action   BackendAction
+	Backend  core.Backend
+	Update   core.BackendUpdate
+	Response chan []core.Backend
+	Err      chan error
+}
+
+/**
+ * Handle backend management request
+ */
+func (this *Scheduler) HandleBackendRequest(req BackendRequest) {
+
+	target := req.Backend.Target
+
+	switch req.Action {
+	case ListBackends:
+		// backends map has no order, keep api output stable
+		backends := this.Backends()
+		sort.Slice(backends, func(i, j int) bool {
+			return targetLess(backends[i].Target, backends[j].Target)
+		})
+		req.Response <- backends
+		return
+
+	case AddBackend:
+		if _, ok := this.backends[target]; ok {
+			req.Err <- errors.New("Backend already exists")
+			return
+		}
+		delete(this.removed, target)
+		if !this.isDiscovered(target) {
+			this.added = append(this.added, req.Backend)
+		}
+
+	case RemoveBackend:
+		if _, ok := this.backends[target]; !ok {
+			req.Err <- core.ErrBackendNotFound
+			return
+		}
+		this.removed[target] = true
+		this.removeAdded(target)
+		delete(this.overrides, target)
+		this.setState(target, core.BACKEND_STATE_ACTIVE)
+
+	case UpdateBackend:
+		if _, ok := this.backends[target]; !ok {
+			req.Err <- core.ErrBackendNotFound
+			return
+		}
+
+		switch req.Update.State {
+		case "":
+		case core.BACKEND_STATE_ACTIVE, core.BACKEND_STATE_DRAIN, core.BACKEND_STATE_DISABLED:
+			this.setState(target, req.Update.State)
+		default:
+			req.Err <- errors.New("Not supported backend state " + req.Update.State)
+			return
+		}
+
+		override := this.overrides[target]
+		if req.Update.Weight != nil {
+			override.Weight = req.Update.Weight
+		}
+		if req.Update.Priority != nil {
+			override.Priority = req.Update.Priority
+		}
+		this.overrides[target] = override
+	}
+
+	this.updateBackends()
+	req.Err <- nil
+}
+
+/**
+ * Apply api changes to discovered backends
+ */
+func (this *Scheduler) withApiChanges(discovered []core.Backend) []core.Backend {
+
+	result := make([]core.Backend, 0, len(discovered)+len(this.added))
+	seen := make(map[core.Target]bool)
+
+	for _, list := range [][]core.Backend{discovered, this.added} {
+		for _, b := range list {
+
+			if this.removed[b.Target] || seen[b.Target] {
+				continue
+			}
+			seen[b.Target] = true
+
+			if override, ok := this.overrides[b.Target]; ok {
+				if override.Weight != nil {
+					b.Weight = *override.Weight
+				}
+				if override.Priority != nil {
+					b.Priority = *override.Priority
+				}
+			}
+
+			result = append(result, b)
+		}
+	}
+
+	return result
+}
+
+/**
+ * Check if target is discovered by upstream
+ */
+func (this *Scheduler) isDiscovered(target core.Target) bool {
+	for _, b := range this.discovered {
+		if b.Target.EqualTo(target) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Forget backend added by api
+ */
+func (this *Scheduler) removeAdded(target core.Target) {
+	added := this.added[:0]
+	for _, b := range this.added {
+		if !b.Target.EqualTo(target) {
+			added = append(added, b)
+		}
+	}
+	this.added = added
+}
+
+/**
+ * Returns admin state of the target
+ */
+func (this *Scheduler) state(target core.Target) string {
+	if state, ok := this.states[target]; ok {
+		return state
+	}
+	return core.BACKEND_STATE_ACTIVE
+}
+
+/**
+ * Set admin state of the target
+ */
+func (this *Scheduler) setState(target core.Target, state string) {
+
+	if state == core.BACKEND_STATE_ACTIVE {
+		delete(this.states, target)
+	} else {
+		this.states[target] = state
+	}
+
+	if state == core.BACKEND_STATE_DISABLED {
+		this.disabled.Store(target, true)
+	} else {
+		this.disabled.Delete(target)
+	}
+}
+
+/**
+ * Check if backend was disabled by api and its connections should be closed
+ */
+func (this *Scheduler) IsDisabled(backend core.Backend) bool {
+	_, ok := this.disabled.Load(backend.Target)
+	return ok
+}
+
+/**
+ * Send backend management request and wait for the result
+ */
+func (this *Scheduler) request(req BackendRequest) error {
+	req.Err = make(chan error, 1)
+	select {
+	case this.manage <- req:
+	case <-this.done:
+		return core.ErrServerStopped
+	}
+	return <-req.Err
+}
+
+/**
+ * Order targets by ip address, IPv4 first and host names last,
+ * then by port number
+ */
+func targetLess(a, b core.Target) bool {
+
+	ipA, ipB := ipOrder(a.Host), ipOrder(b.Host)
+	switch {
+	case ipA != nil && ipB != nil:
+		if len(ipA) != len(ipB) {
+			return len(ipA) < len(ipB)
+		}
+		if c := bytes.Compare(ipA, ipB); c != 0 {
+			return c < 0
+		}
+	case ipA != nil:
+		return true
+	case ipB != nil:
+		return false
+	case a.Host != b.Host:
+		return a.Host < b.Host
+	}
+
+	portA, _ := strconv.Atoi(a.Port)
+	portB, _ := strconv.Atoi(b.Port)
+	if portA != portB {
+		return portA < portB
+	}
+
+	return a.Host < b.Host
+}
+
+/**
+ * Returns 4 or 16 bytes of host ip to order by, nil if host is a name
+ */
+func ipOrder(host string) net.IP {
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+/**
+ * List current backends with stats
+ */
+func (this *Scheduler) ListBackends() ([]core.Backend, error) {
+	req := BackendRequest{
+		Action:   ListBackends,
+		Response: make(chan []core.Backend, 1),
+	}
+	select {
+	case this.manage <- req:
+	case <-this.done:
+		return nil, core.ErrServerStopped
+	}
+	return <-req.Response, nil
+}
+
+/**
+ * Add backend to discovered ones
+ */
+func (this *Scheduler) AddBackend(backend core.Backend) error {
+	backend.Stats = core.BackendStats{Live: true}
+	return this.request(BackendRequest{Action: AddBackend, Backend: backend})
+}
+
+/**
+ * Remove backend, even discovered one
+ */
+func (this *Scheduler) RemoveBackend(target core.Target) error {
+	return this.request(BackendRequest{Action: RemoveBackend, Backend: core.Backend{Target: target}})
+}
+
+/**
+ * Change backend weight, priority or state
+ */
+func (this *Scheduler) UpdateBackend(target core.Target, update core.BackendUpdate) error {
+	return this.request(BackendRequest{Action: UpdateBackend, Backend: core.Backend{Target: target}, Update: update})
+}
@@ -0,0 +1,65 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/millken/tcpwder/core"
+)
+
+func TestListBackendsSorted(t *testing.T) {
+
+	scheduler := &Scheduler{backends: make(map[core.Target]*core.Backend)}
+	for _, target := range []core.Target{
+		{Host: "backend.local", Port: "80"},
+		{Host: "2001:db8::1", Port: "80"},
+		{Host: "10.0.0.2", Port: "80"},
+		{Host: "10.0.0.1", Port: "81"},
+		{Host: "10.0.0.10", Port: "80"},
+		{Host: "10.0.0.1", Port: "9"},
+		{Host: "10.0.0.1", Port: "80"},
+	} {
+		scheduler.backends[target] = &core.Backend{Target: target}
+	}
+
+	// numeric order of addresses and ports, names last
+	expected := []string{
+		"10.0.0.1:9",
+		"10.0.0.1:80",
+		"10.0.0.1:81",
+		"10.0.0.2:80",
+		"10.0.0.10:80",
+		"[2001:db8::1]:80",
+		"backend.local:80",
+	}
+
+	for i := 0; i < 5; i++ {
+		req := BackendRequest{Action: ListBackends, Response: make(chan []core.Backend, 1)}
+		scheduler.HandleBackendRequest(req)
+		backends := <-req.Response
+
+		if len(backends) != len(expected) {
+			t.Fatalf("Expected %d backends, got %+v", len(expected), backends)
+		}
+		for j, backend := range backends {
+			if backend.Target.String() != expected[j] {
+				t.Fatalf("Expected %v order, got %+v", expected, backends)
+			}
+		}
+	}
+}
+
+func TestBackendRequestsAfterStop(t *testing.T) {
+
+	scheduler := &Scheduler{
+		manage: make(chan BackendRequest),
+		done:   make(chan bool),
+	}
+	close(scheduler.done)
+
+	if _, err := scheduler.ListBackends(); err != core.ErrServerStopped {
+		t.Errorf("Expected stopped error listing backends, got %v", err)
+	}
+	if err := scheduler.RemoveBackend(core.Target{Host: "10.0.0.1", Port: "80"}); err != core.ErrServerStopped {
+		t.Errorf("Expected stopped error removing backend, got %v", err)
+	}
+}
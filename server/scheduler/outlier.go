@@ -0,0 +1,194 @@
+/**
+ * outlier.go - passive backends outlier detection
+ */
+
+package scheduler
+
+import (
+	"log"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/utils"
+)
+
+/**
+ * Outlier state of a single backend
+ */
+type outlierState struct {
+
+	/* Consecutive failures in current window */
+	failures int
+
+	/* Time of the first failure in current window */
+	windowStart time.Time
+
+	/* Number of ejections in a row, used for exponential ejection time */
+	ejections uint
+
+	/* Time when backend should be re-admitted */
+	ejectedUntil time.Time
+}
+
+/**
+ * Outlier detector ejects backends failing on real traffic.
+ * It's not thread safe and should be used from scheduler goroutine only
+ */
+type OutlierDetector struct {
+
+	/* Consecutive failures to eject backend */
+	consecutiveFailures int
+
+	/* Window consecutive failures are counted in */
+	interval time.Duration
+
+	/* Ejection time of first ejection, doubled on every next one */
+	baseEjectionTime time.Duration
+
+	/* Max ejection time */
+	maxEjectionTime time.Duration
+
+	/* Max percent of backends pool ejected at once */
+	maxEjectionPercent int
+
+	/* Per target states */
+	states map[core.Target]*outlierState
+}
+
+/**
+ * Create new outlier detector,
+ * returns nil if outlier detection is not configured
+ */
+func NewOutlierDetector(cfg *config.OutlierDetection) *OutlierDetector {
+
+	if cfg == nil {
+		return nil
+	}
+
+	return &OutlierDetector{
+		consecutiveFailures: cfg.ConsecutiveFailures,
+		interval:            utils.ParseDurationOrDefault(cfg.Interval, 10*time.Second),
+		baseEjectionTime:    utils.ParseDurationOrDefault(cfg.BaseEjectionTime, 30*time.Second),
+		maxEjectionTime:     utils.ParseDurationOrDefault(cfg.MaxEjectionTime, 300*time.Second),
+		maxEjectionPercent:  cfg.MaxEjectionPercent,
+		states:              make(map[core.Target]*outlierState),
+	}
+}
+
+/**
+ * Handle failure of the backend, ejecting it if needed
+ */
+func (this *OutlierDetector) Failure(backend *core.Backend, backends []*core.Backend) {
+
+	if this == nil || backend.Stats.Ejected {
+		return
+	}
+
+	now := time.Now()
+
+	state, ok := this.states[backend.Target]
+	if !ok {
+		state = &outlierState{}
+		this.states[backend.Target] = state
+	}
+
+	if state.failures == 0 || now.Sub(state.windowStart) > this.interval {
+		state.failures = 0
+		state.windowStart = now
+	}
+
+	state.failures++
+	if state.failures < this.consecutiveFailures {
+		return
+	}
+
+	ejected := 0
+	for _, b := range backends {
+		if b.Stats.Ejected {
+			ejected++
+		}
+	}
+
+	if (ejected+1)*100 > len(backends)*this.maxEjectionPercent {
+		log.Printf("[WARN] Not ejecting backend %s, max ejection percent %d reached", backend.Target, this.maxEjectionPercent)
+		return
+	}
+
+	// forget previous ejections if backend was healthy long enough
+	if !state.ejectedUntil.IsZero() && now.Sub(state.ejectedUntil) > this.maxEjectionTime {
+		state.ejections = 0
+	}
+
+	ejectionTime := this.baseEjectionTime << state.ejections
+	if ejectionTime > this.maxEjectionTime || ejectionTime <= 0 {
+		ejectionTime = this.maxEjectionTime
+	} else {
+		state.ejections++
+	}
+
+	state.failures = 0
+	state.ejectedUntil = now.Add(ejectionTime)
+	backend.Stats.Ejected = true
+
+	log.Printf("[WARN] Ejecting backend %s for %s", backend.Target, ejectionTime)
+}
+
+/**
+ * Handle success of the backend, resetting consecutive failures
+ */
+func (this *OutlierDetector) Success(backend *core.Backend) {
+
+	if this == nil {
+		return
+	}
+
+	if state, ok := this.states[backend.Target]; ok {
+		state.failures = 0
+	}
+}
+
+/**
+ * Re-admit backends which ejection time passed
+ */
+func (this *OutlierDetector) Readmit(backends []*core.Backend) {
+
+	if this == nil {
+		return
+	}
+
+	now := time.Now()
+
+	for _, backend := range backends {
+		if !backend.Stats.Ejected {
+			continue
+		}
+
+		state, ok := this.states[backend.Target]
+		if ok && now.Before(state.ejectedUntil) {
+			continue
+		}
+
+		backend.Stats.Ejected = false
+		log.Printf("[INFO] Re-admitting backend %s", backend.Target)
+	}
+}
+
+/**
+ * Forget states of backends no longer in pool
+ */
+func (this *OutlierDetector) Sync(backends []*core.Backend) {
+
+	if this == nil {
+		return
+	}
+
+	states := make(map[core.Target]*outlierState)
+	for _, backend := range backends {
+		if state, ok := this.states[backend.Target]; ok {
+			states[backend.Target] = state
+		}
+	}
+
+	this.states = states
+}
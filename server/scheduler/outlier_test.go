@@ -0,0 +1,182 @@
+package scheduler
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+func outlierBackends(n int) []*core.Backend {
+	backends := make([]*core.Backend, n)
+	for i := range backends {
+		backends[i] = &core.Backend{
+			Target: core.Target{Host: "10.0.0." + strconv.Itoa(i+1), Port: "80"},
+			Stats:  core.BackendStats{Live: true},
+		}
+	}
+	return backends
+}
+
+func TestOutlierEjection(t *testing.T) {
+
+	detector := NewOutlierDetector(&config.OutlierDetection{
+		ConsecutiveFailures: 3,
+		MaxEjectionPercent:  100,
+	})
+	backends := outlierBackends(2)
+	backend := backends[0]
+
+	detector.Failure(backend, backends)
+	detector.Failure(backend, backends)
+
+	// success resets consecutive failures
+	detector.Success(backend)
+	detector.Failure(backend, backends)
+	detector.Failure(backend, backends)
+	if backend.Stats.Ejected {
+		t.Fatal("Backend ejected before consecutive failures")
+	}
+
+	detector.Failure(backend, backends)
+	if !backend.Stats.Ejected {
+		t.Fatal("Expected backend to be ejected")
+	}
+	if backends[1].Stats.Ejected {
+		t.Fatal("Expected other backend not to be ejected")
+	}
+}
+
+func TestOutlierFailuresWindow(t *testing.T) {
+
+	detector := NewOutlierDetector(&config.OutlierDetection{
+		ConsecutiveFailures: 2,
+		Interval:            "1m",
+		MaxEjectionPercent:  100,
+	})
+	backends := outlierBackends(1)
+	backend := backends[0]
+
+	detector.Failure(backend, backends)
+
+	// first failure is out of window
+	detector.states[backend.Target].windowStart = time.Now().Add(-2 * time.Minute)
+
+	detector.Failure(backend, backends)
+	if backend.Stats.Ejected {
+		t.Fatal("Expected failures of expired window to be forgotten")
+	}
+
+	detector.Failure(backend, backends)
+	if !backend.Stats.Ejected {
+		t.Fatal("Expected backend to be ejected")
+	}
+}
+
+func TestOutlierExponentialEjectionTime(t *testing.T) {
+
+	detector := NewOutlierDetector(&config.OutlierDetection{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    "10s",
+		MaxEjectionTime:     "30s",
+		MaxEjectionPercent:  100,
+	})
+	backends := outlierBackends(1)
+	backend := backends[0]
+
+	for _, expected := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+
+		start := time.Now()
+		detector.Failure(backend, backends)
+		if !backend.Stats.Ejected {
+			t.Fatal("Expected backend to be ejected")
+		}
+
+		ejectionTime := detector.states[backend.Target].ejectedUntil.Sub(start)
+		if ejectionTime < expected || ejectionTime > expected+time.Second {
+			t.Fatalf("Expected ejection time %s, got %s", expected, ejectionTime)
+		}
+
+		// ejection is over
+		detector.states[backend.Target].ejectedUntil = time.Now()
+		detector.Readmit(backends)
+	}
+
+	// backend healthy longer than max ejection time starts from base again
+	detector.states[backend.Target].ejectedUntil = time.Now().Add(-time.Minute)
+
+	start := time.Now()
+	detector.Failure(backend, backends)
+	if ejectionTime := detector.states[backend.Target].ejectedUntil.Sub(start); ejectionTime > 11*time.Second {
+		t.Fatalf("Expected base ejection time, got %s", ejectionTime)
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+
+	detector := NewOutlierDetector(&config.OutlierDetection{
+		ConsecutiveFailures: 1,
+		MaxEjectionPercent:  50,
+	})
+	backends := outlierBackends(4)
+
+	for _, backend := range backends {
+		detector.Failure(backend, backends)
+	}
+
+	ejected := 0
+	for _, backend := range backends {
+		if backend.Stats.Ejected {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Fatalf("Expected 2 of 4 backends ejected, got %d", ejected)
+	}
+}
+
+func TestOutlierReadmit(t *testing.T) {
+
+	detector := NewOutlierDetector(&config.OutlierDetection{
+		ConsecutiveFailures: 1,
+		MaxEjectionPercent:  100,
+	})
+	backends := outlierBackends(2)
+
+	detector.Failure(backends[0], backends)
+	detector.Failure(backends[1], backends)
+
+	detector.states[backends[0].Target].ejectedUntil = time.Now().Add(-time.Second)
+	detector.Readmit(backends)
+
+	if backends[0].Stats.Ejected {
+		t.Error("Expected backend to be re-admitted after ejection time")
+	}
+	if !backends[1].Stats.Ejected {
+		t.Error("Expected backend to stay ejected until ejection time")
+	}
+
+	// backend without state, e.g. after reload, is re-admitted
+	detector.Sync(backends[:1])
+	detector.Readmit(backends)
+	if backends[1].Stats.Ejected {
+		t.Error("Expected backend without state to be re-admitted")
+	}
+}
+
+func TestOutlierDisabled(t *testing.T) {
+
+	detector := NewOutlierDetector(nil)
+	backends := outlierBackends(1)
+
+	detector.Failure(backends[0], backends)
+	detector.Success(backends[0])
+	detector.Readmit(backends)
+	detector.Sync(backends)
+
+	if backends[0].Stats.Ejected {
+		t.Fatal("Expected disabled detector not to eject")
+	}
+}
@@ -2,9 +2,11 @@ package scheduler
 
 import (
 	"log"
+	"sync"
 	"time"
 
 	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/server/healthcheck"
 	"github.com/millken/tcpwder/server/upstream"
 	"github.com/millken/tcpwder/stats"
 	"github.com/millken/tcpwder/stats/counters"
@@ -24,6 +26,9 @@ const (
 	IncrementRefused
 	IncrementTx
 	IncrementRx
+	IncrementReset
+	ReportSuccess
+	IncrementDropped
 )
 
 /**
@@ -40,10 +45,27 @@ type Op struct {
  */
 type ElectRequest struct {
 	Context  core.Context
+	Exclude  []core.Target
 	Response chan core.Backend
 	Err      chan error
 }
 
+/**
+ * Request to replace balancer, upstream and healthcheck
+ * on configuration reload
+ */
+type ReloadRequest struct {
+	Balancer core.Balancer
+	Upstream *upstream.Upstream
+
+	/* Healthcheck of changed configuration, nil keeps current one */
+	Healthcheck *healthcheck.Healthcheck
+
+	/* Outlier detector of changed configuration, used if OutlierChanged */
+	Outlier        *OutlierDetector
+	OutlierChanged bool
+}
+
 /**
  * Scheduler
  */
@@ -55,6 +77,12 @@ type Scheduler struct {
 	/* Upstream impl */
 	Upstream *upstream.Upstream
 
+	/* Healthcheck impl */
+	Healthcheck *healthcheck.Healthcheck
+
+	/* Passive outlier detection, nil if disabled */
+	Outlier *OutlierDetector
+
 	/* ----- backends ------*/
 
 	/* Current cached backends map */
@@ -63,6 +91,26 @@ type Scheduler struct {
 	/* Current cached backends list (same as backends.list) but preserving order */
 	backendsList []*core.Backend
 
+	/* Last backends got from upstream, before api changes applied */
+	discovered []core.Backend
+
+	/* ----- api changes applied on top of discovered backends ----- */
+
+	/* Backends added by api */
+	added []core.Backend
+
+	/* Backends removed by api */
+	removed map[core.Target]bool
+
+	/* Weight / priority set by api */
+	overrides map[core.Target]core.BackendUpdate
+
+	/* Admin states set by api, active if absent */
+	states map[core.Target]string
+
+	/* Disabled targets, read by connections to drop themselves */
+	disabled *sync.Map
+
 	/* Stats */
 	StatsHandler *stats.Handler
 
@@ -74,8 +122,17 @@ type Scheduler struct {
 	/* Stop channel */
 	stop chan bool
 
+	/* Closed when scheduler is stopped */
+	done chan bool
+
 	/* Elect backend channel */
 	elect chan ElectRequest
+
+	/* Reload channel */
+	reload chan ReloadRequest
+
+	/* Backend management channel */
+	manage chan BackendRequest
 }
 
 /**
@@ -88,12 +145,24 @@ func (this *Scheduler) Start() {
 	this.ops = make(chan Op)
 	this.elect = make(chan ElectRequest)
 	this.stop = make(chan bool)
+	this.done = make(chan bool)
+	this.reload = make(chan ReloadRequest)
+	this.manage = make(chan BackendRequest)
+
+	this.removed = make(map[core.Target]bool)
+	this.overrides = make(map[core.Target]core.BackendUpdate)
+	this.states = make(map[core.Target]string)
+	this.disabled = &sync.Map{}
 
 	this.Upstream.Start()
+	this.Healthcheck.Start()
 
 	// backends stats pusher ticker
 	backendsPushTicker := time.NewTicker(2 * time.Second)
 
+	// upstream closes discover channel when it's done
+	discover := this.Upstream.Discover()
+
 	/**
 	 * Goroutine updates and manages backends
 	 */
@@ -105,6 +174,7 @@ func (this *Scheduler) Start() {
 
 			// push current backends to stats handler
 			case <-backendsPushTicker.C:
+				this.Outlier.Readmit(this.backendsList)
 				this.StatsHandler.Backends <- this.Backends()
 
 			// handle new bandwidth stats of a backend
@@ -114,9 +184,19 @@ func (this *Scheduler) Start() {
 			/* ----- upstream----- */
 
 			// handle newly discovered backends
-			case backends := <-this.Upstream.Discover():
-				this.HandleBackendsUpdate(backends)
-				this.StatsHandler.BackendsCounter.In <- this.Targets()
+			case backends, ok := <-discover:
+				if !ok {
+					discover = nil
+					break
+				}
+				this.discovered = backends
+				this.updateBackends()
+
+			/* ----- healthcheck ----- */
+
+			// handle backend live status change
+			case checkResult := <-this.Healthcheck.Out:
+				this.HandleBackendLiveChange(checkResult.Target, checkResult.Live)
 
 			// handle backend operation
 			case op := <-this.ops:
@@ -126,6 +206,19 @@ func (this *Scheduler) Start() {
 			case electReq := <-this.elect:
 				this.HandleBackendElect(electReq)
 
+			/* ----- api ----- */
+
+			// manage backends
+			case req := <-this.manage:
+				this.HandleBackendRequest(req)
+
+			/* ----- reload ----- */
+
+			// replace balancer, upstream and healthcheck keeping backends stats
+			case reloadReq := <-this.reload:
+				this.HandleReload(reloadReq)
+				discover = this.Upstream.Discover()
+
 			/* ----- stop ----- */
 
 			// handle scheduler stop
@@ -133,6 +226,8 @@ func (this *Scheduler) Start() {
 				log.Printf("Stopping scheduler")
 				backendsPushTicker.Stop()
 				this.Upstream.Stop()
+				this.Healthcheck.Stop()
+				close(this.done)
 				return
 			}
 		}
@@ -193,9 +288,23 @@ func (this *Scheduler) HandleBackendLiveChange(target core.Target, live bool) {
 		return
 	}
 
+	if backend.Stats.Live != live {
+		log.Printf("[INFO] Backend %s live status changed to %t", target, live)
+	}
+
 	backend.Stats.Live = live
 }
 
+/**
+ * Rebuild backends from discovered ones applying api changes
+ * and pass them to healthcheck and stats
+ */
+func (this *Scheduler) updateBackends() {
+	this.HandleBackendsUpdate(this.withApiChanges(this.discovered))
+	this.Healthcheck.In <- this.Targets()
+	this.StatsHandler.BackendsCounter.In <- this.Targets()
+}
+
 /**
  * Update backends map
  */
@@ -217,10 +326,56 @@ func (this *Scheduler) HandleBackendsUpdate(backends []core.Backend) {
 			updated[b.Target] = &b
 			updatedList[i] = &b
 		}
+
+		updatedList[i].Stats.State = this.state(b.Target)
 	}
 
 	this.backends = updated
 	this.backendsList = updatedList
+
+	// rebuild balancer state if it depends on backends pool
+	if u, ok := this.Balancer.(core.BackendsUpdater); ok {
+		u.UpdateBackends(this.backendsList)
+	}
+
+	this.Outlier.Sync(this.backendsList)
+}
+
+/**
+ * Replace balancer, upstream, and healthcheck or outlier detector if changed.
+ * Current backends are kept until new upstream discovers its own.
+ * Their live statuses are reset with new healthcheck, ejections with new
+ * outlier detector, and kept otherwise
+ */
+func (this *Scheduler) HandleReload(req ReloadRequest) {
+
+	this.Upstream.Stop()
+
+	this.Balancer = req.Balancer
+	this.Upstream = req.Upstream
+
+	if req.Healthcheck != nil {
+		this.Healthcheck.Stop()
+		this.Healthcheck = req.Healthcheck
+		for _, b := range this.backendsList {
+			b.Stats.Live = true
+		}
+		this.Healthcheck.Start()
+		this.Healthcheck.In <- this.Targets()
+	}
+
+	if req.OutlierChanged {
+		this.Outlier = req.Outlier
+		for _, b := range this.backendsList {
+			b.Stats.Ejected = false
+		}
+	}
+
+	if u, ok := this.Balancer.(core.BackendsUpdater); ok {
+		u.UpdateBackends(this.backendsList)
+	}
+
+	this.Upstream.Start()
 }
 
 /**
@@ -228,11 +383,18 @@ func (this *Scheduler) HandleBackendsUpdate(backends []core.Backend) {
  */
 func (this *Scheduler) HandleBackendElect(req ElectRequest) {
 
-	// Filter only live backends
+	// Re-admit ejected backends if it's time
+	this.Outlier.Readmit(this.backendsList)
+
+	// Filter only live and not ejected backends
 	var backends []*core.Backend
 	for _, b := range this.backendsList {
 
-		if !b.Stats.Live {
+		if !b.Stats.Live || b.Stats.Ejected || b.Stats.State != core.BACKEND_STATE_ACTIVE {
+			continue
+		}
+
+		if excluded(b.Target, req.Exclude) {
 			continue
 		}
 
@@ -249,6 +411,18 @@ func (this *Scheduler) HandleBackendElect(req ElectRequest) {
 	req.Response <- *backend
 }
 
+/**
+ * Check if target is in exclude list
+ */
+func excluded(target core.Target, exclude []core.Target) bool {
+	for _, t := range exclude {
+		if target.EqualTo(t) {
+			return true
+		}
+	}
+	return false
+}
+
 /**
  * Handle operation on the backend
  */
@@ -274,6 +448,14 @@ func (this *Scheduler) HandleOp(op Op) {
 	switch op.op {
 	case IncrementRefused:
 		backend.Stats.RefusedConnections++
+		this.Outlier.Failure(backend, this.backendsList)
+	case IncrementReset:
+		backend.Stats.ResetConnections++
+		this.Outlier.Failure(backend, this.backendsList)
+	case ReportSuccess:
+		this.Outlier.Success(backend)
+	case IncrementDropped:
+		backend.Stats.DroppedDatagrams++
 	case IncrementConnection:
 		backend.Stats.ActiveConnections++
 		backend.Stats.TotalConnections++
@@ -293,10 +475,18 @@ func (this *Scheduler) Stop() {
 }
 
 /**
- * Take elect backend for proxying
+ * Reload scheduler with new balancer, upstream and healthcheck
+ */
+func (this *Scheduler) Reload(req ReloadRequest) {
+	this.reload <- req
+}
+
+/**
+ * Take elect backend for proxying,
+ * excluding optionally passed targets from election
  */
-func (this *Scheduler) TakeBackend(context core.Context) (*core.Backend, error) {
-	r := ElectRequest{context, make(chan core.Backend), make(chan error)}
+func (this *Scheduler) TakeBackend(context core.Context, exclude ...core.Target) (*core.Backend, error) {
+	r := ElectRequest{context, exclude, make(chan core.Backend), make(chan error)}
 	this.elect <- r
 	select {
 	case err := <-r.Err:
@@ -313,6 +503,27 @@ func (this *Scheduler) IncrementRefused(backend core.Backend) {
 	this.ops <- Op{backend.Target, IncrementRefused, nil}
 }
 
+/**
+ * Increment connection reset count for backend
+ */
+func (this *Scheduler) IncrementReset(backend core.Backend) {
+	this.ops <- Op{backend.Target, IncrementReset, nil}
+}
+
+/**
+ * Increment count of client datagrams to backend dropped because of full queue
+ */
+func (this *Scheduler) IncrementDropped(backend core.Backend) {
+	this.ops <- Op{backend.Target, IncrementDropped, nil}
+}
+
+/**
+ * Report successfully finished connection to backend
+ */
+func (this *Scheduler) ReportSuccess(backend core.Backend) {
+	this.ops <- Op{backend.Target, ReportSuccess, nil}
+}
+
 /**
  * Increment backend connection counter
  */
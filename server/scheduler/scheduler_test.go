@@ -0,0 +1,50 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/server/upstream"
+)
+
+func TestReloadKeepsBackendStatuses(t *testing.T) {
+
+	outlierCfg := &config.OutlierDetection{ConsecutiveFailures: 1, MaxEjectionPercent: 100}
+
+	backend := &core.Backend{
+		Target: core.Target{Host: "10.0.0.1", Port: "80"},
+		Stats:  core.BackendStats{Live: false, Ejected: true},
+	}
+
+	scheduler := &Scheduler{
+		Upstream:     upstream.New(config.Upstream{"10.0.0.1:80"}, config.Discovery{Kind: "static"}),
+		Outlier:      NewOutlierDetector(outlierCfg),
+		backends:     map[core.Target]*core.Backend{backend.Target: backend},
+		backendsList: []*core.Backend{backend},
+	}
+
+	// filters only reload
+	scheduler.HandleReload(ReloadRequest{
+		Upstream: upstream.New(config.Upstream{"10.0.0.1:80"}, config.Discovery{Kind: "static"}),
+		Outlier:  NewOutlierDetector(outlierCfg),
+	})
+	if backend.Stats.Live || !backend.Stats.Ejected {
+		t.Errorf("Backend statuses reset by reload %+v", backend.Stats)
+	}
+
+	// outlier detection changed
+	scheduler.HandleReload(ReloadRequest{
+		Upstream:       upstream.New(config.Upstream{"10.0.0.1:80"}, config.Discovery{Kind: "static"}),
+		Outlier:        nil,
+		OutlierChanged: true,
+	})
+	if backend.Stats.Live || backend.Stats.Ejected {
+		t.Errorf("Unexpected backend statuses after outlier detection change %+v", backend.Stats)
+	}
+	if scheduler.Outlier != nil {
+		t.Error("Outlier detector is not replaced")
+	}
+
+	scheduler.Upstream.Stop()
+}
@@ -0,0 +1,122 @@
+/**
+ * bucket.go - token bucket allowing to go into debt, so
+ * chunks of any size are delayed instead of being refused
+ */
+
+package shaper
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+ * Token bucket, safe for concurrent use
+ */
+type bucket struct {
+	sync.Mutex
+
+	/* Tokens (bytes) per second, unlimited if 0 */
+	rate float64
+
+	/* Bucket size */
+	burst float64
+
+	/* Tokens available, negative if in debt */
+	tokens float64
+
+	/* Time tokens were last refilled */
+	last time.Time
+}
+
+/**
+ * Create new bucket, full
+ */
+func newBucket(rate, burst uint64) *bucket {
+	b := &bucket{}
+	b.configure(rate, burst)
+	return b
+}
+
+/**
+ * Set rate and burst, burst is one second of rate if 0
+ */
+func (this *bucket) configure(rate, burst uint64) {
+	this.Lock()
+	defer this.Unlock()
+
+	if burst == 0 {
+		burst = rate
+	}
+
+	// bucket was unlimited, start full
+	if this.rate == 0 {
+		this.tokens = float64(burst)
+		this.last = time.Time{}
+	}
+
+	this.rate = float64(rate)
+	this.burst = float64(burst)
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+}
+
+/**
+ * Returns max bytes taken at once without waiting longer
+ * than a burst takes, size if bucket is unlimited
+ */
+func (this *bucket) chunk(size int) int {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.rate == 0 || float64(size) <= this.burst {
+		return size
+	}
+	if this.burst < 1 {
+		return 1
+	}
+	return int(this.burst)
+}
+
+/**
+ * Check if bucket is refilled to burst, unlimited bucket is always full
+ */
+func (this *bucket) full(now time.Time) bool {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.rate == 0 || this.last.IsZero() {
+		return true
+	}
+
+	return this.tokens+now.Sub(this.last).Seconds()*this.rate >= this.burst
+}
+
+/**
+ * Take n tokens, returns how long to wait until debt is paid
+ */
+func (this *bucket) take(n int) time.Duration {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.rate == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	if !this.last.IsZero() {
+		this.tokens += now.Sub(this.last).Seconds() * this.rate
+		if this.tokens > this.burst {
+			this.tokens = this.burst
+		}
+	}
+	this.last = now
+
+	this.tokens -= float64(n)
+	if this.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-this.tokens / this.rate * float64(time.Second))
+}
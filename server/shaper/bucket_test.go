@@ -0,0 +1,78 @@
+package shaper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketUnlimited(t *testing.T) {
+
+	b := newBucket(0, 0)
+
+	if d := b.take(1 << 20); d != 0 {
+		t.Fatalf("Expected no wait, got %s", d)
+	}
+	if n := b.chunk(1 << 20); n != 1<<20 {
+		t.Fatalf("Expected whole chunk, got %d", n)
+	}
+	if !b.full(time.Now()) {
+		t.Fatal("Expected unlimited bucket to be full")
+	}
+}
+
+func TestBucketDebt(t *testing.T) {
+
+	b := newBucket(1000, 100)
+
+	if n := b.chunk(500); n != 100 {
+		t.Fatalf("Expected chunk of burst size, got %d", n)
+	}
+	if n := b.chunk(50); n != 50 {
+		t.Fatalf("Expected chunk smaller than burst to be kept, got %d", n)
+	}
+
+	if d := b.take(100); d != 0 {
+		t.Fatalf("Expected burst to be taken without wait, got %s", d)
+	}
+
+	// 100 bytes in debt at 1000 bytes per second
+	d := b.take(100)
+	if d <= 50*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("Expected about 100ms wait, got %s", d)
+	}
+}
+
+func TestBucketFull(t *testing.T) {
+
+	b := newBucket(1000, 100)
+	if !b.full(time.Now()) {
+		t.Fatal("Expected new bucket to be full")
+	}
+
+	b.take(100)
+	now := time.Now()
+	if b.full(now) {
+		t.Fatal("Expected drained bucket not to be full")
+	}
+	if !b.full(now.Add(100 * time.Millisecond)) {
+		t.Fatal("Expected bucket to be full after refill")
+	}
+}
+
+func TestBucketConfigure(t *testing.T) {
+
+	b := newBucket(1000, 0)
+	if b.burst != 1000 || b.tokens != 1000 {
+		t.Fatalf("Expected one second of rate burst, got %v with %v tokens", b.burst, b.tokens)
+	}
+
+	b.configure(1000, 10)
+	if b.tokens != 10 {
+		t.Fatalf("Expected tokens to be capped by new burst, got %v", b.tokens)
+	}
+
+	b.configure(0, 0)
+	if d := b.take(1000); d != 0 {
+		t.Fatalf("Expected unlimited bucket not to wait, got %s", d)
+	}
+}
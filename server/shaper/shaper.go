@@ -0,0 +1,270 @@
+/**
+ * shaper.go - token bucket bandwidth shaping of connection,
+ * client ip and server scope. Fast clients are slowed down
+ * by delaying reads instead of being dropped
+ */
+
+package shaper
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+)
+
+/**
+ * How often buckets of disconnected client ips are checked
+ */
+const IP_BUCKETS_SWEEP_INTERVAL = time.Second
+
+/**
+ * Direction of traffic
+ */
+type Direction int
+
+const (
+
+	/* Client to backend */
+	UPLOAD Direction = iota
+
+	/* Backend to client */
+	DOWNLOAD
+)
+
+/**
+ * Upload and download buckets of one scope
+ */
+type buckets [2]*bucket
+
+func newBuckets(cfg *config.Bandwidth) buckets {
+	b := buckets{newBucket(0, 0), newBucket(0, 0)}
+	b.configure(cfg)
+	return b
+}
+
+func (this buckets) configure(cfg *config.Bandwidth) {
+	if cfg == nil {
+		cfg = &config.Bandwidth{}
+	}
+	this[UPLOAD].configure(cfg.Upload, cfg.UploadBurst)
+	this[DOWNLOAD].configure(cfg.Download, cfg.DownloadBurst)
+}
+
+func (this buckets) full(now time.Time) bool {
+	return this[UPLOAD].full(now) && this[DOWNLOAD].full(now)
+}
+
+/**
+ * Buckets shared by connections of the same client ip
+ */
+type ipBuckets struct {
+	buckets buckets
+
+	/* Connections using buckets */
+	refs int
+}
+
+/**
+ * Shaper of server connections, safe for concurrent use
+ */
+type Shaper struct {
+	sync.Mutex
+
+	cfg config.Shaping
+
+	/* Server scope buckets */
+	server buckets
+
+	/* Per client ip buckets, kept after disconnect until full again */
+	perIp map[string]*ipBuckets
+
+	/* Time buckets of disconnected client ips were last checked */
+	lastSweep time.Time
+
+	/* Active connections, to reconfigure their buckets on reload */
+	connections map[*Connection]bool
+}
+
+/**
+ * Shaped connection of a client
+ */
+type Connection struct {
+	shaper *Shaper
+	host   string
+
+	/* Connection, client ip and server scope buckets */
+	buckets [3]buckets
+
+	/* Closed on disconnect, waking up waiting reads */
+	done chan bool
+	once sync.Once
+}
+
+/**
+ * Check bandwidth limits
+ */
+func validate(cfg *config.Bandwidth) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.UploadBurst > 0 && cfg.Upload == 0 {
+		return errors.New("upload_burst requires upload")
+	}
+	if cfg.DownloadBurst > 0 && cfg.Download == 0 {
+		return errors.New("download_burst requires download")
+	}
+	return nil
+}
+
+/**
+ * Create shaper from configuration, not limiting anything if nil
+ */
+func New(cfg *config.Shaping) (*Shaper, error) {
+
+	if cfg == nil {
+		cfg = &config.Shaping{}
+	}
+
+	for _, b := range []*config.Bandwidth{cfg.Connection, cfg.PerIp, cfg.Server} {
+		if err := validate(b); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Shaper{
+		cfg:         *cfg,
+		server:      newBuckets(cfg.Server),
+		perIp:       make(map[string]*ipBuckets),
+		connections: make(map[*Connection]bool),
+	}, nil
+}
+
+/**
+ * Apply new configuration to server, client ips and active
+ * connections buckets. Keeps current one if new one is invalid
+ */
+func (this *Shaper) Reload(cfg *config.Shaping) {
+
+	shaper, err := New(cfg)
+	if err != nil {
+		log.Printf("[ERROR] shaping: %s", err)
+		return
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	this.cfg = shaper.cfg
+	this.server.configure(this.cfg.Server)
+	for _, ip := range this.perIp {
+		ip.buckets.configure(this.cfg.PerIp)
+	}
+	for conn := range this.connections {
+		conn.buckets[0].configure(this.cfg.Connection)
+	}
+}
+
+/**
+ * Start shaping connection of client host
+ */
+func (this *Shaper) Connect(host string) *Connection {
+
+	this.Lock()
+	defer this.Unlock()
+
+	this.sweep(time.Now())
+
+	ip, ok := this.perIp[host]
+	if !ok {
+		ip = &ipBuckets{buckets: newBuckets(this.cfg.PerIp)}
+		this.perIp[host] = ip
+	}
+	ip.refs++
+
+	conn := &Connection{
+		shaper:  this,
+		host:    host,
+		buckets: [3]buckets{newBuckets(this.cfg.Connection), ip.buckets, this.server},
+		done:    make(chan bool),
+	}
+	this.connections[conn] = true
+
+	return conn
+}
+
+/**
+ * Returns how many bytes of size should be read at once,
+ * so that a single read never waits longer than a burst takes
+ */
+func (this *Connection) Chunk(direction Direction, size int) int {
+	for _, b := range this.buckets {
+		size = b[direction].chunk(size)
+	}
+	return size
+}
+
+/**
+ * Take n bytes from all scopes, waiting until the slowest one allows
+ * them or connection is disconnected
+ */
+func (this *Connection) Wait(direction Direction, n int) {
+
+	var delay time.Duration
+	for _, b := range this.buckets {
+		if d := b[direction].take(n); d > delay {
+			delay = d
+		}
+	}
+
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-this.done:
+	}
+}
+
+/**
+ * Stop shaping connection, can be called more than once
+ */
+func (this *Connection) Disconnect() {
+	this.once.Do(func() {
+		close(this.done)
+
+		this.shaper.Lock()
+		defer this.shaper.Unlock()
+
+		delete(this.shaper.connections, this)
+		if ip := this.shaper.perIp[this.host]; ip != nil {
+			ip.refs--
+		}
+		this.shaper.sweep(time.Now())
+	})
+}
+
+/**
+ * Drop buckets of client ips without connections once they are full,
+ * so a client can't refill its burst by reconnecting.
+ * Should be called holding shaper lock
+ */
+func (this *Shaper) sweep(now time.Time) {
+
+	if now.Sub(this.lastSweep) < IP_BUCKETS_SWEEP_INTERVAL {
+		return
+	}
+	this.lastSweep = now
+
+	for host, ip := range this.perIp {
+		if ip.refs <= 0 && ip.buckets.full(now) {
+			delete(this.perIp, host)
+		}
+	}
+}
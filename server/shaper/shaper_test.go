@@ -0,0 +1,125 @@
+package shaper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+)
+
+func perIpShaper(t *testing.T) *Shaper {
+	s, err := New(&config.Shaping{
+		PerIp: &config.Bandwidth{Upload: 1000, Download: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNewValidates(t *testing.T) {
+
+	if _, err := New(&config.Shaping{Server: &config.Bandwidth{UploadBurst: 10}}); err == nil {
+		t.Fatal("Expected upload_burst without upload to fail")
+	}
+	if _, err := New(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectionsShareIpBuckets(t *testing.T) {
+
+	s := perIpShaper(t)
+
+	a := s.Connect("10.0.0.1")
+	b := s.Connect("10.0.0.1")
+	c := s.Connect("10.0.0.2")
+	defer a.Disconnect()
+	defer b.Disconnect()
+	defer c.Disconnect()
+
+	if a.buckets[1][UPLOAD] != b.buckets[1][UPLOAD] {
+		t.Fatal("Expected connections of the same ip to share buckets")
+	}
+	if a.buckets[1][UPLOAD] == c.buckets[1][UPLOAD] {
+		t.Fatal("Expected connections of different ips not to share buckets")
+	}
+	if a.buckets[2][UPLOAD] != c.buckets[2][UPLOAD] {
+		t.Fatal("Expected connections to share server buckets")
+	}
+}
+
+func TestReconnectKeepsIpBuckets(t *testing.T) {
+
+	s := perIpShaper(t)
+
+	conn := s.Connect("10.0.0.1")
+	conn.Wait(UPLOAD, 1000)
+	drained := conn.buckets[1]
+	conn.Disconnect()
+
+	conn = s.Connect("10.0.0.1")
+	if conn.buckets[1] != drained {
+		t.Fatal("Expected drained ip buckets to be kept after reconnect")
+	}
+	conn.Disconnect()
+
+	// refilled buckets are dropped on next sweep
+	drained[UPLOAD].Lock()
+	drained[UPLOAD].last = drained[UPLOAD].last.Add(-2 * time.Second)
+	drained[UPLOAD].Unlock()
+
+	s.Lock()
+	s.lastSweep = time.Time{}
+	s.sweep(time.Now())
+	_, ok := s.perIp["10.0.0.1"]
+	s.Unlock()
+
+	if ok {
+		t.Fatal("Expected full ip buckets without connections to be dropped")
+	}
+}
+
+func TestWaitReturnsOnDisconnect(t *testing.T) {
+
+	s := perIpShaper(t)
+	conn := s.Connect("10.0.0.1")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.Disconnect()
+	}()
+
+	start := time.Now()
+	conn.Wait(DOWNLOAD, 100000)
+	if time.Since(start) > time.Second {
+		t.Fatal("Expected wait to return on disconnect")
+	}
+
+	// second disconnect is noop
+	conn.Disconnect()
+}
+
+func TestReloadReconfiguresBuckets(t *testing.T) {
+
+	s := perIpShaper(t)
+	conn := s.Connect("10.0.0.1")
+	defer conn.Disconnect()
+
+	s.Reload(&config.Shaping{
+		Connection: &config.Bandwidth{Upload: 10},
+	})
+
+	if conn.buckets[0][UPLOAD].rate != 10 {
+		t.Fatalf("Expected connection bucket to be reconfigured, got rate %v", conn.buckets[0][UPLOAD].rate)
+	}
+	if conn.buckets[1][UPLOAD].rate != 0 {
+		t.Fatalf("Expected ip bucket to be unlimited, got rate %v", conn.buckets[1][UPLOAD].rate)
+	}
+
+	// invalid configuration is ignored
+	s.Reload(&config.Shaping{Connection: &config.Bandwidth{UploadBurst: 10}})
+	if conn.buckets[0][UPLOAD].rate != 10 {
+		t.Fatal("Expected invalid configuration to be ignored")
+	}
+}
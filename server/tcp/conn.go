@@ -0,0 +1,46 @@
+package tcp
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+/**
+ * Backend connection remembering if it was reset by the peer.
+ * Writes to the connection closed by the peer (broken pipe) count as
+ * reset too. Backend closing connection gracefully or timing out is not
+ * tracked
+ */
+type trackedConn struct {
+	net.Conn
+
+	/* 1 if connection was reset or pipe was broken */
+	reset int32
+}
+
+func (this *trackedConn) Read(b []byte) (int, error) {
+	n, err := this.Conn.Read(b)
+	this.track(err)
+	return n, err
+}
+
+func (this *trackedConn) Write(b []byte) (int, error) {
+	n, err := this.Conn.Write(b)
+	this.track(err)
+	return n, err
+}
+
+func (this *trackedConn) track(err error) {
+	if err != nil && (errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)) {
+		atomic.StoreInt32(&this.reset, 1)
+	}
+}
+
+/**
+ * Check if connection was reset by the peer or pipe was broken
+ */
+func (this *trackedConn) IsReset() bool {
+	return atomic.LoadInt32(&this.reset) == 1
+}
@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/server/filter"
+	"github.com/millken/tcpwder/server/shaper"
 )
 
 const (
@@ -22,7 +24,7 @@ const (
  * Perform copy/proxy data from 'from' to 'to' socket, counting r/w stats and
  * dropping connection if timeout exceeded
  */
-func (this *Server) proxy(to net.Conn, from net.Conn, timeout time.Duration, isIn bool) <-chan core.ReadWriteCount {
+func (this *Server) proxy(to net.Conn, from net.Conn, filterConn *filter.Connection, shapedConn *shaper.Connection, timeout time.Duration, isIn bool) <-chan core.ReadWriteCount {
 
 	stats := make(chan core.ReadWriteCount)
 	outStats := make(chan core.ReadWriteCount)
@@ -75,7 +77,7 @@ func (this *Server) proxy(to net.Conn, from net.Conn, timeout time.Duration, isI
 
 	// Run proxy copier
 	go func() {
-		err := this.Copy(to, from, stats, isIn)
+		err := this.Copy(to, from, stats, filterConn, shapedConn, isIn)
 		// hack to determine normal close. TODO: fix when it will be exposed in golang
 		e, ok := err.(*net.OpError)
 		if err != nil && (!ok || e.Err.Error() != "use of closed network connection") {
@@ -85,6 +87,9 @@ func (this *Server) proxy(to net.Conn, from net.Conn, timeout time.Duration, isI
 		to.Close()
 		from.Close()
 
+		// Wake up other direction waiting in shaper
+		shapedConn.Disconnect()
+
 		// Stop stats collecting goroutine
 		close(stats)
 	}()
@@ -95,21 +100,33 @@ func (this *Server) proxy(to net.Conn, from net.Conn, timeout time.Duration, isI
 /**
  * It's build by analogy of io.Copy
  */
-func (this *Server) Copy(to io.Writer, from io.Reader, ch chan<- core.ReadWriteCount, isIn bool) error {
+func (this *Server) Copy(to io.Writer, from io.Reader, ch chan<- core.ReadWriteCount, filterConn *filter.Connection, shapedConn *shaper.Connection, isIn bool) error {
 
 	buf := make([]byte, BUFFER_SIZE)
 	var err error = nil
 
+	direction := shaper.UPLOAD
+	if isIn {
+		direction = shaper.DOWNLOAD
+	}
+
 	for {
-		readN, readErr := from.Read(buf)
+		readN, readErr := from.Read(buf[0:shapedConn.Chunk(direction, len(buf))])
 
 		if readN > 0 {
+			// isIn copies backend response to the client
 			if isIn {
-				if err = this.filter.HandleClientRequest(buf); err != nil {
-					return err
-				}
+				err = filterConn.Response(buf[0:readN])
+			} else {
+				err = filterConn.Request(buf[0:readN])
+			}
+			if err != nil {
+				return err
 			}
 
+			// Wait for bandwidth, delaying the next read too
+			shapedConn.Wait(direction, readN)
+
 			writeN, writeErr := to.Write(buf[0:readN])
 
 			if writeN > 0 {
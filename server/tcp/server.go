@@ -2,25 +2,39 @@ package tcp
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
 	"log"
 	"net"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/millken/tcpwder/balance"
 	"github.com/millken/tcpwder/config"
 	"github.com/millken/tcpwder/core"
 	"github.com/millken/tcpwder/firewall"
+	"github.com/millken/tcpwder/proxyprotocol"
 	"github.com/millken/tcpwder/server/filter"
+	"github.com/millken/tcpwder/server/healthcheck"
 	"github.com/millken/tcpwder/server/scheduler"
+	"github.com/millken/tcpwder/server/shaper"
 	"github.com/millken/tcpwder/server/upstream"
 	"github.com/millken/tcpwder/stats"
 	"github.com/millken/tcpwder/tls/sni"
+	"github.com/millken/tcpwder/upgrade"
 	"github.com/millken/tcpwder/utils"
 	tlsutil "github.com/millken/tcpwder/utils/tls"
 )
 
+/**
+ * Request to start draining.
+ * Drained channel is closed when no active connections left
+ */
+type drainRequest struct {
+	status  core.DrainStatus
+	drained chan bool
+}
+
 type Server struct {
 
 	/* Server friendly name */
@@ -29,8 +43,9 @@ type Server struct {
 	/* Listener */
 	listener net.Listener
 
-	/* Configuration */
-	cfg config.Server
+	/* Configuration, replaced on reload while connections read it */
+	cfg      config.Server
+	cfgMutex sync.RWMutex
 
 	/*scheduler deals with upstream */
 	scheduler scheduler.Scheduler
@@ -47,14 +62,36 @@ type Server struct {
 	/* Channel for dropping connections or connectons to drop */
 	disconnect chan (net.Conn)
 
+	/* Channel for configuration reloads */
+	reload chan (config.Server)
+
+	/* Channel for drain requests */
+	drain chan (drainRequest)
+
+	/* Closed when draining server has no active connections, nil if not draining */
+	drained chan bool
+
+	/* Drain progress, nil if not draining */
+	drainStatus *core.DrainStatus
+	drainMutex  sync.Mutex
+
 	/* Stop channel */
 	stop chan bool
 
+	/* Closed when server is stopped */
+	done chan bool
+
 	/* Tls config used to connect to backends */
 	backendsTlsConfg *tls.Config
 
 	/* filter */
 	filter *filter.Filter
+
+	/* Bandwidth shaper */
+	shaper *shaper.Shaper
+
+	/* Sources allowed to send PROXY protocol header, none if empty */
+	proxyProtocolTrusted []*net.IPNet
 }
 
 /**
@@ -64,6 +101,31 @@ func New(name string, cfg config.Server) (*Server, error) {
 
 	var err error = nil
 
+	/* Add backend tls config if needed */
+	var backendsTlsConfig *tls.Config
+	if cfg.BackendsTls != nil {
+		backendsTlsConfig, err = tlsutil.PrepareBackendsTlsConfig(*cfg.BackendsTls)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	/* Parse PROXY protocol trusted sources */
+	var proxyProtocolTrusted []*net.IPNet
+	for _, cidr := range cfg.ProxyProtocolTrusted {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		proxyProtocolTrusted = append(proxyProtocolTrusted, ipNet)
+	}
+
+	/* Create bandwidth shaper */
+	bandwidthShaper, err := shaper.New(cfg.Shaping)
+	if err != nil {
+		return nil, err
+	}
+
 	statsHandler := stats.NewHandler(name)
 
 	// Create server
@@ -71,24 +133,24 @@ func New(name string, cfg config.Server) (*Server, error) {
 		name:         name,
 		cfg:          cfg,
 		stop:         make(chan bool),
+		done:         make(chan bool),
+		reload:       make(chan config.Server),
+		drain:        make(chan drainRequest),
 		disconnect:   make(chan net.Conn),
 		connect:      make(chan *core.TcpContext),
 		clients:      make(map[string]net.Conn),
 		statsHandler: statsHandler,
 		scheduler: scheduler.Scheduler{
-			Balancer:     balance.New(cfg.Sni, cfg.Balance),
-			Upstream:     upstream.New(cfg.Upstream),
+			Balancer:     balance.New(cfg),
+			Upstream:     upstream.New(cfg.Upstream, *cfg.Discovery),
+			Healthcheck:  healthcheck.New(*cfg.Healthcheck, backendsTlsConfig),
+			Outlier:      scheduler.NewOutlierDetector(cfg.OutlierDetection),
 			StatsHandler: statsHandler,
 		},
-		filter: filter.New(cfg),
-	}
-
-	/* Add backend tls config if needed */
-	if cfg.BackendsTls != nil {
-		server.backendsTlsConfg, err = prepareBackendsTlsConfig(cfg)
-		if err != nil {
-			return nil, err
-		}
+		filter:               filter.New(cfg),
+		shaper:               bandwidthShaper,
+		backendsTlsConfg:     backendsTlsConfig,
+		proxyProtocolTrusted: proxyProtocolTrusted,
 	}
 
 	log.Printf("[INFO] Creating '%s': %s %s", name, cfg.Bind, cfg.Balance)
@@ -100,9 +162,18 @@ func New(name string, cfg config.Server) (*Server, error) {
  * Returns current server configuration
  */
 func (this *Server) Cfg() config.Server {
+	this.cfgMutex.RLock()
+	defer this.cfgMutex.RUnlock()
 	return this.cfg
 }
 
+/**
+ * Returns backends manager
+ */
+func (this *Server) Backends() core.BackendsManager {
+	return &this.scheduler
+}
+
 /**
  * Start server
  */
@@ -118,17 +189,25 @@ func (this *Server) Start() error {
 			case ctx := <-this.connect:
 				this.HandleClientConnect(ctx)
 
+			case cfg := <-this.reload:
+				this.HandleReload(cfg)
+
+			case req := <-this.drain:
+				this.HandleDrain(req)
+
 			case <-this.stop:
 				this.scheduler.Stop()
 				this.statsHandler.Stop()
 				this.filter.Stop()
 				if this.listener != nil {
+					upgrade.Forget(this.listener)
 					this.listener.Close()
 					for _, conn := range this.clients {
 						conn.Close()
 					}
 				}
 				this.clients = make(map[string]net.Conn)
+				close(this.done)
 				return
 			}
 		}
@@ -152,14 +231,51 @@ func (this *Server) Start() error {
 	return nil
 }
 
+/**
+ * Reload upstream, balancer and filters from configuration.
+ * Listener and active connections are kept
+ */
+func (this *Server) Reload(cfg config.Server) error {
+	this.reload <- cfg
+	return nil
+}
+
+/**
+ * Replace scheduler parts and filters with ones of new configuration
+ */
+func (this *Server) HandleReload(cfg config.Server) {
+
+	log.Printf("[INFO] Reloading '%s': %s %s", this.name, cfg.Bind, cfg.Balance)
+
+	previous := this.Cfg()
+
+	// unchanged healthcheck and outlier detector keep backends statuses
+	req := scheduler.ReloadRequest{
+		Balancer:       balance.New(cfg),
+		Upstream:       upstream.New(cfg.Upstream, *cfg.Discovery),
+		Outlier:        scheduler.NewOutlierDetector(cfg.OutlierDetection),
+		OutlierChanged: !reflect.DeepEqual(previous.OutlierDetection, cfg.OutlierDetection),
+	}
+	if !reflect.DeepEqual(previous.Healthcheck, cfg.Healthcheck) {
+		req.Healthcheck = healthcheck.New(*cfg.Healthcheck, this.backendsTlsConfg)
+	}
+	this.scheduler.Reload(req)
+	this.filter.Reload(cfg)
+	this.shaper.Reload(cfg.Shaping)
+
+	this.cfgMutex.Lock()
+	this.cfg = cfg
+	this.cfgMutex.Unlock()
+}
+
 /**
  * Handle client disconnection
  */
 func (this *Server) HandleClientDisconnect(client net.Conn) {
-	this.filter.HandleClientDisconnect(client)
 	client.Close()
 	delete(this.clients, client.RemoteAddr().String())
 	this.statsHandler.Connections <- uint(len(this.clients))
+	this.updateDrain()
 }
 
 /**
@@ -174,27 +290,120 @@ func (this *Server) HandleClientConnect(ctx *core.TcpContext) {
 		client.Close()
 		return
 	}
-	if err := this.filter.HandleClientConnect(client); err != nil {
+	filterConn, err := this.filter.HandleClientConnect(ctx)
+	if err != nil {
 		log.Printf("[WARN] handle client connect: %s, %s", host, err)
 		client.Close()
 		return
 	}
+	if ctx.Geo != nil {
+		log.Printf("[DEBUG] Client %s geo %s %s", host, ctx.Geo, ctx.Geo.Organization)
+	}
 	/*
 		if *this.cfg.MaxConnections != 0 && len(this.clients) >= *this.cfg.MaxConnections {
 			log.Printf("[WARN] Too many connections to %s", this.cfg.Bind)
 			client.Close()
 			return
 		}
-
-		this.clients[client.RemoteAddr().String()] = client
 	*/
+	this.clients[client.RemoteAddr().String()] = client
 	this.statsHandler.Connections <- uint(len(this.clients))
+	this.updateDrain()
+	shapedConn := this.shaper.Connect(host)
 	go func() {
-		this.handle(ctx)
-		this.disconnect <- client
+		this.handle(ctx, filterConn, shapedConn)
+		shapedConn.Disconnect()
+		filterConn.Disconnect()
+		select {
+		case this.disconnect <- client:
+		case <-this.done:
+		}
 	}()
 }
 
+/**
+ * Stop accepting new connections and start waiting for active ones to finish
+ */
+func (this *Server) HandleDrain(req drainRequest) {
+	if this.listener != nil {
+		upgrade.Forget(this.listener)
+		this.listener.Close()
+	}
+
+	this.drained = req.drained
+
+	this.drainMutex.Lock()
+	this.drainStatus = &req.status
+	this.drainMutex.Unlock()
+
+	this.updateDrain()
+}
+
+/**
+ * Update drain progress, notifying when no active connections left
+ */
+func (this *Server) updateDrain() {
+	if this.drained == nil {
+		return
+	}
+
+	this.drainMutex.Lock()
+	this.drainStatus.ActiveConnections = uint(len(this.clients))
+	this.drainMutex.Unlock()
+
+	if len(this.clients) == 0 {
+		close(this.drained)
+		this.drained = nil
+	}
+}
+
+/**
+ * Drain, waiting for active connections up to drain timeout,
+ * then stop dropping ones left
+ */
+func (this *Server) Drain() {
+
+	timeout := utils.ParseDurationOrDefault(*this.Cfg().DrainTimeout, 0)
+
+	if timeout > 0 {
+		log.Printf("[INFO] Draining %s for up to %s", this.name, timeout)
+
+		now := time.Now()
+		drained := make(chan bool)
+		this.drain <- drainRequest{
+			status: core.DrainStatus{
+				Started:  now,
+				Deadline: now.Add(timeout),
+			},
+			drained: drained,
+		}
+
+		select {
+		case <-drained:
+			log.Printf("[INFO] Drained %s", this.name)
+		case <-time.After(timeout):
+			log.Printf("[WARN] Drain timeout for %s, dropping active connections", this.name)
+		}
+	}
+
+	this.Stop()
+}
+
+/**
+ * Returns drain progress, nil if server is not draining
+ */
+func (this *Server) DrainStatus() *core.DrainStatus {
+	this.drainMutex.Lock()
+	defer this.drainMutex.Unlock()
+
+	if this.drainStatus == nil {
+		return nil
+	}
+
+	status := *this.drainStatus
+	return &status
+}
+
 /**
  * Stop, dropping all connections
  */
@@ -203,6 +412,7 @@ func (this *Server) Stop() {
 	log.Printf("Stopping %s", this.name)
 
 	this.stop <- true
+	<-this.done
 }
 
 /**
@@ -210,17 +420,19 @@ func (this *Server) Stop() {
  */
 func (this *Server) Listen() (err error) {
 
-	// create tcp listener
-	this.listener, err = net.Listen("tcp", this.cfg.Bind)
+	cfg := this.Cfg()
+
+	// create tcp listener, taking over one inherited on upgrade
+	this.listener, err = upgrade.Listen(cfg.Bind)
 
 	var tlsConfig *tls.Config
-	sniEnabled := this.cfg.Sni != nil
+	sniEnabled := cfg.Sni != nil
 
-	if this.cfg.Protocol == "tls" {
+	if cfg.Protocol == "tls" {
 
 		// Create tls listener
 		var crt tls.Certificate
-		if crt, err = tls.LoadX509KeyPair(this.cfg.Tls.CertPath, this.cfg.Tls.KeyPath); err != nil {
+		if crt, err = tls.LoadX509KeyPair(cfg.Tls.CertPath, cfg.Tls.KeyPath); err != nil {
 			log.Printf("[ERROR] %s", err)
 			return err
 		}
@@ -232,7 +444,7 @@ func (this *Server) Listen() (err error) {
 	}
 
 	if err != nil {
-		log.Printf("[ERROR] Error starting %s server: %s", this.cfg.Protocol, err)
+		log.Printf("[ERROR] Error starting %s server: %s", cfg.Protocol, err)
 		return err
 	}
 
@@ -257,9 +469,30 @@ func (this *Server) wrap(conn net.Conn, sniEnabled bool, tlsConfig *tls.Config)
 	var hostname string
 	var err error
 
+	cfg := this.Cfg()
+
+	if cfg.AcceptProxyProtocol {
+		if !this.proxyProtocolTrusts(conn.RemoteAddr()) {
+			log.Printf("[WARN] PROXY protocol header from untrusted source %s", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+
+		var ppConn net.Conn
+		ppConn, err = proxyprotocol.Accept(conn, utils.ParseDurationOrDefault(cfg.ProxyProtocolReadTimeout, time.Second*5))
+
+		if err != nil {
+			log.Printf("[ERROR] Failed to read PROXY protocol header from %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+
+		conn = ppConn
+	}
+
 	if sniEnabled {
 		var sniConn net.Conn
-		sniConn, hostname, err = sni.Sniff(conn, utils.ParseDurationOrDefault(this.cfg.Sni.ReadTimeout, time.Second*2))
+		sniConn, hostname, err = sni.Sniff(conn, utils.ParseDurationOrDefault(cfg.Sni.ReadTimeout, time.Second*2))
 
 		if err != nil {
 			log.Printf("[ERROR] Failed to get / parse ClientHello for sni: %s", err)
@@ -274,53 +507,189 @@ func (this *Server) wrap(conn net.Conn, sniEnabled bool, tlsConfig *tls.Config)
 		conn = tls.Server(conn, tlsConfig)
 	}
 
-	this.connect <- &core.TcpContext{
-		hostname,
-		conn,
+	select {
+	case this.connect <- &core.TcpContext{
+		Hostname: hostname,
+		Conn:     conn,
+	}:
+	case <-this.done:
+		conn.Close()
 	}
 
 }
 
 /**
- * Handle incoming connection and prox it to backend
+ * Check if source is allowed to send PROXY protocol header
  */
-func (this *Server) handle(ctx *core.TcpContext) {
-	clientConn := ctx.Conn
+func (this *Server) proxyProtocolTrusts(addr net.Addr) bool {
 
-	log.Printf("[DEBUG] Accepted %s -> %s", clientConn.RemoteAddr(), this.listener.Addr())
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
 
-	/* Find out backend for proxying */
-	var err error
-	backend, err := this.scheduler.TakeBackend(ctx)
+	for _, ipNet := range this.proxyProtocolTrusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * Connect to backend, sending PROXY protocol header if needed
+ */
+func (this *Server) dial(backend *core.Backend, ctx *core.TcpContext, cfg config.Server) (net.Conn, error) {
+
+	timeout := utils.ParseDurationOrDefault(*cfg.BackendConnectionTimeout, 0)
+
+	if cfg.SendProxyProtocol == "" {
+		if cfg.BackendsTls != nil {
+			return tls.DialWithDialer(&net.Dialer{
+				Timeout: timeout,
+			}, "tcp", backend.Address(), this.backendsTlsConfg)
+		}
+
+		return net.DialTimeout("tcp", backend.Address(), timeout)
+	}
+
+	conn, err := net.DialTimeout("tcp", backend.Address(), timeout)
 	if err != nil {
-		log.Printf("[ERROR] %s, Closing connection ", err, clientConn.RemoteAddr())
-		return
+		return nil, err
 	}
-	log.Printf("[DEBUG] backend %+v", backend)
 
-	/* Connect to backend */
-	var backendConn net.Conn
+	/* PROXY protocol header goes before anything else, including tls handshake */
+	if err = this.writeProxyProtocolHeader(conn, ctx, cfg.SendProxyProtocol); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if cfg.BackendsTls == nil {
+		return conn, nil
+	}
+
+	tlsConfig := this.backendsTlsConfg
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = strings.Trim(backend.Host, "[]")
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+/**
+ * Write PROXY protocol header with client addresses to backend connection
+ */
+func (this *Server) writeProxyProtocolHeader(conn net.Conn, ctx *core.TcpContext, sendProxyProtocol string) error {
 
-	if this.cfg.BackendsTls != nil {
-		backendConn, err = tls.DialWithDialer(&net.Dialer{
-			Timeout: utils.ParseDurationOrDefault(*this.cfg.BackendConnectionTimeout, 0),
-		}, "tcp", backend.Address(), this.backendsTlsConfg)
+	header := &proxyprotocol.Header{
+		SourceAddr:      ctx.Conn.RemoteAddr(),
+		DestinationAddr: ctx.Conn.LocalAddr(),
+		TLVs:            map[byte][]byte{},
+	}
 
-	} else {
-		backendConn, err = net.DialTimeout("tcp", backend.Address(), utils.ParseDurationOrDefault(*this.cfg.BackendConnectionTimeout, 0))
+	if ctx.Hostname != "" {
+		header.TLVs[proxyprotocol.V2_TYPE_AUTHORITY] = []byte(ctx.Hostname)
 	}
+
+	version := 1
+	if sendProxyProtocol == "v2" {
+		version = 2
+	}
+
+	data, err := header.Format(version)
 	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(data)
+	return err
+}
+
+/**
+ * Handle incoming connection and prox it to backend
+ */
+func (this *Server) handle(ctx *core.TcpContext, filterConn *filter.Connection, shapedConn *shaper.Connection) {
+	clientConn := ctx.Conn
+
+	log.Printf("[DEBUG] Accepted %s -> %s", clientConn.RemoteAddr(), this.listener.Addr())
+
+	/* Find out backend for proxying and connect to it, retrying with other backends */
+	var err error
+	var backend *core.Backend
+	var backendConn net.Conn
+	var failed []core.Target
+
+	/* Configuration at accept time, reloads apply to new connections only */
+	cfg := this.Cfg()
+
+	backoff := utils.ParseDurationOrDefault(cfg.RetryBackoff, 0)
+
+	for attempt := 0; ; attempt++ {
+		backend, err = this.scheduler.TakeBackend(ctx, failed...)
+		if err != nil {
+			log.Printf("[ERROR] %s, Closing connection %s", err, clientConn.RemoteAddr())
+			return
+		}
+		log.Printf("[DEBUG] backend %+v", backend)
+
+		backendConn, err = this.dial(backend, ctx, cfg)
+		if err == nil {
+			break
+		}
+
 		this.scheduler.IncrementRefused(*backend)
 		log.Printf("[ERROR] %s", err)
-		return
+
+		if attempt >= cfg.Retries {
+			return
+		}
+
+		failed = append(failed, backend.Target)
+		log.Printf("[DEBUG] Retrying %s with another backend, attempt %d", clientConn.RemoteAddr(), attempt+1)
+
+		if backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-this.done:
+				timer.Stop()
+				log.Printf("[DEBUG] Server stopped, not retrying %s", clientConn.RemoteAddr())
+				return
+			}
+			backoff *= 2
+		}
 	}
+
 	this.scheduler.IncrementConnection(*backend)
 	defer this.scheduler.DecrementConnection(*backend)
 
+	/* Track backend resets for outlier detection */
+	tracked := &trackedConn{Conn: backendConn}
+	backendConn = tracked
+	defer func() {
+		if tracked.IsReset() {
+			this.scheduler.IncrementReset(*backend)
+		} else {
+			this.scheduler.ReportSuccess(*backend)
+		}
+	}()
+
 	/* Stat proxying */
 	log.Printf("[DEBUG] Begin %s%s%s%s%s", clientConn.RemoteAddr(), " -> ", this.listener.Addr(), " -> ", backendConn.RemoteAddr())
-	cs := this.proxy(clientConn, backendConn, utils.ParseDurationOrDefault(*this.cfg.BackendIdleTimeout, 0), true)
-	bs := this.proxy(backendConn, clientConn, utils.ParseDurationOrDefault(*this.cfg.ClientIdleTimeout, 0), false)
+	cs := this.proxy(clientConn, backendConn, filterConn, shapedConn, utils.ParseDurationOrDefault(*cfg.BackendIdleTimeout, 0), true)
+	bs := this.proxy(backendConn, clientConn, filterConn, shapedConn, utils.ParseDurationOrDefault(*cfg.ClientIdleTimeout, 0), false)
 
 	isTx, isRx := true, true
 	ticker := time.NewTicker(1 * time.Second)
@@ -333,62 +702,20 @@ func (this *Server) handle(ctx *core.TcpContext) {
 				backendConn.Close()
 				break
 			}
+			if this.scheduler.IsDisabled(*backend) {
+				log.Printf("[DEBUG] Backend %s disabled, closing %s", backend.Address(), clientConn.RemoteAddr())
+				clientConn.Close()
+				backendConn.Close()
+			}
 		case s, ok := <-cs:
 			isRx = ok
 			this.scheduler.IncrementRx(*backend, s.CountWrite)
-			this.filter.HandleClientRead(clientConn, s)
+			filterConn.Read(s)
 		case s, ok := <-bs:
 			isTx = ok
 			this.scheduler.IncrementTx(*backend, s.CountWrite)
-			this.filter.HandleClientWrite(clientConn, s)
+			filterConn.Write(s)
 		}
 	}
 	log.Printf("[DEBUG] End %s -> %s", clientConn.RemoteAddr(), this.listener.Addr())
 }
-
-func prepareBackendsTlsConfig(cfg config.Server) (*tls.Config, error) {
-
-	var err error
-
-	result := &tls.Config{
-		InsecureSkipVerify:       cfg.BackendsTls.IgnoreVerify,
-		CipherSuites:             tlsutil.MapCiphers(cfg.BackendsTls.Ciphers),
-		PreferServerCipherSuites: cfg.BackendsTls.PreferServerCiphers,
-		MinVersion:               tlsutil.MapVersion(cfg.BackendsTls.MinVersion),
-		MaxVersion:               tlsutil.MapVersion(cfg.BackendsTls.MaxVersion),
-		SessionTicketsDisabled:   !cfg.BackendsTls.SessionTickets,
-	}
-
-	if cfg.BackendsTls.CertPath != nil && cfg.BackendsTls.KeyPath != nil {
-
-		var crt tls.Certificate
-
-		if crt, err = tls.LoadX509KeyPair(*cfg.BackendsTls.CertPath, *cfg.BackendsTls.KeyPath); err != nil {
-			log.Printf("[ERROR] prepareBackendsTls : %s", err)
-			return nil, err
-		}
-
-		result.Certificates = []tls.Certificate{crt}
-	}
-
-	if cfg.BackendsTls.RootCaCertPath != nil {
-
-		var caCertPem []byte
-
-		if caCertPem, err = ioutil.ReadFile(*cfg.BackendsTls.RootCaCertPath); err != nil {
-			log.Printf("[ERROR] %s", err)
-			return nil, err
-		}
-
-		caCertPool := x509.NewCertPool()
-		if ok := caCertPool.AppendCertsFromPEM(caCertPem); !ok {
-			log.Printf("[ERROR] Unable to load root pem")
-		}
-
-		result.RootCAs = caCertPool
-
-	}
-
-	return result, nil
-
-}
@@ -1,19 +1,36 @@
 package udp
 
 import (
+	"errors"
 	"log"
 	"net"
+	"reflect"
+	"sync"
+	"time"
 
 	"github.com/millken/tcpwder/balance"
 	"github.com/millken/tcpwder/config"
 	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/firewall"
+	"github.com/millken/tcpwder/server/filter"
+	"github.com/millken/tcpwder/server/healthcheck"
 	"github.com/millken/tcpwder/server/scheduler"
+	"github.com/millken/tcpwder/server/shaper"
 	"github.com/millken/tcpwder/server/upstream"
 	"github.com/millken/tcpwder/stats"
+	"github.com/millken/tcpwder/upgrade"
 	"github.com/millken/tcpwder/utils"
 )
 
-const UDP_PACKET_SIZE = 65507
+const (
+	UDP_PACKET_SIZE = 65507
+
+	/* Client datagrams of session waiting to be sent, more are dropped */
+	UDP_SESSION_QUEUE_SIZE = 64
+
+	/* Min interval between logs of dropped datagrams of a session */
+	UDP_DROP_LOG_INTERVAL = 10 * time.Second
+)
 
 /**
  * UDP server implementation
@@ -23,8 +40,9 @@ type Server struct {
 	/* Server name */
 	name string
 
-	/* Server configuration */
-	cfg config.Server
+	/* Server configuration, replaced on reload while others read it */
+	cfg      config.Server
+	cfgMutex sync.RWMutex
 
 	/* Scheduler */
 	scheduler scheduler.Scheduler
@@ -32,18 +50,45 @@ type Server struct {
 	/* Stats handler */
 	statsHandler *stats.Handler
 
+	/* Filters applied to sessions and datagrams */
+	filter *filter.Filter
+
+	/* Bandwidth shaper of sessions */
+	shaper *shaper.Shaper
+
 	/* Server connection */
 	serverConn *net.UDPConn
 
 	/* Flag indicating that server is stopped */
 	stopped bool
 
+	/* Closed when socket is left to new process or new server */
+	released chan bool
+
+	/* Closed when draining server has no active sessions, nil if not draining */
+	drained chan bool
+
+	/* Drain progress, nil if not draining */
+	drainStatus *core.DrainStatus
+	drainMutex  sync.Mutex
+
 	/* ----- channels ----- */
 	getOrCreate chan *sessionRequest
 	remove      chan net.UDPAddr
+	reload      chan config.Server
+	drain       chan drainRequest
 	stop        chan bool
 }
 
+/**
+ * Request to start draining.
+ * Drained channel is closed when no active sessions left
+ */
+type drainRequest struct {
+	status  core.DrainStatus
+	drained chan bool
+}
+
 /**
  * Request to get session for clientAddr
  */
@@ -65,19 +110,32 @@ type sessionResponse struct {
  */
 func New(name string, cfg config.Server) (*Server, error) {
 
+	/* Create bandwidth shaper */
+	bandwidthShaper, err := shaper.New(cfg.Shaping)
+	if err != nil {
+		return nil, err
+	}
+
 	statsHandler := stats.NewHandler(name)
 	server := &Server{
 		name: name,
 		cfg:  cfg,
 		scheduler: scheduler.Scheduler{
-			Balancer:     balance.New(nil, cfg.Balance),
-			Upstream:     upstream.New(cfg.Upstream),
+			Balancer:     balance.New(cfg),
+			Upstream:     upstream.New(cfg.Upstream, *cfg.Discovery),
+			Healthcheck:  healthcheck.New(*cfg.Healthcheck, nil),
+			Outlier:      scheduler.NewOutlierDetector(cfg.OutlierDetection),
 			StatsHandler: statsHandler,
 		},
 		statsHandler: statsHandler,
+		filter:       filter.New(cfg),
+		shaper:       bandwidthShaper,
 		getOrCreate:  make(chan *sessionRequest),
 		remove:       make(chan net.UDPAddr),
+		reload:       make(chan config.Server),
+		drain:        make(chan drainRequest),
 		stop:         make(chan bool),
+		released:     make(chan bool),
 	}
 
 	log.Printf("[INFO] Creating UDP server '%s': %s %s", name, cfg.Bind, cfg.Balance)
@@ -88,15 +146,25 @@ func New(name string, cfg config.Server) (*Server, error) {
  * Returns current server configuration
  */
 func (this *Server) Cfg() config.Server {
+	this.cfgMutex.RLock()
+	defer this.cfgMutex.RUnlock()
 	return this.cfg
 }
 
+/**
+ * Returns backends manager
+ */
+func (this *Server) Backends() core.BackendsManager {
+	return &this.scheduler
+}
+
 /**
  * Starts server
  */
 func (this *Server) Start() error {
 	this.scheduler.Start()
 	this.statsHandler.Start()
+	this.filter.Start()
 	// Start listening
 	if err := this.listen(); err != nil {
 		this.Stop()
@@ -121,6 +189,14 @@ func (this *Server) Start() error {
 					break
 				}
 
+				if this.drainStatus != nil {
+					sessionRequest.response <- sessionResponse{
+						session: nil,
+						err:     errors.New("Server is draining"),
+					}
+					break
+				}
+
 				session, err := this.makeSession(sessionRequest.clientAddr)
 				if err == nil {
 					sessions[sessionRequest.clientAddr.String()] = session
@@ -139,12 +215,31 @@ func (this *Server) Start() error {
 				}
 				session.stop()
 				delete(sessions, clientAddr.String())
+				session.filterConn.Disconnect()
+				session.shapedConn.Disconnect()
+				this.updateDrain(len(sessions))
+
+			/* handle configuration reload */
+			case cfg := <-this.reload:
+				this.handleReload(cfg)
+
+			/* handle drain start, new sessions are refused */
+			case req := <-this.drain:
+				if upgrade.TakenOver(this.serverConn) {
+					this.release()
+				}
+				this.drained = req.drained
+				this.drainMutex.Lock()
+				this.drainStatus = &req.status
+				this.drainMutex.Unlock()
+				this.updateDrain(len(sessions))
 
 			/* handle server stop */
 			case <-this.stop:
 				for _, session := range sessions {
 					session.stop()
 				}
+				this.filter.Stop()
 				return
 			}
 		}
@@ -153,18 +248,127 @@ func (this *Server) Start() error {
 	return nil
 }
 
+/**
+ * Update drain progress, notifying when no active sessions left
+ */
+func (this *Server) updateDrain(sessions int) {
+	if this.drained == nil {
+		return
+	}
+
+	this.drainMutex.Lock()
+	this.drainStatus.ActiveConnections = uint(sessions)
+	this.drainMutex.Unlock()
+
+	if sessions == 0 {
+		close(this.drained)
+		this.drained = nil
+	}
+}
+
+/**
+ * Stop reading socket taken over by new process or new server,
+ * so datagrams of all clients reach it instead of being refused here.
+ * Active sessions keep relaying backend responses until they end
+ */
+func (this *Server) release() {
+	close(this.released)
+	this.serverConn.SetReadDeadline(time.Now())
+}
+
+/**
+ * Drain, waiting for active sessions up to drain timeout,
+ * then stop dropping ones left
+ */
+func (this *Server) Drain() {
+
+	timeout := utils.ParseDurationOrDefault(*this.Cfg().DrainTimeout, 0)
+
+	if timeout > 0 {
+		log.Printf("[INFO] Draining %s for up to %s", this.name, timeout)
+
+		now := time.Now()
+		drained := make(chan bool)
+		this.drain <- drainRequest{
+			status: core.DrainStatus{
+				Started:  now,
+				Deadline: now.Add(timeout),
+			},
+			drained: drained,
+		}
+
+		select {
+		case <-drained:
+			log.Printf("[INFO] Drained %s", this.name)
+		case <-time.After(timeout):
+			log.Printf("[WARN] Drain timeout for %s, dropping active sessions", this.name)
+		}
+	}
+
+	this.Stop()
+}
+
+/**
+ * Returns drain progress, nil if server is not draining
+ */
+func (this *Server) DrainStatus() *core.DrainStatus {
+	this.drainMutex.Lock()
+	defer this.drainMutex.Unlock()
+
+	if this.drainStatus == nil {
+		return nil
+	}
+
+	status := *this.drainStatus
+	return &status
+}
+
+/**
+ * Reload upstream, balancer and filters from configuration.
+ * Listener and active sessions are kept
+ */
+func (this *Server) Reload(cfg config.Server) error {
+	this.reload <- cfg
+	return nil
+}
+
+/**
+ * Replace scheduler parts and filters with ones of new configuration
+ */
+func (this *Server) handleReload(cfg config.Server) {
+
+	log.Printf("[INFO] Reloading UDP server '%s': %s %s", this.name, cfg.Bind, cfg.Balance)
+
+	previous := this.Cfg()
+
+	// unchanged healthcheck and outlier detector keep backends statuses
+	req := scheduler.ReloadRequest{
+		Balancer:       balance.New(cfg),
+		Upstream:       upstream.New(cfg.Upstream, *cfg.Discovery),
+		Outlier:        scheduler.NewOutlierDetector(cfg.OutlierDetection),
+		OutlierChanged: !reflect.DeepEqual(previous.OutlierDetection, cfg.OutlierDetection),
+	}
+	if !reflect.DeepEqual(previous.Healthcheck, cfg.Healthcheck) {
+		req.Healthcheck = healthcheck.New(*cfg.Healthcheck, nil)
+	}
+	this.scheduler.Reload(req)
+	this.filter.Reload(cfg)
+	this.shaper.Reload(cfg.Shaping)
+
+	this.cfgMutex.Lock()
+	this.cfg = cfg
+	this.cfgMutex.Unlock()
+}
+
 /**
  * Start accepting connections
  */
 func (this *Server) listen() error {
 
-	listenAddr, err := net.ResolveUDPAddr("udp", this.cfg.Bind)
-	if err != nil {
-		log.Printf("[ERROR] resolving server bind addr %s", err)
-		return err
-	}
+	var err error
 
-	this.serverConn, err = net.ListenUDP("udp", listenAddr)
+	// taking over connection inherited on upgrade
+	this.serverConn, err = upgrade.ListenUDP(this.Cfg().Bind)
 
 	if err != nil {
 		log.Printf("[ERROR] starting UDP server: %s", err)
@@ -173,19 +377,34 @@ func (this *Server) listen() error {
 
 	// Main proxy loop goroutine
 	go func() {
+		buf := make([]byte, UDP_PACKET_SIZE)
 		for {
-			buf := make([]byte, UDP_PACKET_SIZE)
 			n, clientAddr, err := this.serverConn.ReadFromUDP(buf)
 
 			if err != nil {
 				if this.stopped {
 					return
 				}
+				select {
+				case <-this.released:
+					log.Printf("[INFO] Left %s to new listener", this.serverConn.LocalAddr())
+					return
+				default:
+				}
 				log.Printf("[ERROR] ReadFromUDP: %s", err)
 				continue
 			}
 
+			// copy, so queued datagrams hold their size only
+			data := make([]byte, n)
+			copy(data, buf[0:n])
+
 			go func(buf []byte) {
+
+				if !firewall.Allows(clientAddr.IP.String()) {
+					return
+				}
+
 				responseChan := make(chan sessionResponse, 1)
 
 				this.getOrCreate <- &sessionRequest{
@@ -200,13 +419,11 @@ func (this *Server) listen() error {
 					return
 				}
 
-				err := response.session.send(buf)
-
-				if err != nil {
-					log.Printf("[ERROR] sending data to backend %s", err)
+				if !response.session.enqueue(buf) {
+					response.session.drop()
 				}
 
-			}(buf[0:n])
+			}(data)
 		}
 	}()
 
@@ -220,27 +437,37 @@ func (this *Server) makeSession(clientAddr net.UDPAddr) (*session, error) {
 
 	log.Printf("[DEBUG] Accepted %s%s%s", clientAddr.String(), " -> ", this.serverConn.LocalAddr())
 
+	cfg := this.Cfg()
+
 	var maxRequests uint64
 	var maxResponses uint64
 
-	if this.cfg.Udp != nil {
-		maxRequests = this.cfg.Udp.MaxRequests
-		maxResponses = this.cfg.Udp.MaxResponses
+	if cfg.Udp != nil {
+		maxRequests = cfg.Udp.MaxRequests
+		maxResponses = cfg.Udp.MaxResponses
 	}
 
-	backend, err := this.scheduler.TakeBackend(&core.UdpContext{
+	ctx := &core.UdpContext{
 		RemoteAddr: clientAddr,
-	})
+	}
 
+	filterConn, err := this.filter.HandleClientConnect(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	backend, err := this.scheduler.TakeBackend(ctx)
+
+	if err != nil {
+		filterConn.Disconnect()
+		return nil, err
+	}
+
 	log.Printf("[DEBUG] backend %+v", backend)
 
 	session := &session{
-		clientIdleTimeout:  utils.ParseDurationOrDefault(*this.cfg.ClientIdleTimeout, 0),
-		backendIdleTimeout: utils.ParseDurationOrDefault(*this.cfg.BackendIdleTimeout, 0),
+		clientIdleTimeout:  utils.ParseDurationOrDefault(*cfg.ClientIdleTimeout, 0),
+		backendIdleTimeout: utils.ParseDurationOrDefault(*cfg.BackendIdleTimeout, 0),
 		maxRequests:        maxRequests,
 		maxResponses:       maxResponses,
 		scheduler:          this.scheduler,
@@ -250,10 +477,15 @@ func (this *Server) makeSession(clientAddr net.UDPAddr) (*session, error) {
 		serverConn: this.serverConn,
 		clientAddr: clientAddr,
 		backend:    backend,
+		filterConn: filterConn,
+		shapedConn: this.shaper.Connect(clientAddr.IP.String()),
 	}
 
 	err = session.start()
 	if err != nil {
+		filterConn.Disconnect()
+		session.shapedConn.Disconnect()
+		this.scheduler.IncrementRefused(*backend)
 		session.stop()
 		return nil, err
 	}
@@ -268,9 +500,10 @@ func (this *Server) Stop() {
 	log.Printf("[INFO] Stopping %s", this.name)
 
 	this.stopped = true
+	upgrade.Forget(this.serverConn)
 	this.serverConn.Close()
 
 	this.scheduler.Stop()
-	this.scheduler.Stop()
+	this.statsHandler.Stop()
 	this.stop <- true
 }
@@ -7,13 +7,17 @@
 package udp
 
 import (
+	"errors"
 	"log"
 	"net"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/server/filter"
 	"github.com/millken/tcpwder/server/scheduler"
+	"github.com/millken/tcpwder/server/shaper"
 )
 
 /**
@@ -33,6 +37,12 @@ type session struct {
 	/* actually sent client requests */
 	_sentRequests uint64
 
+	/* client requests dropped because of full queue */
+	_droppedRequests uint64
+
+	/* unix nano time drops were last logged */
+	_dropLogged int64
+
 	/* max number of backend responses */
 	maxResponses uint64
 
@@ -48,6 +58,12 @@ type session struct {
 	/* Session backend */
 	backend *core.Backend
 
+	/* Filters of the session client */
+	filterConn *filter.Connection
+
+	/* Bandwidth shaping of the session client */
+	shapedConn *shaper.Connection
+
 	/* connection to previously elected backend */
 	backendConn *net.UDPConn
 
@@ -56,9 +72,15 @@ type session struct {
 
 	clientLastActivity time.Time
 
+	/* Client datagrams waiting to be filtered, shaped and sent to backend */
+	requests chan []byte
+
 	/* stop channel */
 	stopC chan bool
 
+	/* Closed when session is stopped */
+	doneC chan bool
+
 	/* function to call to notify server that session is closed and should be removed */
 	notifyClosed func()
 }
@@ -69,6 +91,8 @@ type session struct {
 func (s *session) start() error {
 
 	s.stopC = make(chan bool)
+	s.doneC = make(chan bool)
+	s.requests = make(chan []byte, UDP_SESSION_QUEUE_SIZE)
 	s.clientActivityC = make(chan bool)
 	s.clientLastActivity = time.Now()
 
@@ -89,7 +113,7 @@ func (s *session) start() error {
 	s.backendConn = backendConn
 
 	/**
-	 * Update time and wait for stop
+	 * Update time, check backend is not disabled and wait for stop
 	 */
 	var t *time.Ticker
 	var tC <-chan time.Time
@@ -100,10 +124,21 @@ func (s *session) start() error {
 		tC = t.C
 	}
 
+	disabledTicker := time.NewTicker(1 * time.Second)
+	disabled := false
+
 	stopped := false
 	go func() {
 		for {
 			select {
+			case <-disabledTicker.C:
+				if !disabled && s.scheduler.IsDisabled(*s.backend) {
+					log.Printf("[DEBUG] Backend %s disabled, closing session %s", s.backend.Address(), s.clientAddr.String())
+					disabled = true
+					go func() {
+						s.stopC <- true
+					}()
+				}
 			case now := <-tC:
 				if s.clientLastActivity.Add(s.clientIdleTimeout).Before(now) {
 					log.Printf("[DEBUG] Client %s%s%s", s.clientAddr, " was idle for more than ", s.clientIdleTimeout)
@@ -113,12 +148,14 @@ func (s *session) start() error {
 				}
 			case <-s.stopC:
 				stopped = true
+				close(s.doneC)
 				log.Printf("[DEBUG] Closing client session: %s", s.clientAddr.String())
 				s.backendConn.Close()
 				s.notifyClosed()
 				if t != nil {
 					t.Stop()
 				}
+				disabledTicker.Stop()
 				return
 			case <-s.clientActivityC:
 				s.clientLastActivity = time.Now()
@@ -126,6 +163,35 @@ func (s *session) start() error {
 		}
 	}()
 
+	/**
+	 * Proxy queued data from client to backend. Waiting for
+	 * bandwidth here fills the queue, so over the limit datagrams
+	 * are dropped instead of piling up
+	 */
+	go func() {
+		for {
+			select {
+			case buf := <-s.requests:
+				if err := s.filterConn.Request(buf); err != nil {
+					log.Printf("[WARN] dropping datagram from %s: %s", s.clientAddr.String(), err)
+					continue
+				}
+
+				s.shapedConn.Wait(shaper.UPLOAD, len(buf))
+
+				if err := s.send(buf); err != nil {
+					log.Printf("[ERROR] sending data to backend %s", err)
+					continue
+				}
+
+				s.filterConn.Write(core.ReadWriteCount{CountRead: uint(len(buf)), CountWrite: uint(len(buf))})
+
+			case <-s.doneC:
+				return
+			}
+		}
+	}()
+
 	/**
 	 * Proxy data from backend to client
 	 */
@@ -150,12 +216,25 @@ func (s *session) start() error {
 					log.Printf("[ERROR] reading from backend %s", err)
 				}
 
+				// backend answered with port unreachable
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					s.scheduler.IncrementRefused(*s.backend)
+				}
+
 				s.stop()
 				return
 			}
 
 			s.scheduler.IncrementRx(*s.backend, uint(n))
+
+			// drop response denied by filters
+			if err := s.filterConn.Response(buf[0:n]); err != nil {
+				continue
+			}
+
+			s.shapedConn.Wait(shaper.DOWNLOAD, n)
 			s.serverConn.WriteToUDP(buf[0:n], &s.clientAddr)
+			s.filterConn.Read(core.ReadWriteCount{CountRead: uint(n), CountWrite: uint(n)})
 
 			if s.maxResponses > 0 {
 				responses++
@@ -169,6 +248,37 @@ func (s *session) start() error {
 	return nil
 }
 
+/**
+ * Queue client datagram to be sent to backend,
+ * returns false if queue is full
+ */
+func (s *session) enqueue(buf []byte) bool {
+	select {
+	case s.requests <- buf:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+ * Count client datagram dropped because queue is full,
+ * logging drops at most once per UDP_DROP_LOG_INTERVAL
+ */
+func (s *session) drop() {
+
+	s.scheduler.IncrementDropped(*s.backend)
+	dropped := atomic.AddUint64(&s._droppedRequests, 1)
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s._dropLogged)
+	if now-last < int64(UDP_DROP_LOG_INTERVAL) || !atomic.CompareAndSwapInt64(&s._dropLogged, last, now) {
+		return
+	}
+
+	log.Printf("[WARN] Dropping datagrams from %s: session queue is full, %d dropped so far", s.clientAddr.String(), dropped)
+}
+
 /**
  * Writes data to session backend
  */
@@ -0,0 +1,166 @@
+/**
+ * dns.go - dns A/AAAA and SRV upstream discovery
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/utils"
+)
+
+/**
+ * Resolve hosts of upstream lines to A/AAAA records,
+ * every resolved address becomes backend with line's weight, priority and sni
+ */
+func dns(ctx context.Context, cfg config.Upstream, discoveryCfg config.Discovery) (*[]core.Backend, error) {
+
+	server := ""
+	network := "ip"
+	if discoveryCfg.DnsDiscoveryConfig != nil {
+		server = discoveryCfg.DnsLookupServer
+		switch discoveryCfg.DnsFamily {
+		case "ipv4":
+			network = "ip4"
+		case "ipv6":
+			network = "ip6"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, utils.ParseDurationOrDefault(discoveryCfg.Timeout, 5*time.Second))
+	defer cancel()
+
+	r := resolver(server)
+
+	backends := []core.Backend{}
+	for _, s := range cfg {
+		backend, err := core.ParseBackendDefault(s)
+		if err != nil {
+			log.Printf("[WARN] %s", err)
+			continue
+		}
+
+		ips, err := r.LookupIP(ctx, network, backend.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range ips {
+			b := *backend
+			b.Host = ip.String()
+			backends = append(backends, b)
+		}
+	}
+
+	sortBackends(backends)
+
+	return &backends, nil
+}
+
+/**
+ * Lookup SRV records, every record target address becomes
+ * backend with record's port, weight and priority
+ */
+func srv(ctx context.Context, cfg config.Upstream, discoveryCfg config.Discovery) (*[]core.Backend, error) {
+
+	if discoveryCfg.SrvDiscoveryConfig == nil || discoveryCfg.SrvLookupPattern == "" {
+		return nil, errors.New("No srv_lookup_pattern specified")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, utils.ParseDurationOrDefault(discoveryCfg.Timeout, 5*time.Second))
+	defer cancel()
+
+	r := resolver(discoveryCfg.SrvLookupServer)
+
+	_, records, err := r.LookupSRV(ctx, "", "", discoveryCfg.SrvLookupPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	backends := []core.Backend{}
+	for _, record := range records {
+
+		host := strings.TrimSuffix(record.Target, ".")
+
+		ips, err := r.LookupIP(ctx, "ip", host)
+		if err != nil {
+			log.Printf("[WARN] Unable to resolve srv target %s: %s", host, err)
+			continue
+		}
+
+		// weight 0 is valid for srv, but means the lowest chance to be elected
+		weight := int(record.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+
+		for _, ip := range ips {
+			backends = append(backends, core.Backend{
+				Target: core.Target{
+					Host: ip.String(),
+					Port: strconv.Itoa(int(record.Port)),
+				},
+				Priority: int(record.Priority),
+				Weight:   weight,
+				Stats: core.BackendStats{
+					Live: true,
+				},
+			})
+		}
+	}
+
+	sortBackends(backends)
+
+	return &backends, nil
+}
+
+/**
+ * Returns resolver using dns server, or system resolver if server is empty
+ */
+func resolver(server string) *net.Resolver {
+
+	if server == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			conn, err := d.DialContext(ctx, network, server)
+			if err != nil {
+				return nil, err
+			}
+
+			// resolver watches deadlines only, abort query on stop too
+			go func() {
+				<-ctx.Done()
+				conn.Close()
+			}()
+
+			return conn, nil
+		},
+	}
+}
+
+/**
+ * Sort backends to keep pool order stable between lookups
+ */
+func sortBackends(backends []core.Backend) {
+	sort.SliceStable(backends, func(i, j int) bool {
+		if backends[i].Priority != backends[j].Priority {
+			return backends[i].Priority < backends[j].Priority
+		}
+		return backends[i].Address() < backends[j].Address()
+	})
+}
@@ -0,0 +1,332 @@
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+)
+
+const (
+	DNS_TYPE_A    = 1
+	DNS_TYPE_AAAA = 28
+	DNS_TYPE_SRV  = 33
+
+	DNS_RCODE_NXDOMAIN = 3
+)
+
+/**
+ * In-process udp dns server answering from static records
+ */
+type stubDns struct {
+	conn net.PacketConn
+
+	/* Record data by name and type */
+	records map[string]map[uint16][][]byte
+
+	/* Never answer, to test timeouts */
+	silent bool
+
+	/* Closed on first query */
+	queried     chan bool
+	queriedOnce sync.Once
+
+	done chan bool
+}
+
+func newStubDns(t *testing.T) *stubDns {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &stubDns{
+		conn:    conn,
+		records: make(map[string]map[uint16][][]byte),
+		queried: make(chan bool),
+		done:    make(chan bool),
+	}
+}
+
+func (this *stubDns) Addr() string {
+	return this.conn.LocalAddr().String()
+}
+
+func (this *stubDns) add(name string, t uint16, rdata []byte) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if this.records[name] == nil {
+		this.records[name] = make(map[uint16][][]byte)
+	}
+	this.records[name][t] = append(this.records[name][t], rdata)
+}
+
+func (this *stubDns) AddA(name string, ip string) {
+	this.add(name, DNS_TYPE_A, net.ParseIP(ip).To4())
+}
+
+func (this *stubDns) AddAAAA(name string, ip string) {
+	this.add(name, DNS_TYPE_AAAA, net.ParseIP(ip).To16())
+}
+
+func (this *stubDns) AddSRV(name string, priority, weight, port uint16, target string) {
+	rdata := make([]byte, 6)
+	binary.BigEndian.PutUint16(rdata[0:2], priority)
+	binary.BigEndian.PutUint16(rdata[2:4], weight)
+	binary.BigEndian.PutUint16(rdata[4:6], port)
+	this.add(name, DNS_TYPE_SRV, append(rdata, encodeName(target)...))
+}
+
+/**
+ * Start serving, records should not be added after
+ */
+func (this *stubDns) Start() {
+	go func() {
+		defer close(this.done)
+
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := this.conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			this.queriedOnce.Do(func() { close(this.queried) })
+
+			if this.silent {
+				continue
+			}
+
+			if response := this.answer(buf[:n]); response != nil {
+				this.conn.WriteTo(response, addr)
+			}
+		}
+	}()
+}
+
+func (this *stubDns) Stop() {
+	this.conn.Close()
+	<-this.done
+}
+
+/**
+ * Build response to query, nil if query is malformed
+ */
+func (this *stubDns) answer(query []byte) []byte {
+
+	if len(query) < 12 {
+		return nil
+	}
+
+	// question name
+	labels := []string{}
+	i := 12
+	for {
+		if i >= len(query) {
+			return nil
+		}
+		l := int(query[i])
+		i++
+		if l == 0 {
+			break
+		}
+		if i+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i:i+l]))
+		i += l
+	}
+	if i+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[i : i+2])
+	question := query[12 : i+4]
+
+	name := strings.ToLower(strings.Join(labels, "."))
+	types, found := this.records[name]
+	answers := types[qtype]
+
+	response := make([]byte, 12)
+	copy(response[0:2], query[0:2])
+
+	// response, authoritative, recursion desired and available
+	flags := uint16(0x8580)
+	if !found {
+		flags |= DNS_RCODE_NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(response[2:4], flags)
+	binary.BigEndian.PutUint16(response[4:6], 1)
+	binary.BigEndian.PutUint16(response[6:8], uint16(len(answers)))
+
+	response = append(response, question...)
+
+	for _, rdata := range answers {
+		rr := make([]byte, 12)
+		binary.BigEndian.PutUint16(rr[0:2], 0xc00c) // pointer to question name
+		binary.BigEndian.PutUint16(rr[2:4], qtype)
+		binary.BigEndian.PutUint16(rr[4:6], 1) // IN
+		binary.BigEndian.PutUint32(rr[6:10], 60)
+		binary.BigEndian.PutUint16(rr[10:12], uint16(len(rdata)))
+		response = append(response, rr...)
+		response = append(response, rdata...)
+	}
+
+	return response
+}
+
+/**
+ * Encode name in uncompressed wire format
+ */
+func encodeName(name string) []byte {
+	result := []byte{}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		result = append(result, byte(len(label)))
+		result = append(result, label...)
+	}
+	return append(result, 0)
+}
+
+func TestDnsDiscovery(t *testing.T) {
+
+	stub := newStubDns(t)
+	stub.AddA("backend.test", "10.0.0.2")
+	stub.AddA("backend.test", "10.0.0.1")
+	stub.AddAAAA("backend.test", "2001:db8::1")
+	stub.Start()
+	defer stub.Stop()
+
+	discoveryCfg := config.Discovery{
+		Kind:    "dns",
+		Timeout: "2s",
+		DnsDiscoveryConfig: &config.DnsDiscoveryConfig{
+			DnsLookupServer: stub.Addr(),
+			DnsFamily:       "ipv4",
+		},
+	}
+
+	backends, err := dns(context.Background(), config.Upstream{"backend.test.:8080 weight=3 priority=2"}, discoveryCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*backends) != 2 {
+		t.Fatalf("Expected 2 backends, got %+v", *backends)
+	}
+	for i, host := range []string{"10.0.0.1", "10.0.0.2"} {
+		b := (*backends)[i]
+		if b.Host != host || b.Port != "8080" || b.Weight != 3 || b.Priority != 2 {
+			t.Errorf("Unexpected backend %+v", b)
+		}
+	}
+
+	discoveryCfg.DnsFamily = ""
+	backends, err = dns(context.Background(), config.Upstream{"backend.test.:8080"}, discoveryCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*backends) != 3 {
+		t.Fatalf("Expected 3 backends, got %+v", *backends)
+	}
+}
+
+func TestSrvDiscovery(t *testing.T) {
+
+	stub := newStubDns(t)
+	stub.AddSRV("_app._tcp.service.test", 1, 10, 8081, "a.service.test.")
+	stub.AddSRV("_app._tcp.service.test", 2, 0, 8082, "b.service.test.")
+	stub.AddSRV("_app._tcp.service.test", 1, 5, 8083, "missing.service.test.")
+	stub.AddA("a.service.test", "10.0.1.1")
+	stub.AddA("b.service.test", "10.0.1.2")
+	stub.Start()
+	defer stub.Stop()
+
+	discoveryCfg := config.Discovery{
+		Kind:    "srv",
+		Timeout: "2s",
+		SrvDiscoveryConfig: &config.SrvDiscoveryConfig{
+			SrvLookupServer:  stub.Addr(),
+			SrvLookupPattern: "_app._tcp.service.test.",
+		},
+	}
+
+	backends, err := srv(context.Background(), nil, discoveryCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unresolvable target is skipped
+	if len(*backends) != 2 {
+		t.Fatalf("Expected 2 backends, got %+v", *backends)
+	}
+
+	a, b := (*backends)[0], (*backends)[1]
+	if a.Host != "10.0.1.1" || a.Port != "8081" || a.Priority != 1 || a.Weight != 10 {
+		t.Errorf("Unexpected backend %+v", a)
+	}
+	// srv weight 0 becomes the lowest weight
+	if b.Host != "10.0.1.2" || b.Port != "8082" || b.Priority != 2 || b.Weight != 1 {
+		t.Errorf("Unexpected backend %+v", b)
+	}
+}
+
+func TestDnsDiscoveryNxdomain(t *testing.T) {
+
+	stub := newStubDns(t)
+	stub.Start()
+	defer stub.Stop()
+
+	_, err := dns(context.Background(), config.Upstream{"missing.test.:80"}, config.Discovery{
+		Kind:    "dns",
+		Timeout: "2s",
+		DnsDiscoveryConfig: &config.DnsDiscoveryConfig{
+			DnsLookupServer: stub.Addr(),
+		},
+	})
+
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok || !dnsErr.IsNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+
+	_, err = srv(context.Background(), nil, config.Discovery{
+		Kind:    "srv",
+		Timeout: "2s",
+		SrvDiscoveryConfig: &config.SrvDiscoveryConfig{
+			SrvLookupServer:  stub.Addr(),
+			SrvLookupPattern: "_app._tcp.missing.test.",
+		},
+	})
+
+	dnsErr, ok = err.(*net.DNSError)
+	if !ok || !dnsErr.IsNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestDnsDiscoveryTimeout(t *testing.T) {
+
+	stub := newStubDns(t)
+	stub.silent = true
+	stub.Start()
+	defer stub.Stop()
+
+	start := time.Now()
+
+	_, err := dns(context.Background(), config.Upstream{"backend.test.:80"}, config.Discovery{
+		Kind:    "dns",
+		Timeout: "200ms",
+		DnsDiscoveryConfig: &config.DnsDiscoveryConfig{
+			DnsLookupServer: stub.Addr(),
+		},
+	})
+
+	if err == nil {
+		t.Fatal("Expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Lookup took %s, longer than timeout", elapsed)
+	}
+}
@@ -0,0 +1,209 @@
+/**
+ * file.go - file upstream discovery
+ */
+
+package upstream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+/**
+ * Last parsed backends of file, reused while file
+ * modification time and size stay the same
+ */
+type fileState struct {
+	modTime  time.Time
+	size     int64
+	format   string
+	backends []core.Backend
+}
+
+/**
+ * Parsed files by path
+ */
+var files = struct {
+	sync.Mutex
+	m map[string]fileState
+}{
+	m: make(map[string]fileState),
+}
+
+/**
+ * Read backends from plain text or json file.
+ * File is not read again until its modification time or size changes
+ */
+func file(ctx context.Context, cfg config.Upstream, discoveryCfg config.Discovery) (*[]core.Backend, error) {
+
+	if discoveryCfg.FileDiscoveryConfig == nil || discoveryCfg.FilePath == "" {
+		return nil, errors.New("No file_path specified")
+	}
+
+	path := discoveryCfg.FilePath
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	format := discoveryCfg.FileFormat
+	if format == "" {
+		format = "plain"
+		if strings.ToLower(filepath.Ext(discoveryCfg.FilePath)) == ".json" {
+			format = "json"
+		}
+	}
+
+	files.Lock()
+	state, ok := files.m[path]
+	files.Unlock()
+
+	if ok && state.format == format && state.size == info.Size() && state.modTime.Equal(info.ModTime()) {
+		backends := make([]core.Backend, len(state.backends))
+		copy(backends, state.backends)
+		return &backends, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var backends *[]core.Backend
+	switch format {
+	case "plain":
+		backends, err = parsePlainBackends(data)
+	case "json":
+		backends, err = parseJsonBackends(data)
+	default:
+		return nil, errors.New("Unknown file format " + format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state = fileState{
+		modTime:  info.ModTime(),
+		size:     info.Size(),
+		format:   format,
+		backends: make([]core.Backend, len(*backends)),
+	}
+	copy(state.backends, *backends)
+
+	files.Lock()
+	files.m[path] = state
+	files.Unlock()
+
+	return backends, nil
+}
+
+/**
+ * Parse backends, one per line in default backend syntax.
+ * Empty lines and lines starting with # are ignored
+ */
+func parsePlainBackends(data []byte) (*[]core.Backend, error) {
+
+	backends := []core.Backend{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		backend, err := core.ParseBackendDefault(line)
+		if err != nil {
+			log.Printf("[WARN] %s", err)
+			continue
+		}
+		backends = append(backends, *backend)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &backends, nil
+}
+
+/**
+ * Parse json array of backends. Every element is either a string
+ * in default backend syntax or an object with host, port, weight, priority and sni
+ */
+func parseJsonBackends(data []byte) (*[]core.Backend, error) {
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return nil, err
+	}
+
+	backends := []core.Backend{}
+	for _, element := range elements {
+
+		var line string
+		if err := json.Unmarshal(element, &line); err == nil {
+			backend, err := core.ParseBackendDefault(line)
+			if err != nil {
+				log.Printf("[WARN] %s", err)
+				continue
+			}
+			backends = append(backends, *backend)
+			continue
+		}
+
+		var obj struct {
+			Host     string      `json:"host"`
+			Port     interface{} `json:"port"`
+			Weight   int         `json:"weight"`
+			Priority int         `json:"priority"`
+			Sni      string      `json:"sni"`
+		}
+		if err := json.Unmarshal(element, &obj); err != nil {
+			log.Printf("[WARN] Cant parse %s: %s", element, err)
+			continue
+		}
+
+		if obj.Host == "" || obj.Port == nil {
+			log.Printf("[WARN] Cant parse %s: no host or port", element)
+			continue
+		}
+
+		if obj.Weight <= 0 {
+			obj.Weight = 1
+		}
+		if obj.Priority <= 0 {
+			obj.Priority = 1
+		}
+
+		backends = append(backends, core.Backend{
+			Target: core.Target{
+				Host: obj.Host,
+				Port: fmt.Sprint(obj.Port),
+			},
+			Weight:   obj.Weight,
+			Priority: obj.Priority,
+			Sni:      obj.Sni,
+			Stats: core.BackendStats{
+				Live: true,
+			},
+		})
+	}
+
+	return &backends, nil
+}
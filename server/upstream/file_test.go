@@ -0,0 +1,125 @@
+package upstream
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+)
+
+func fileDiscovery(path, format string) config.Discovery {
+	return config.Discovery{
+		Kind: "file",
+		FileDiscoveryConfig: &config.FileDiscoveryConfig{
+			FilePath:   path,
+			FileFormat: format,
+		},
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := filepath.Join(dir, "backends.txt")
+	if err := ioutil.WriteFile(plain, []byte("# comment\n\n10.0.0.1:80 weight=2\nnot a backend\n10.0.0.2:81\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backends, err := file(context.Background(), nil, fileDiscovery(plain, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*backends) != 2 || (*backends)[0].Weight != 2 || (*backends)[1].Port != "81" {
+		t.Fatalf("Unexpected plain backends %+v", *backends)
+	}
+
+	json := filepath.Join(dir, "backends.json")
+	if err := ioutil.WriteFile(json, []byte(`["10.0.0.1:80", {"host": "10.0.0.2", "port": 8080, "sni": "example.com"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backends, err = file(context.Background(), nil, fileDiscovery(json, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*backends) != 2 || (*backends)[1].Port != "8080" || (*backends)[1].Sni != "example.com" {
+		t.Fatalf("Unexpected json backends %+v", *backends)
+	}
+
+	if _, err := file(context.Background(), nil, fileDiscovery(plain, "yaml")); err == nil {
+		t.Fatal("Expected unknown format error")
+	}
+	if _, err := file(context.Background(), nil, fileDiscovery(filepath.Join(dir, "missing"), "")); err == nil {
+		t.Fatal("Expected missing file error")
+	}
+}
+
+func TestFileDiscoveryRereadsOnlyChanged(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backends.txt")
+	if err := ioutil.WriteFile(path, []byte("10.0.0.1:80\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := file(context.Background(), nil, fileDiscovery(path, "")); err != nil {
+		t.Fatal(err)
+	}
+
+	// same size and modification time, cached backends are returned
+	if err := ioutil.WriteFile(path, []byte("10.0.0.2:80\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	backends, err := file(context.Background(), nil, fileDiscovery(path, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*backends) != 1 || (*backends)[0].Host != "10.0.0.1" {
+		t.Fatalf("Expected cached backends, got %+v", *backends)
+	}
+
+	// returned backends are copies of cached ones
+	(*backends)[0].Host = "changed"
+
+	backends, err = file(context.Background(), nil, fileDiscovery(path, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*backends)[0].Host != "10.0.0.1" {
+		t.Fatalf("Expected cached backends not to be changed, got %+v", *backends)
+	}
+
+	if err := os.Chtimes(path, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	backends, err = file(context.Background(), nil, fileDiscovery(path, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*backends) != 1 || (*backends)[0].Host != "10.0.0.2" {
+		t.Fatalf("Expected changed file to be read, got %+v", *backends)
+	}
+}
@@ -0,0 +1,58 @@
+/**
+ * json.go - http json upstream discovery
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/utils"
+)
+
+/* Max size of json endpoint response */
+const JSON_MAX_RESPONSE_SIZE = 10 * 1024 * 1024
+
+/**
+ * Fetch backends from http endpoint returning json array,
+ * in the same format as json file discovery
+ */
+func jsonEndpoint(ctx context.Context, cfg config.Upstream, discoveryCfg config.Discovery) (*[]core.Backend, error) {
+
+	if discoveryCfg.JsonDiscoveryConfig == nil || discoveryCfg.JsonEndpoint == "" {
+		return nil, errors.New("No json_endpoint specified")
+	}
+
+	client := &http.Client{
+		Timeout: utils.ParseDurationOrDefault(discoveryCfg.Timeout, 5*time.Second),
+	}
+
+	req, err := http.NewRequest("GET", discoveryCfg.JsonEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d from %s", resp.StatusCode, discoveryCfg.JsonEndpoint)
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, JSON_MAX_RESPONSE_SIZE))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJsonBackends(data)
+}
@@ -0,0 +1,105 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+)
+
+func jsonDiscovery(endpoint, timeout string) config.Discovery {
+	return config.Discovery{
+		Kind:    "json",
+		Timeout: timeout,
+		JsonDiscoveryConfig: &config.JsonDiscoveryConfig{
+			JsonEndpoint: endpoint,
+		},
+	}
+}
+
+func TestJsonDiscovery(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[
+			"10.0.0.1:80 weight=2",
+			{"host": "10.0.0.2", "port": 8080, "priority": 2, "sni": "example.com"},
+			{"host": "10.0.0.3"},
+			"not a backend"
+		]`))
+	}))
+	defer server.Close()
+
+	backends, err := jsonEndpoint(context.Background(), nil, jsonDiscovery(server.URL, "2s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// elements without port or in bad syntax are skipped
+	if len(*backends) != 2 {
+		t.Fatalf("Expected 2 backends, got %+v", *backends)
+	}
+
+	a, b := (*backends)[0], (*backends)[1]
+	if a.Host != "10.0.0.1" || a.Port != "80" || a.Weight != 2 || a.Priority != 1 {
+		t.Errorf("Unexpected backend %+v", a)
+	}
+	if b.Host != "10.0.0.2" || b.Port != "8080" || b.Weight != 1 || b.Priority != 2 || b.Sni != "example.com" {
+		t.Errorf("Unexpected backend %+v", b)
+	}
+}
+
+func TestJsonDiscoveryBadStatus(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	if _, err := jsonEndpoint(context.Background(), nil, jsonDiscovery(server.URL, "2s")); err == nil {
+		t.Fatal("Expected error on non 200 status")
+	}
+}
+
+func TestJsonDiscoveryMalformed(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"host": "10.0.0.1", "port": 80`))
+	}))
+	defer server.Close()
+
+	if _, err := jsonEndpoint(context.Background(), nil, jsonDiscovery(server.URL, "2s")); err == nil {
+		t.Fatal("Expected error on malformed json")
+	}
+}
+
+func TestJsonDiscoveryTimeout(t *testing.T) {
+
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	start := time.Now()
+
+	if _, err := jsonEndpoint(context.Background(), nil, jsonDiscovery(server.URL, "200ms")); err == nil {
+		t.Fatal("Expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Fetch took %s, longer than timeout", elapsed)
+	}
+}
+
+func TestJsonDiscoveryNoEndpoint(t *testing.T) {
+	if _, err := jsonEndpoint(context.Background(), nil, config.Discovery{Kind: "json"}); err == nil {
+		t.Fatal("Expected error without json_endpoint")
+	}
+}
@@ -0,0 +1,21 @@
+/**
+ * registry.go - upstream discoveries registry
+ */
+
+package upstream
+
+/**
+ * Registry of available discovery fetch functions
+ */
+var registry = make(map[string]FetchFunc)
+
+/**
+ * Initialize registry
+ */
+func init() {
+	registry["static"] = static
+	registry["dns"] = dns
+	registry["srv"] = srv
+	registry["file"] = file
+	registry["json"] = jsonEndpoint
+}
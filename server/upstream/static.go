@@ -0,0 +1,30 @@
+/**
+ * static.go - static upstream list
+ */
+
+package upstream
+
+import (
+	"context"
+	"log"
+
+	"github.com/millken/tcpwder/config"
+	"github.com/millken/tcpwder/core"
+)
+
+/**
+ * Parse backends from upstream lines
+ */
+func static(ctx context.Context, cfg config.Upstream, discoveryCfg config.Discovery) (*[]core.Backend, error) {
+	var backends []core.Backend
+	for _, s := range cfg {
+		backend, err := core.ParseBackendDefault(s)
+		if err != nil {
+			log.Printf("[WARN] %s", err)
+			continue
+		}
+		backends = append(backends, *backend)
+	}
+
+	return &backends, nil
+}
@@ -1,20 +1,46 @@
 package upstream
 
 import (
+	"context"
 	"log"
 	"time"
 
 	"github.com/millken/tcpwder/config"
 	"github.com/millken/tcpwder/core"
+	"github.com/millken/tcpwder/utils"
 )
 
+/**
+ * Fetch function
+ * Discovers current backends
+ */
+type FetchFunc func(context.Context, config.Upstream, config.Discovery) (*[]core.Backend, error)
+
 /**
  * Create new Upstream based on strategy
  */
-func New(cfg config.Upstream) *Upstream {
+func New(cfg config.Upstream, discoveryCfg config.Discovery) *Upstream {
+
+	fetch, ok := registry[discoveryCfg.Kind]
+	if !ok {
+		log.Printf("[WARN] Unknown discovery kind %s, using static", discoveryCfg.Kind)
+		fetch = registry["static"]
+		discoveryCfg.Kind = "static"
+	}
+
+	interval := utils.ParseDurationOrDefault(discoveryCfg.Interval, 0)
+	if discoveryCfg.Kind == "static" {
+		interval = 0
+	}
+
 	d := Upstream{
-		opts: UpstreamOpts{0},
-		cfg:  cfg,
+		opts: UpstreamOpts{
+			Interval:          interval,
+			RetryWaitDuration: utils.ParseDurationOrDefault(discoveryCfg.RetryWait, 2*time.Second),
+		},
+		cfg:          cfg,
+		discoveryCfg: discoveryCfg,
+		fetch:        fetch,
 	}
 
 	return &d
@@ -24,6 +50,7 @@ func New(cfg config.Upstream) *Upstream {
  * Options for pull discovery
  */
 type UpstreamOpts struct {
+	Interval          time.Duration
 	RetryWaitDuration time.Duration
 }
 
@@ -47,10 +74,31 @@ type Upstream struct {
 	 */
 	cfg config.Upstream
 
+	/**
+	 * Discovery configuration
+	 */
+	discoveryCfg config.Discovery
+
+	/**
+	 * Discovery fetch function
+	 */
+	fetch FetchFunc
+
 	/**
 	 * Channel where to push newly discovered backends
 	 */
 	out chan ([]core.Backend)
+
+	/**
+	 * Context cancelled on stop
+	 */
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	/**
+	 * Channel closed when discovery goroutine exits
+	 */
+	done chan bool
 }
 
 /**
@@ -58,34 +106,52 @@ type Upstream struct {
  */
 func (this *Upstream) Start() {
 
-	log.Printf("[INFO] Starting upstream")
+	log.Printf("[INFO] Starting upstream %s", this.discoveryCfg.Kind)
 	this.out = make(chan []core.Backend)
+	this.done = make(chan bool)
+	this.ctx, this.cancel = context.WithCancel(context.Background())
 
-	// Prepare interval
-	interval, err := time.ParseDuration("0")
-	if err != nil {
-		log.Fatal(err)
-	}
+	interval := this.opts.Interval
 
 	go func() {
+		defer close(this.done)
+		defer close(this.out)
+
 		for {
-			backends, err := this.fetch()
+			backends, err := this.fetch(this.ctx, this.cfg, this.discoveryCfg)
+
+			if this.ctx.Err() != nil {
+				return
+			}
 
 			if err != nil {
 				log.Printf("[ERROR] %s %s %s", err, " retrying in ", this.opts.RetryWaitDuration.String())
 
-				this.backends = &[]core.Backend{}
-				this.out <- *this.backends
-
-				time.Sleep(this.opts.RetryWaitDuration)
+				// keep last known good backends unless asked otherwise
+				if this.discoveryCfg.FailPolicy == "setempty" || this.backends == nil {
+					this.backends = &[]core.Backend{}
+					if !this.push(*this.backends) {
+						return
+					}
+				}
+
+				if !this.wait(this.opts.RetryWaitDuration) {
+					return
+				}
 				continue
 			}
 
-			// cache
-			this.backends = backends
+			// push only if backends changed
+			if this.backends == nil || !equalBackends(*this.backends, *backends) {
+
+				// cache
+				this.backends = backends
 
-			// out
-			this.out <- *this.backends
+				// out
+				if !this.push(*this.backends) {
+					return
+				}
+			}
 
 			// exit gorouting if no cacheTtl
 			// used for static discovery
@@ -93,30 +159,74 @@ func (this *Upstream) Start() {
 				return
 			}
 
-			time.Sleep(interval)
+			if !this.wait(interval) {
+				return
+			}
 		}
 	}()
 }
 
-func (this *Upstream) fetch() (*[]core.Backend, error) {
-	var backends []core.Backend
-	for _, s := range this.cfg {
-		backend, err := core.ParseBackendDefault(s)
-		if err != nil {
-			log.Printf("[WARN] %s", err)
-			continue
+/**
+ * Push backends to out channel.
+ * Returns false if upstream was stopped
+ */
+func (this *Upstream) push(backends []core.Backend) bool {
+	select {
+	case this.out <- backends:
+		return true
+	case <-this.ctx.Done():
+		return false
+	}
+}
+
+/**
+ * Wait for duration.
+ * Returns false if upstream was stopped
+ */
+func (this *Upstream) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-this.ctx.Done():
+		return false
+	}
+}
+
+/**
+ * Check if backends lists have the same discovery properties
+ */
+func equalBackends(a, b []core.Backend) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].EqualTo(b[i]) ||
+			a[i].Weight != b[i].Weight ||
+			a[i].Priority != b[i].Priority ||
+			a[i].Sni != b[i].Sni {
+			return false
 		}
-		backends = append(backends, *backend)
 	}
 
-	return &backends, nil
+	return true
 }
 
 /**
- * Stop discovery
+ * Stop discovery and wait until it stops.
+ * Discover channel is closed after stop
  */
 func (this *Upstream) Stop() {
-	// TODO: Add stopping function
+	if this.cancel == nil {
+		return
+	}
+
+	this.cancel()
+	<-this.done
 }
 
 /**
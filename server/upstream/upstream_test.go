@@ -0,0 +1,216 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/millken/tcpwder/config"
+)
+
+/**
+ * Wait until number of goroutines is back to baseline,
+ * failing with stacks of running ones if it's not
+ */
+func expectGoroutines(t *testing.T, baseline int) {
+
+	// idle keep alive connections of json discovery are not leaks
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("Goroutines leaked, %d running, %d expected:\n%s", runtime.NumGoroutine(), baseline, buf[:n])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/**
+ * Discovery configurations of every kind, with their servers started
+ */
+func discoveries(t *testing.T) (map[string]config.Discovery, func()) {
+
+	stub := newStubDns(t)
+	stub.AddA("backend.test", "10.0.0.1")
+	stub.AddSRV("_app._tcp.service.test", 1, 1, 8080, "backend.test.")
+	stub.Start()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`["10.0.0.1:80"]`))
+	}))
+
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "backends")
+	if err := ioutil.WriteFile(path, []byte("10.0.0.1:80\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]config.Discovery{
+		"static": {Kind: "static"},
+		"dns": {
+			Kind:     "dns",
+			Interval: "10ms",
+			DnsDiscoveryConfig: &config.DnsDiscoveryConfig{
+				DnsLookupServer: stub.Addr(),
+			},
+		},
+		"srv": {
+			Kind:     "srv",
+			Interval: "10ms",
+			SrvDiscoveryConfig: &config.SrvDiscoveryConfig{
+				SrvLookupServer:  stub.Addr(),
+				SrvLookupPattern: "_app._tcp.service.test.",
+			},
+		},
+		"file": {
+			Kind:     "file",
+			Interval: "10ms",
+			FileDiscoveryConfig: &config.FileDiscoveryConfig{
+				FilePath: path,
+			},
+		},
+		"json": {
+			Kind:     "json",
+			Interval: "10ms",
+			JsonDiscoveryConfig: &config.JsonDiscoveryConfig{
+				JsonEndpoint: server.URL,
+			},
+		},
+	}
+
+	for kind := range registry {
+		if _, ok := result[kind]; !ok {
+			t.Fatalf("Discovery %s is not covered", kind)
+		}
+	}
+
+	return result, func() {
+		stub.Stop()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUpstreamStopNoLeak(t *testing.T) {
+
+	cfgs, cleanup := discoveries(t)
+	defer cleanup()
+
+	for kind, discoveryCfg := range cfgs {
+
+		baseline := runtime.NumGoroutine()
+
+		u := New(config.Upstream{"backend.test.:80"}, discoveryCfg)
+		u.Start()
+
+		select {
+		case backends := <-u.Discover():
+			if len(backends) != 1 {
+				t.Errorf("%s: expected 1 backend, got %+v", kind, backends)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: no backends discovered", kind)
+		}
+
+		// let it loop a few times
+		time.Sleep(30 * time.Millisecond)
+
+		u.Stop()
+
+		// discover channel is closed after stop
+		for range u.Discover() {
+		}
+
+		expectGoroutines(t, baseline)
+	}
+}
+
+func TestUpstreamStopDuringFetch(t *testing.T) {
+
+	// dns server never answering
+	stub := newStubDns(t)
+	stub.silent = true
+	stub.Start()
+	defer stub.Stop()
+
+	// http server answering on client disconnect only
+	entered := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case entered <- true:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	cfgs := map[string]struct {
+		discovery config.Discovery
+		inFlight  <-chan bool
+	}{
+		"dns": {
+			config.Discovery{
+				Kind:    "dns",
+				Timeout: "1m",
+				DnsDiscoveryConfig: &config.DnsDiscoveryConfig{
+					DnsLookupServer: stub.Addr(),
+				},
+			},
+			stub.queried,
+		},
+		"json": {
+			config.Discovery{
+				Kind:    "json",
+				Timeout: "1m",
+				JsonDiscoveryConfig: &config.JsonDiscoveryConfig{
+					JsonEndpoint: server.URL,
+				},
+			},
+			entered,
+		},
+	}
+
+	for kind, c := range cfgs {
+
+		baseline := runtime.NumGoroutine()
+
+		u := New(config.Upstream{"backend.test.:80"}, c.discovery)
+		u.Start()
+
+		select {
+		case <-c.inFlight:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: fetch not started", kind)
+		}
+
+		stopped := make(chan bool)
+		go func() {
+			u.Stop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: stop blocked by fetch in flight", kind)
+		}
+
+		expectGoroutines(t, baseline)
+	}
+}
+
+func TestUpstreamStopNotStarted(t *testing.T) {
+	u := New(config.Upstream{"10.0.0.1:80"}, config.Discovery{Kind: "static"})
+	u.Stop()
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package upgrade
+
+import (
+	"os"
+	"syscall"
+)
+
+/* Signals requesting upgrade */
+var signals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,8 @@
+package upgrade
+
+import (
+	"os"
+)
+
+/* Upgrade by signal is not supported on windows */
+var signals []os.Signal
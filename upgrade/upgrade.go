@@ -0,0 +1,412 @@
+/**
+ * upgrade.go - zero-downtime binary upgrade.
+ *
+ * Running process passes its listening sockets to the freshly
+ * exec'd child as inherited fds 3, 4, ... and describes them in
+ * TCPWDER_LISTENERS environment variable as comma separated
+ * "network/address" keys in the same order. Child takes sockets over
+ * instead of binding and reports it's ready by writing to the fd
+ * from TCPWDER_READY_FD, after that parent drains and exits.
+ *
+ * Server recreated on reload takes socket of the replaced one over
+ * the same way, while replaced one drains.
+ */
+
+package upgrade
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ENV_LISTENERS = "TCPWDER_LISTENERS"
+	ENV_READY_FD  = "TCPWDER_READY_FD"
+
+	/* Time child has to take sockets over and start all servers */
+	READY_TIMEOUT = 30 * time.Second
+)
+
+/**
+ * Socket which fd can be passed to the child
+ */
+type filer interface {
+	File() (*os.File, error)
+}
+
+/* Listening sockets of this process and ones inherited from the parent, keyed by network/address */
+var sockets = struct {
+	sync.Mutex
+	m         map[string]filer
+	inherited map[string]*os.File
+
+	/* Keys of sockets next listener of the same address shares */
+	shared map[string]bool
+}{
+	m:         make(map[string]filer),
+	inherited: make(map[string]*os.File),
+	shared:    make(map[string]bool),
+}
+
+/* Upgrade requests, reply channel receives upgrade result */
+var requests = make(chan chan error)
+
+/* Prevents concurrent upgrades */
+var upgrading sync.Mutex
+
+/* Set when sockets were handed over to ready child */
+var handedOver = struct {
+	sync.Mutex
+	done bool
+}{}
+
+/**
+ * Collect sockets inherited from the parent
+ */
+func init() {
+
+	keys := os.Getenv(ENV_LISTENERS)
+	os.Unsetenv(ENV_LISTENERS)
+
+	if keys == "" {
+		return
+	}
+
+	for i, key := range strings.Split(keys, ",") {
+		sockets.inherited[key] = os.NewFile(uintptr(3+i), key)
+	}
+}
+
+/**
+ * Take inherited socket over, nil if there is no such one
+ */
+func takeInherited(key string) *os.File {
+	sockets.Lock()
+	defer sockets.Unlock()
+
+	f, ok := sockets.inherited[key]
+	if !ok {
+		return nil
+	}
+
+	delete(sockets.inherited, key)
+	return f
+}
+
+/**
+ * Duplicate socket shared with new listener, nil if it's not shared
+ */
+func dupShared(key string) *os.File {
+	sockets.Lock()
+	defer sockets.Unlock()
+
+	socket, ok := sockets.m[key]
+	if !ok || !sockets.shared[key] {
+		return nil
+	}
+
+	f, err := socket.File()
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+/**
+ * Take inherited or shared socket over, nil if there is no such one
+ */
+func take(key string) *os.File {
+	if f := takeInherited(key); f != nil {
+		return f
+	}
+	return dupShared(key)
+}
+
+/**
+ * Let next listener of network address share socket of the current one
+ * instead of binding, so server replacing current one accepts without a gap
+ */
+func Share(network, bind string) {
+	sockets.Lock()
+	sockets.shared[network+"/"+bind] = true
+	sockets.Unlock()
+}
+
+/**
+ * Bind next listeners of network address as usual
+ */
+func Unshare(network, bind string) {
+	sockets.Lock()
+	delete(sockets.shared, network+"/"+bind)
+	sockets.Unlock()
+}
+
+/**
+ * Check if socket was taken over by new process or by new server of
+ * this process, so they read it too and serve new clients
+ */
+func TakenOver(socket interface{}) bool {
+
+	handedOver.Lock()
+	done := handedOver.done
+	handedOver.Unlock()
+
+	if done {
+		return true
+	}
+
+	sockets.Lock()
+	defer sockets.Unlock()
+
+	for _, s := range sockets.m {
+		if s == socket {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Remember socket to pass it to the child on upgrade
+ */
+func register(key string, socket filer) {
+	sockets.Lock()
+	sockets.m[key] = socket
+	sockets.Unlock()
+}
+
+/**
+ * Forget socket closed by its server, so it's not passed to the child
+ */
+func Forget(socket interface{}) {
+	sockets.Lock()
+	for key, s := range sockets.m {
+		if s == socket {
+			delete(sockets.m, key)
+		}
+	}
+	sockets.Unlock()
+}
+
+/**
+ * Listen tcp address, taking inherited or shared listener over if there is one
+ */
+func Listen(bind string) (net.Listener, error) {
+
+	key := "tcp/" + bind
+
+	if f := take(key); f != nil {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err == nil {
+			log.Printf("[INFO] Took tcp listener %s over", bind)
+			register(key, l.(filer))
+			return l, nil
+		}
+		log.Printf("[WARN] Can't use tcp listener %s: %s", bind, err)
+	}
+
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+
+	register(key, l.(filer))
+	return l, nil
+}
+
+/**
+ * Listen udp address, taking inherited or shared connection over if there is one
+ */
+func ListenUDP(bind string) (*net.UDPConn, error) {
+
+	key := "udp/" + bind
+
+	if f := take(key); f != nil {
+		c, err := net.FilePacketConn(f)
+		f.Close()
+		if err == nil {
+			if conn, ok := c.(*net.UDPConn); ok {
+				log.Printf("[INFO] Took udp listener %s over", bind)
+				register(key, conn)
+				return conn, nil
+			}
+			c.Close()
+			err = errors.New("not an udp socket")
+		}
+		log.Printf("[WARN] Can't use udp listener %s: %s", bind, err)
+	}
+
+	listenAddr, err := net.ResolveUDPAddr("udp", bind)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	register(key, conn)
+	return conn, nil
+}
+
+/**
+ * Notify parent that all sockets were taken over and close
+ * inherited ones no longer used by configuration.
+ * Does nothing if process was not started by upgrade
+ */
+func Ready() {
+
+	sockets.Lock()
+	for key, f := range sockets.inherited {
+		log.Printf("[INFO] Closing unused inherited listener %s", key)
+		f.Close()
+	}
+	sockets.inherited = make(map[string]*os.File)
+	sockets.Unlock()
+
+	fd := os.Getenv(ENV_READY_FD)
+	os.Unsetenv(ENV_READY_FD)
+
+	if fd == "" {
+		return
+	}
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		log.Printf("[ERROR] Bad %s: %s", ENV_READY_FD, fd)
+		return
+	}
+
+	f := os.NewFile(uintptr(n), "ready")
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Printf("[ERROR] Can't notify parent process: %s", err)
+	}
+	f.Close()
+}
+
+/**
+ * Relay signals requesting upgrade to channel
+ */
+func Notify(c chan<- os.Signal) {
+	if len(signals) > 0 {
+		signal.Notify(c, signals...)
+	}
+}
+
+/**
+ * Request upgrade from the main loop and wait for the result
+ */
+func Request() error {
+	reply := make(chan error, 1)
+	requests <- reply
+	return <-reply
+}
+
+/**
+ * Returns channel of upgrade requests
+ */
+func Requests() <-chan chan error {
+	return requests
+}
+
+/**
+ * Start new process of the same binary passing listening sockets
+ * to it and wait until it is ready. After success caller should
+ * drain its servers and exit
+ */
+func Upgrade() error {
+
+	upgrading.Lock()
+	defer upgrading.Unlock()
+
+	// binary path, as os.Args[0] may be relative to the PATH entry or to old working directory
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Upgrading, starting %s", executable)
+
+	var keys []string
+	var files []*os.File
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	sockets.Lock()
+	for key, socket := range sockets.m {
+		f, err := socket.File()
+		if err != nil {
+			// socket was closed with its server
+			delete(sockets.m, key)
+			continue
+		}
+		keys = append(keys, key)
+		files = append(files, f)
+	}
+	sockets.Unlock()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		ENV_LISTENERS+"="+strings.Join(keys, ","),
+		ENV_READY_FD+"="+strconv.Itoa(3+len(files)),
+	)
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	// child closes its end of the pipe on exit, so read returns
+	ready := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := r.Read(buf)
+		ready <- n == 1
+	}()
+
+	select {
+	case ok := <-ready:
+		if !ok {
+			cmd.Wait()
+			return errors.New("New process exited before it was ready")
+		}
+	case <-time.After(READY_TIMEOUT):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("New process was not ready in " + READY_TIMEOUT.String())
+	}
+
+	log.Printf("[INFO] New process %d is ready", cmd.Process.Pid)
+	cmd.Process.Release()
+
+	handedOver.Lock()
+	handedOver.done = true
+	handedOver.Unlock()
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package upgrade
+
+import (
+	"net"
+	"testing"
+)
+
+func registered(key string) bool {
+	sockets.Lock()
+	defer sockets.Unlock()
+	_, ok := sockets.m[key]
+	return ok
+}
+
+func TestForget(t *testing.T) {
+
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !registered("tcp/127.0.0.1:0") || !registered("udp/127.0.0.1:0") {
+		t.Fatal("Sockets are not registered")
+	}
+
+	Forget(l)
+	l.Close()
+	Forget(c)
+	c.Close()
+
+	if registered("tcp/127.0.0.1:0") || registered("udp/127.0.0.1:0") {
+		t.Fatal("Closed sockets are still registered")
+	}
+}
+
+func TestShare(t *testing.T) {
+
+	old, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Share("tcp", "127.0.0.1:0")
+	l, err := Listen("127.0.0.1:0")
+	Unshare("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if l.Addr().String() != old.Addr().String() {
+		t.Fatalf("Listener %s is not shared with %s", l.Addr(), old.Addr())
+	}
+	if !TakenOver(old) || TakenOver(l) {
+		t.Fatal("Old listener should be taken over by new one")
+	}
+
+	// new listener keeps accepting once old one is closed
+	Forget(old)
+	old.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+
+	Forget(l)
+}
@@ -0,0 +1,193 @@
+/**
+ * tree.go - path compressed binary radix trees of ip prefixes,
+ * one per address family, so lookup costs O(prefix length)
+ * regardless of number of prefixes
+ */
+
+package cidrtree
+
+import (
+	"math/bits"
+	"net"
+)
+
+type node struct {
+
+	/* Prefix bits, bits after length are zero */
+	key [16]byte
+
+	/* Prefix length in bits */
+	length int
+
+	/* Smallest rule index of the prefix, -1 for branch nodes */
+	rule int
+
+	children [2]*node
+}
+
+/**
+ * Tree of prefixes with rule indexes, lookup finds
+ * the smallest index among prefixes containing ip
+ */
+type Tree struct {
+	v4 *node
+	v6 *node
+}
+
+/**
+ * Returns bit i of the key
+ */
+func keyBit(key *[16]byte, i int) int {
+	return int(key[i/8]>>(7-uint(i%8))) & 1
+}
+
+/**
+ * Returns number of leading bits equal in both keys, not more than max
+ */
+func commonLength(a, b *[16]byte, max int) int {
+	for i := 0; i < 16 && i*8 < max; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i*8 + bits.LeadingZeros8(x)
+			if n > max {
+				return max
+			}
+			return n
+		}
+	}
+	return max
+}
+
+/**
+ * Returns key with bits after length cleared
+ */
+func maskKey(key [16]byte, length int) [16]byte {
+	for i := 0; i < 16; i++ {
+		switch {
+		case length >= (i+1)*8:
+		case length <= i*8:
+			key[i] = 0
+		default:
+			key[i] &= ^byte(0xff >> uint(length-i*8))
+		}
+	}
+	return key
+}
+
+/**
+ * Convert ip to tree key, reporting if it is IPv4 one
+ */
+func ipKey(ip net.IP) ([16]byte, bool) {
+
+	var key [16]byte
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(key[:], ip4)
+		return key, true
+	}
+
+	copy(key[:], ip.To16())
+	return key, false
+}
+
+/**
+ * Returns root of the tree for address family
+ */
+func (this *Tree) rootOf(v4 bool) **node {
+	if v4 {
+		return &this.v4
+	}
+	return &this.v6
+}
+
+/**
+ * Insert prefix with rule index, keeping the smallest
+ * index if prefix is already present
+ */
+func (this *Tree) Insert(network *net.IPNet, rule int) {
+
+	key, v4 := ipKey(network.IP)
+	length, size := network.Mask.Size()
+
+	// IPv4-mapped IPv6 prefix goes to IPv4 tree, with mask of IPv4 bits
+	if v4 && size == 8*net.IPv6len {
+		length -= 8 * (net.IPv6len - net.IPv4len)
+		if length < 0 {
+			length = 0
+		}
+	}
+
+	key = maskKey(key, length)
+
+	p := this.rootOf(v4)
+	for {
+		n := *p
+
+		if n == nil {
+			*p = &node{key: key, length: length, rule: rule}
+			return
+		}
+
+		max := n.length
+		if length < max {
+			max = length
+		}
+		common := commonLength(&n.key, &key, max)
+
+		if common == n.length {
+
+			// same prefix
+			if common == length {
+				if n.rule < 0 || rule < n.rule {
+					n.rule = rule
+				}
+				return
+			}
+
+			// go deeper
+			p = &n.children[keyBit(&key, n.length)]
+			continue
+		}
+
+		// new prefix contains node one
+		if common == length {
+			parent := &node{key: key, length: length, rule: rule}
+			parent.children[keyBit(&n.key, length)] = n
+			*p = parent
+			return
+		}
+
+		// prefixes diverge, branch them
+		branch := &node{key: maskKey(key, common), length: common, rule: -1}
+		branch.children[keyBit(&n.key, common)] = n
+		branch.children[keyBit(&key, common)] = &node{key: key, length: length, rule: rule}
+		*p = branch
+		return
+	}
+}
+
+/**
+ * Returns the smallest rule index among prefixes containing ip
+ */
+func (this *Tree) Lookup(ip net.IP) (int, bool) {
+
+	key, v4 := ipKey(ip)
+
+	best := -1
+	for n := *this.rootOf(v4); n != nil; {
+
+		if commonLength(&n.key, &key, n.length) < n.length {
+			break
+		}
+
+		if n.rule >= 0 && (best < 0 || n.rule < best) {
+			best = n.rule
+		}
+
+		if n.length == 128 {
+			break
+		}
+
+		n = n.children[keyBit(&key, n.length)]
+	}
+
+	return best, best >= 0
+}
@@ -0,0 +1,59 @@
+package cidrtree
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTreeLookup(t *testing.T) {
+
+	tree := &Tree{}
+	for i, cidr := range []string{
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.3/32",
+		"::ffff:192.168.0.0/112",
+		"2001:db8::/32",
+		"0.0.0.0/0",
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Insert(network, i)
+	}
+
+	for ip, expected := range map[string]int{
+		"10.2.0.1":           0,
+		"10.1.2.3":           0,
+		"::ffff:10.1.2.3":    0,
+		"192.168.1.1":        3,
+		"::ffff:192.168.1.1": 3,
+		"192.169.0.1":        5,
+		"2001:db8::1":        4,
+		"2001:db9::1":        -1,
+	} {
+		rule, ok := tree.Lookup(net.ParseIP(ip))
+		if expected < 0 && ok || expected >= 0 && rule != expected {
+			t.Errorf("%s: expected rule %d, got %d %v", ip, expected, rule, ok)
+		}
+	}
+}
+
+func TestTreeMappedPrefix(t *testing.T) {
+
+	tree := &Tree{}
+	_, network, _ := net.ParseCIDR("::ffff:10.0.0.0/104")
+	tree.Insert(network, 0)
+
+	for _, ip := range []string{"10.0.0.1", "10.255.255.255", "::ffff:10.1.1.1"} {
+		if _, ok := tree.Lookup(net.ParseIP(ip)); !ok {
+			t.Errorf("%s is not matched by ::ffff:10.0.0.0/104", ip)
+		}
+	}
+	for _, ip := range []string{"11.0.0.1", "2001:db8::1"} {
+		if _, ok := tree.Lookup(net.ParseIP(ip)); ok {
+			t.Errorf("%s is matched by ::ffff:10.0.0.0/104", ip)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+type geoDB struct {
+	modTime time.Time
+	reader  *geoip2.Reader
+}
+
+/* Loaded MaxMind databases by path, shared by servers */
+var geoDBs = struct {
+	sync.Mutex
+	m map[string]geoDB
+}{
+	m: make(map[string]geoDB),
+}
+
+// LoadGeoDB load MaxMind mmdb database, reusing already loaded one if file is not modified.
+// Database is read to memory, so replaced reader is collected once no filter uses it
+func LoadGeoDB(path string) (*geoip2.Reader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	geoDBs.Lock()
+	defer geoDBs.Unlock()
+
+	if db, ok := geoDBs.m[path]; ok && db.modTime.Equal(info.ModTime()) {
+		return db.reader, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := geoip2.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	geoDBs.m[path] = geoDB{modTime: info.ModTime(), reader: reader}
+	return reader, nil
+}
@@ -8,6 +8,11 @@ package tls
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+
+	"github.com/millken/tcpwder/config"
 )
 
 /**
@@ -71,3 +76,53 @@ func MapCiphers(ciphers []string) []uint16 {
 
 	return result
 }
+
+/**
+ * Prepare tls config used to connect to backends
+ */
+func PrepareBackendsTlsConfig(cfg config.BackendsTls) (*tls.Config, error) {
+
+	var err error
+
+	result := &tls.Config{
+		InsecureSkipVerify:       cfg.IgnoreVerify,
+		CipherSuites:             MapCiphers(cfg.Ciphers),
+		PreferServerCipherSuites: cfg.PreferServerCiphers,
+		MinVersion:               MapVersion(cfg.MinVersion),
+		MaxVersion:               MapVersion(cfg.MaxVersion),
+		SessionTicketsDisabled:   !cfg.SessionTickets,
+	}
+
+	if cfg.CertPath != nil && cfg.KeyPath != nil {
+
+		var crt tls.Certificate
+
+		if crt, err = tls.LoadX509KeyPair(*cfg.CertPath, *cfg.KeyPath); err != nil {
+			log.Printf("[ERROR] prepareBackendsTls : %s", err)
+			return nil, err
+		}
+
+		result.Certificates = []tls.Certificate{crt}
+	}
+
+	if cfg.RootCaCertPath != nil {
+
+		var caCertPem []byte
+
+		if caCertPem, err = ioutil.ReadFile(*cfg.RootCaCertPath); err != nil {
+			log.Printf("[ERROR] %s", err)
+			return nil, err
+		}
+
+		caCertPool := x509.NewCertPool()
+		if ok := caCertPool.AppendCertsFromPEM(caCertPem); !ok {
+			log.Printf("[ERROR] Unable to load root pem")
+		}
+
+		result.RootCAs = caCertPool
+
+	}
+
+	return result, nil
+
+}